@@ -0,0 +1,166 @@
+/*
+ *  Copyright (c) 2011 NeuStar, Inc.
+ *  All rights reserved.  
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at 
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *  
+ *  NeuStar, the Neustar logo and related names and logos are registered
+ *  trademarks, service marks or tradenames of NeuStar, Inc. All other 
+ *  product names, company names, marks, logos and symbols may be trademarks
+ *  of their respective owners.
+ */
+
+package kafka
+
+import (
+  "encoding/binary"
+  "fmt"
+  "net"
+)
+
+// Like Consume, but the messages of the fetch are handed to handlerFunc from a pool of workers goroutines,
+// so a handler waiting on I/O doesn't hold up the others. Messages may be handled concurrently and in any
+// order. The offset (and any OffsetStore commit) only moves past a message once it and every message before
+// it have been handled, so consuming always resumes at or before the first unhandled message.
+// Returns once every message of the fetch has been handled.
+func (consumer *BrokerConsumer) ConsumeConcurrent(workers int, handlerFunc MessageHandlerFunc) (int, error) {
+  if consumer.isClosed() {
+    return -1, ErrConsumerClosed
+  }
+  if workers < 1 {
+    workers = 1
+  }
+  conn, err := consumer.broker.connect()
+  if err != nil {
+    return -1, err
+  }
+
+  before := consumer.offset
+  num, err := consumer.consumeConcurrently(conn, workers, handlerFunc)
+  err = consumer.reportFetch(conn, before, num, err)
+  consumer.releaseConn(conn, err)
+  if err != nil {
+    consumer.broker.logger.Printf("Fatal Error: %v\n", err)
+    return num, err
+  }
+  if num == 0 && consumer.offset == before {
+    return 0, ErrNoMessages
+  }
+  return num, nil
+}
+
+// A single fetch for ConsumeConcurrent, advancing the offset as a watermark behind the workers
+func (consumer *BrokerConsumer) consumeConcurrently(conn net.Conn, workers int, handlerFunc MessageHandlerFunc) (int, error) {
+  if err := consumer.loadStoredOffset(); err != nil {
+    return -1, err
+  }
+  consumer.resolveLatestOffset(conn)
+  defer consumer.holdFetchBuffer()()
+  _, payload, err := consumer.fetchComplete(conn)
+  if err != nil {
+    return -1, err
+  }
+  msgs, end, decodeErr := consumer.decodeFetched(payload)
+
+  // the filters keep state, so they see the messages in offset order before any is handed out
+  handle := make([]bool, len(msgs))
+  admitted := []int{}
+  for i, msg := range msgs {
+    if consumer.MaxMessagesPerFetch > 0 && len(admitted) >= consumer.MaxMessagesPerFetch && msgs[i-1].offset != msg.offset {
+      // the rest of the fetch is read again by the next one
+      msgs, end, decodeErr = msgs[:i], msg.offset, nil
+      break
+    }
+    msg.partition = consumer.broker.partition
+    msg.targetPartition = consumer.broker.partition
+    if consumer.DetectDuplicates && (i == 0 || msgs[i-1].offset != msg.offset) {
+      consumer.checkDuplicate(msg.offset)
+    }
+    if handle[i] = consumer.admit(msg); handle[i] {
+      admitted = append(admitted, i)
+    }
+  }
+
+  jobs := make(chan int)
+  finished := make(chan int)
+  for w := 0; w < workers; w++ {
+    go func() {
+      for i := range jobs {
+        handlerFunc(msgs[i])
+        finished <- i
+      }
+    }()
+  }
+  go func() {
+    defer close(jobs)
+    for _, i := range admitted {
+      consumer.limiter.wait(len(msgs[i].payload))
+      jobs <- i
+    }
+  }()
+
+  handled := make([]bool, len(msgs))
+  next := 0
+  var commitErr error
+  // move the offset past every message handled (or filtered out) with none unhandled before it
+  advance := func() {
+    for ; commitErr == nil && next < len(msgs) && (handled[next] || !handle[next]); next++ {
+      msg := msgs[next]
+      // messages of a compressed set share an offset, resuming before the last of them replays the set
+      resumeAt := msg.offset
+      if next == len(msgs)-1 || msgs[next+1].offset != msg.offset {
+        resumeAt = msg.nextOffset
+      }
+      if handle[next] {
+        if err := consumer.commitHandled(resumeAt); err != nil {
+          commitErr = fmt.Errorf("committing offset %d: %w", resumeAt, err)
+          return
+        }
+      }
+      consumer.setOffset(resumeAt)
+    }
+  }
+  advance()
+  for range admitted {
+    handled[<-finished] = true
+    advance()
+  }
+
+  if commitErr != nil {
+    return len(admitted), commitErr
+  }
+  if decodeErr != nil {
+    // the offset stopped at the message that failed to decode
+    return len(admitted), decodeErr
+  }
+  consumer.setOffset(end)
+  return len(admitted), nil
+}
+
+// Decode the complete messages of a fetch from the current offset, passing over those that fail to decode
+// under SkipCorrupted. Returns them and the offset following them, or stops at the first that fails.
+func (consumer *BrokerConsumer) decodeFetched(payload []byte) ([]*Message, uint64, error) {
+  msgs := []*Message{}
+  var current uint64 = 0
+  for {
+    decoded, consumed, err := decodeMessageSet(payload[current:], consumer.offset+current, consumer.codecs, consumer.messageFormat())
+    msgs = append(msgs, decoded...)
+    current += consumed
+    if err == nil || !consumer.SkipCorrupted {
+      return msgs, consumer.offset + current, err
+    }
+    consumer.corrupted.Add(1)
+    consumer.broker.logger.Printf("ERROR: [%s] skipping corrupt message at offset %d: %v\n", consumer.broker.topic, consumer.offset+current, err)
+    current += 4 + uint64(binary.BigEndian.Uint32(payload[current:]))
+  }
+}
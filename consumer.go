@@ -23,24 +23,269 @@
 package kafka
 
 import (
+  "bytes"
+  "context"
+  "crypto/tls"
   "encoding/binary"
   "errors"
+  "fmt"
+  "hash/crc32"
   "io"
-  "log"
+  "math"
+  "math/rand"
   "net"
   "time"
   "os"
+  "sync"
+  "sync/atomic"
 )
 
 const (
   CONNECTION_RETRY_WAIT_IN_SECONDS = 10
+  // minimum number of bytes sampled by WarmUp
+  WARMUP_SAMPLE_SIZE = 1048576
+  // number of recently delivered offsets remembered by DetectDuplicates
+  DUPLICATE_WINDOW_SIZE = 1024
+  // reconnect backoff in ConsumeOnChannel, unless set on the consumer
+  DEFAULT_RECONNECT_BACKOFF_MS     = 100
+  DEFAULT_MAX_RECONNECT_BACKOFF_MS = 30000
+  DEFAULT_MAX_RECONNECT_ATTEMPTS   = 10
+  // how long ConsumeWithContext waits between fetches once caught up
+  DEFAULT_POLL_TIMEOUT_MS = 1000
+  // how often the lag hooks query the latest offset when LagCheckInterval isn't set
+  DEFAULT_LAG_CHECK_INTERVAL_IN_SECONDS = 30
+  // maxSize of NewBrokerLatestConsumer, which doesn't take one
+  DEFAULT_MAX_SIZE = 1048576
+  // the largest maxSize AutoGrowMaxSize grows to when MaxSizeLimit isn't set
+  DEFAULT_MAX_SIZE_LIMIT = 64 * 1048576
+  // how much longer each fetch without new messages makes the poll interval, up to MaxPollInterval
+  POLL_BACKOFF_MULTIPLIER = 2
+  // fetches in a row without messages after which ConsumeN returns what it has, unless MaxEmptyPolls is set,
+  // and how long it waits after each
+  DEFAULT_MAX_EMPTY_POLLS = 3
+  EMPTY_POLL_WAIT_MS      = 100
+  // how often WaitForDelivery checks whether the channel has been drained
+  DELIVERY_POLL_INTERVAL_MS = 10
 )
 
+// Returned (wrapped, test with errors.Is) when the message at the consumer's offset is bigger than maxSize,
+// so a fetch can't return any of it whole and consuming would stall there
+var ErrMessageTooLarge = errors.New("message larger than maxSize")
+
+// Returned by the consume calls on a consumer after Close
+var ErrConsumerClosed = errors.New("consumer closed")
+
+// Returned by Consume and ConsumeE when the broker has no messages at the consumer's offset: the consumer
+// is caught up, as opposed to io.EOF or another error from a dropped connection
+var ErrNoMessages = errors.New("no messages at offset")
+
+// Returned by ConsumeOnChannelWithResult's handler for a message quit kept off the channel, which stops the
+// fetch before the message is committed
+var errQuitDelivery = errors.New("quit before delivery")
+
 type BrokerConsumer struct {
   broker  *Broker
   offset  uint64
   maxSize uint32
   codecs  map[byte]PayloadCodec
+
+  // when > 0, the polling loops log a liveness line after being idle (no messages) this long
+  IdleHeartbeat time.Duration
+  // when set, called by the polling loops (ConsumeUntilQuit and the channel consumers) after every fetch with
+  // the number of messages it produced, the offset it left, and its error (nil, or io.EOF when the broker
+  // closed the connection). Called from the consuming goroutine, so it should return quickly.
+  OnPoll func(fetched int, offset uint64, err error)
+
+  // number of successfully decoded messages to discard immediately after a Seek, to resync
+  // onto message boundaries when the seek offset is imprecise. Has no effect without a Seek.
+  SkipInitial int
+
+  // when true, remember a bounded window of recently delivered offsets and log/count any repeat
+  // before it is handed to the handler (the message is still delivered)
+  DetectDuplicates bool
+
+  // how ConsumeToWriter separates payloads, defaults to FRAMING_LENGTH_PREFIX
+  Framing Framing
+
+  // when true, WarmUp raises maxSize to fit the largest message it observes
+  WarmUpAutoAdjust bool
+
+  // when set, only messages whose payload starts with these bytes reach the handler,
+  // the offset still advances over the rest
+  PrefixFilter []byte
+
+  // fraction (0..1) of messages handed to the handler, the offset still advances over all of them.
+  // 0 (the default) delivers every message.
+  SampleRate float64
+  // seed for the sampling, for reproducible runs; 0 seeds from the clock
+  SampleSeed int64
+
+  // called from the polling loops when the byte lag behind the latest offset goes above LagThreshold,
+  // and OnLagRecovered when it drops back to or below it. The latest offset is queried at most
+  // every LagCheckInterval (default DEFAULT_LAG_CHECK_INTERVAL_IN_SECONDS).
+  OnLagExceeded    func(lag uint64)
+  OnLagRecovered   func(lag uint64)
+  LagThreshold     uint64
+  LagCheckInterval time.Duration
+
+  // ConsumeOnChannel reconnects after a connection error, waiting ReconnectBackoffBase before the first
+  // attempt and doubling up to ReconnectBackoffMax between attempts. After MaxReconnectAttempts failed
+  // attempts (negative disables reconnecting) the error is returned. Zero values use the DEFAULT_ constants.
+  ReconnectBackoffBase time.Duration
+  ReconnectBackoffMax  time.Duration
+  MaxReconnectAttempts int
+
+  // when set, the consume loops publish what they are doing here (see ConsumeEvent)
+  Events chan ConsumeEvent
+
+  // when true, the next fetch is issued in the background, at the offset following the messages just
+  // fetched, while the handler works through them. Messages are still handled one fetch at a time in
+  // offset order; a prefetch is discarded if the offset has moved elsewhere (e.g. Seek) by then.
+  Prefetch bool
+
+  // when set, the offset is loaded from here before the first fetch (overriding the constructor's, unless
+  // Seek was called) and committed after every CommitInterval successfully handled messages, or once
+  // CommitEvery has passed since the last commit (checked as messages are handled), whichever comes first;
+  // with neither set, after every message. Close (or FlushOffset) commits what's left uncommitted.
+  // The committed offset never passes an unhandled message, so a restart redelivers rather than loses.
+  OffsetStore    OffsetStore
+  CommitInterval int
+  CommitEvery    time.Duration
+
+  // how long a request may take to write, and how long to wait on the broker for each part of its response,
+  // before failing with a timeout (a net.Error, so ConsumeOnChannel reconnects). Zero waits indefinitely.
+  ReadTimeout  time.Duration
+  WriteTimeout time.Duration
+
+  // when true, a fetch that holds only part of a message is retried with maxSize doubled, up to
+  // MaxSizeLimit (default DEFAULT_MAX_SIZE_LIMIT), rather than failing with ErrMessageTooLarge
+  AutoGrowMaxSize bool
+  MaxSizeLimit    uint32
+
+  // when true, the channel consumers issue the next fetch only once the receiver has taken every message of
+  // the previous one off the channel (buffered ones included), and Prefetch is ignored
+  WaitForDelivery bool
+  // while a channel consumer has been blocked delivering for this long, a cheap offsets request is sent
+  // on its connection every BlockedKeepAlive, so the broker doesn't drop it as idle. Zero disables.
+  BlockedKeepAlive time.Duration
+
+  // when > 0, the channel consumers send a cheap offsets request on their connection when it has gone this
+  // long without a fetch (a pollTimeoutMs longer than it), so a dropped connection is found, and replaced,
+  // before the next fetch. See also SetKeepAlive.
+  HeartbeatInterval time.Duration
+
+  // when longer than the poll interval (pollTimeoutMs, or DEFAULT_POLL_TIMEOUT_MS for ConsumeWithContext),
+  // the polling loops wait POLL_BACKOFF_MULTIPLIER times longer after each fetch that brought nothing new,
+  // up to this, and go back to the poll interval once messages arrive. Zero polls at a fixed interval.
+  MaxPollInterval time.Duration
+
+  // how many fetches in a row without messages ConsumeN makes before giving up, default DEFAULT_MAX_EMPTY_POLLS
+  MaxEmptyPolls int
+
+  // when > 0, a fetch hands at most this many messages to the handler (all of a compressed set's, once
+  // started), the offset moving just past the last of them so the next fetch picks up from there.
+  // Prefetch is ignored.
+  MaxMessagesPerFetch int
+
+  // when true, a message that fails to decode (e.g. a checksum mismatch) is logged, counted and skipped over
+  // by its declared length, rather than failing the fetch and being read again by the next one
+  SkipCorrupted bool
+
+  // when true, the payloads of uncompressed messages are framed with a key (see NewKeyedMessage), which is
+  // split off into Key(). Only set it for topics published that way, a payload that isn't fails to decode.
+  KeyedPayloads bool
+
+  // when true, each fetch response is read into the same buffer, which decoded (uncompressed) messages
+  // reference rather than own: a message's PayloadRef is only valid until the next fetch, or Close, use
+  // Payload for a copy that outlives it. The channel consumers may fetch again before the receiver is done
+  // with a message, unless WaitForDelivery is set. The buffer comes from a pool shared by all consumers and
+  // goes back to it on Close (once the fetch in progress, if any, is handled). Ignored with Prefetch.
+  ZeroCopy bool
+
+  skipRemaining  int
+  recentOffsets  *offsetWindow
+  sampler        *rand.Rand
+  prefetched     *prefetch
+  // guards writes to offset and maxSize, so they can be read from outside the consume loop (Offset, Stats)
+  lock           sync.RWMutex
+  // counters that Stats may read while a consume loop updates them
+  skippedInitial atomic.Uint64
+  duplicates     atomic.Uint64
+  sampled        atomic.Uint64
+  sampledOut     atomic.Uint64
+  prefixMatched  atomic.Uint64
+  prefixSkipped  atomic.Uint64
+  consumed       atomic.Uint64
+  skipped        atomic.Uint64
+  corrupted      atomic.Uint64
+  bytesRead      atomic.Uint64
+  lastErr        atomic.Pointer[error]
+  blockedSince   atomic.Int64 // unix nanos since when delivery has been blocked, 0 when it isn't
+  storeLoaded    bool
+  startAtLatest  bool // resolve the latest offset before the first fetch, see WithLatestOffset
+  // guards uncommitted, pendingCommit and lastCommit, which Close flushes from outside the consume loop
+  commitLock     sync.Mutex
+  uncommitted    int    // messages handled since the last commit
+  pendingCommit  uint64 // where to resume after the last handled message
+  lastCommit     time.Time
+  limiter        rateLimiter
+  // ZeroCopy's response buffer, from fetchBuffers, and whether a fetch is using it (guarded by bufLock)
+  bufLock        sync.Mutex
+  fetchBuf       *[]byte
+  fetching       bool
+  rangeEnd       uint64 // ConsumeRange's end, fetches stop at the first message there or beyond; 0 for none
+  // closed by Close, once, to stop the consume loops
+  closed         chan bool
+  closeOnce      sync.Once
+}
+
+// Counters accumulated by a BrokerConsumer, see Stats()
+type ConsumerStats struct {
+  SkippedInitial uint64 // messages discarded by SkipInitial after a Seek
+  Duplicates     uint64 // repeated offsets seen with DetectDuplicates
+  Sampled        uint64 // messages delivered under SampleRate
+  SampledOut     uint64 // messages skipped by SampleRate
+  PrefixMatched  uint64 // messages matching PrefixFilter
+  PrefixSkipped  uint64 // messages skipped by PrefixFilter
+  Consumed       uint64 // messages handed to a handler
+  Skipped        uint64 // fetches that failed, their messages are left to a later fetch
+  Corrupted      uint64 // messages passed over by SkipCorrupted
+  Bytes          uint64 // length of the fetch responses read
+  LastError      error  // what the last failed fetch returned, nil if none has
+  // whether a channel consumer is waiting on its receiver right now, and for how long it has been
+  DeliveryBlocked bool
+  BlockedFor      time.Duration
+  // where the next fetch starts, and how much it asks for
+  Offset  uint64
+  MaxSize uint32
+}
+
+// A bounded set of the most recently seen offsets
+type offsetWindow struct {
+  seen map[uint64]bool
+  ring []uint64
+  next int
+}
+
+func newOffsetWindow(size int) *offsetWindow {
+  return &offsetWindow{seen: make(map[uint64]bool, size), ring: make([]uint64, 0, size)}
+}
+
+// Records offset, returning true if it was already in the window
+func (w *offsetWindow) add(offset uint64) bool {
+  if w.seen[offset] {
+    return true
+  }
+  if len(w.ring) < cap(w.ring) {
+    w.ring = append(w.ring, offset)
+  } else {
+    // evict the oldest offset
+    delete(w.seen, w.ring[w.next])
+    w.ring[w.next] = offset
+    w.next = (w.next + 1) % len(w.ring)
+  }
+  w.seen[offset] = true
+  return false
 }
 
 // Create a new broker consumer
@@ -50,10 +295,7 @@ type BrokerConsumer struct {
 // offset to start consuming from
 // maxSize (in bytes) of the message to consume (this should be at least as big as the biggest message to be published)
 func NewBrokerConsumer(hostname string, topic string, partition int, offset uint64, maxSize uint32) *BrokerConsumer {
-  return &BrokerConsumer{broker: newBroker(hostname, topic, partition),
-    offset:  offset,
-    maxSize: maxSize,
-    codecs:  DefaultCodecsMap}
+  return NewConsumer(hostname, topic, partition, WithOffset(offset), WithMaxSize(maxSize))
 }
 
 // Simplified consumer that defaults the offset and maxSize to 0.
@@ -61,10 +303,16 @@ func NewBrokerConsumer(hostname string, topic string, partition int, offset uint
 // topic to consume
 // partition to consume from
 func NewBrokerOffsetConsumer(hostname string, topic string, partition int) *BrokerConsumer {
-  return &BrokerConsumer{broker: newBroker(hostname, topic, partition),
-    offset:  0,
-    maxSize: 0,
-    codecs:  DefaultCodecsMap}
+  return NewConsumer(hostname, topic, partition)
+}
+
+// Consumer of new messages only: it starts from the latest offset, which it looks up on its first fetch.
+// If that lookup fails it consumes from offset 0 instead. maxSize is DEFAULT_MAX_SIZE.
+// hostname - host and optionally port, delimited by ':'
+// topic to consume
+// partition to consume from
+func NewBrokerLatestConsumer(hostname string, topic string, partition int) *BrokerConsumer {
+  return NewConsumer(hostname, topic, partition, WithMaxSize(DEFAULT_MAX_SIZE), WithLatestOffset())
 }
 
 // Add Custom Payload Codecs for Consumer Decoding
@@ -76,178 +324,1698 @@ func (consumer *BrokerConsumer) AddCodecs(payloadCodecs []PayloadCodec) {
   }
 }
 
-// Keeps consuming forward until quit, outputing errors, but not dying on them
+// Make connections to the broker originate from addr (e.g. a *net.TCPAddr with port 0),
+// for routing or firewall rules on multi-homed hosts. nil restores the default.
+func (consumer *BrokerConsumer) SetLocalAddr(addr net.Addr) error {
+  return consumer.broker.setLocalAddr(addr)
+}
+
+// Open broker connections with dialer instead of a plain TCP dial, e.g. to go through a proxy or TLS, or to
+// run against an in-memory connection in tests. nil restores the default.
+func (consumer *BrokerConsumer) SetDialer(dialer func(network, addr string) (net.Conn, error)) {
+  consumer.broker.Dialer = dialer
+}
+
+// Connect to the broker over TLS with config (nil goes back to plain TCP). The broker's certificate is
+// verified against config.ServerName, or each endpoint's host when that's empty; set
+// config.InsecureSkipVerify for a broker with a self-signed certificate, e.g. in development.
+// Applies on top of a dialer set with SetDialer. A failed handshake is returned as a connection error.
+func (consumer *BrokerConsumer) SetTLS(config *tls.Config) {
+  consumer.broker.setTLS(config)
+}
+
+// Have onTiming called with how long each connect, request write and response read takes, labelled
+// TIMING_CONNECT, TIMING_WRITE or TIMING_READ, e.g. to feed latency metrics. nil stops the reports.
+// It's called from the goroutine doing the work, which it holds up, so it should return quickly.
+func (consumer *BrokerConsumer) SetOnTiming(onTiming func(label string, d time.Duration)) {
+  consumer.broker.onTiming = onTiming
+}
+
+// Verify message checksums with table instead of IEEE, e.g. crc32.MakeTable(crc32.Castagnoli) to read
+// from producers using that polynomial. nil goes back to IEEE. The publisher's SetChecksumTable must match.
+func (consumer *BrokerConsumer) SetChecksumTable(table *crc32.Table) {
+  consumer.broker.setChecksumTable(table)
+}
+
+// Set the TCP keepalive period of the connections dialed to the broker, so connections dropped between
+// fetches by a firewall or NAT are noticed. 0 keeps Go's default, negative disables TCP keepalive.
+// Has no effect on connections from a dialer (see SetDialer) that aren't a *net.TCPConn.
+func (consumer *BrokerConsumer) SetKeepAlive(period time.Duration) {
+  consumer.broker.keepAlive = period
+}
+
+// Cap the rate messages are handed to the handler at, e.g. to replay a backlog without overwhelming what
+// it's written to. Messages are spaced out evenly rather than let through in bursts. A rate of 0 leaves
+// that dimension unlimited (the default), bytes counting payloads. Safe to call while consuming, to
+// speed up or slow down a running consumer.
+func (consumer *BrokerConsumer) SetRateLimit(messagesPerSecond float64, bytesPerSecond float64) {
+  consumer.limiter.set(messagesPerSecond, bytesPerSecond)
+}
+
+// The bytes the next fetch would send for the current offset and maxSize, nothing is sent
+func (consumer *BrokerConsumer) DebugConsumeRequest() []byte {
+  consumer.lock.RLock()
+  defer consumer.lock.RUnlock()
+  return consumer.broker.EncodeConsumeRequest(consumer.offset, consumer.maxSize)
+}
+
+// The bytes GetOffsets(time, maxNumOffsets) would send, nothing is sent
+func (consumer *BrokerConsumer) DebugOffsetRequest(time int64, maxNumOffsets uint32) []byte {
+  return consumer.broker.EncodeOffsetRequest(time, maxNumOffsets)
+}
+
+// Cap the length of a broker response the consumer will accept; a larger declared length (from a corrupt
+// or out of step connection) is returned as an error rather than allocated. 0 restores the default of
+// MAX_RESPONSE_SIZE_MULTIPLE times the size expected (maxSize for fetches) plus MAX_RESPONSE_SLACK_BYTES.
+func (consumer *BrokerConsumer) SetMaxResponseBytes(maxResponseBytes uint32) {
+  consumer.broker.maxResponseBytes = maxResponseBytes
+}
+
+// Route the consumer's error and warning logging to logger (NopLogger to silence it), nil restores DefaultLogger
+func (consumer *BrokerConsumer) SetLogger(logger Logger) {
+  consumer.broker.setLogger(logger)
+}
+
+// Set how many idle connections are kept for reuse by the one-shot calls (Consume, GetOffsets, ...)
+func (consumer *BrokerConsumer) SetMaxIdleConnections(maxIdle int) {
+  consumer.broker.lock.Lock()
+  consumer.broker.maxIdle = maxIdle
+  consumer.broker.lock.Unlock()
+}
+
+// Stop the consumer: a consume loop in progress stops as on quit, later consume calls return
+// ErrConsumerClosed, the offset of the messages handled so far is committed to OffsetStore (see FlushOffset),
+// and the idle pooled connections are closed. Closing again only closes idle connections.
+func (consumer *BrokerConsumer) Close() error {
+  consumer.closeOnce.Do(func() { close(consumer.closed) })
+  consumer.bufLock.Lock()
+  consumer.releaseFetchBuffer()
+  consumer.bufLock.Unlock()
+  flushErr := consumer.FlushOffset()
+  if err := consumer.broker.Close(); err != nil {
+    return err
+  }
+  return flushErr
+}
+
+func (consumer *BrokerConsumer) isClosed() bool {
+  select {
+  case <-consumer.closed:
+    return true
+  default:
+    return false
+  }
+}
+
+// conn with ReadTimeout and WriteTimeout applied to each read and write, for one request/response exchange
+func (consumer *BrokerConsumer) timed(conn net.Conn) net.Conn {
+  if consumer.ReadTimeout <= 0 && consumer.WriteTimeout <= 0 {
+    return conn
+  }
+  return &deadlineConn{Conn: conn, readTimeout: consumer.ReadTimeout, writeTimeout: consumer.WriteTimeout}
+}
+
+// Give a connection back to the broker's pool, unless a prefetch is still using it
+func (consumer *BrokerConsumer) releaseConn(conn net.Conn, err error) {
+  if consumer.prefetched != nil && consumer.prefetched.conn == conn {
+    consumer.prefetched = nil
+    conn.Close()
+    return
+  }
+  consumer.broker.release(conn, err)
+}
+
+// Returns a snapshot of the consumer's counters, safe to call while a consume loop runs (e.g. from a
+// monitoring goroutine)
+func (consumer *BrokerConsumer) Stats() ConsumerStats {
+  consumer.lock.RLock()
+  stats := ConsumerStats{Offset: consumer.offset, MaxSize: consumer.maxSize}
+  consumer.lock.RUnlock()
+  stats.SkippedInitial = consumer.skippedInitial.Load()
+  stats.Duplicates = consumer.duplicates.Load()
+  stats.Sampled = consumer.sampled.Load()
+  stats.SampledOut = consumer.sampledOut.Load()
+  stats.PrefixMatched = consumer.prefixMatched.Load()
+  stats.PrefixSkipped = consumer.prefixSkipped.Load()
+  stats.Consumed = consumer.consumed.Load()
+  stats.Skipped = consumer.skipped.Load()
+  stats.Corrupted = consumer.corrupted.Load()
+  stats.Bytes = consumer.bytesRead.Load()
+  if err := consumer.lastErr.Load(); err != nil {
+    stats.LastError = *err
+  }
+  if since := consumer.blockedSince.Load(); since != 0 {
+    stats.DeliveryBlocked = true
+    stats.BlockedFor = time.Since(time.Unix(0, since))
+  }
+  return stats
+}
+
+// The offset the next fetch starts at, safe to call while a consume loop runs
+func (consumer *BrokerConsumer) Offset() uint64 {
+  consumer.lock.RLock()
+  defer consumer.lock.RUnlock()
+  return consumer.offset
+}
+
+// The offset the consumer will fetch from next, the same as Offset. Checkpoint it after consuming to
+// restart where this consumer left off, e.g. with NewBrokerConsumer(..., consumer.CurrentOffset(), ...).
+func (consumer *BrokerConsumer) CurrentOffset() uint64 {
+  return consumer.Offset()
+}
+
+// Move the offset from the consume loop. The loop reads it without locking, as only it (or Seek,
+// which isn't called while consuming) writes it.
+func (consumer *BrokerConsumer) setOffset(offset uint64) {
+  consumer.lock.Lock()
+  consumer.offset = offset
+  consumer.lock.Unlock()
+}
+
+func (consumer *BrokerConsumer) setMaxSize(maxSize uint32) {
+  consumer.lock.Lock()
+  consumer.maxSize = maxSize
+  consumer.lock.Unlock()
+}
+
+// Repositions the consumer to offset; the next fetch starts there.
+// If SkipInitial is set, that many decoded messages are discarded after the seek.
+// Seeking isn't safe while a consume loop (ConsumeOnChannel, ConsumeUntilQuit, ...) is running, as the
+// loop moves the offset itself; stop it first, e.g. on ErrOffsetOutOfRange, then seek and start again.
+func (consumer *BrokerConsumer) Seek(offset uint64) {
+  consumer.lock.Lock()
+  defer consumer.lock.Unlock()
+  consumer.offset = offset
+  consumer.skipRemaining = consumer.SkipInitial
+  consumer.storeLoaded = true // an explicit position wins over the OffsetStore
+  consumer.startAtLatest = false // and over WithLatestOffset
+  consumer.commitLock.Lock()
+  consumer.uncommitted = 0 // and over what was handled before it
+  consumer.commitLock.Unlock()
+}
+
+// Seek to the earliest offset the broker still holds, see Seek
+func (consumer *BrokerConsumer) SeekToEarliest() error {
+  return consumer.seekToTime(-2)
+}
+
+// Seek to the offset the next published message will get, see Seek
+func (consumer *BrokerConsumer) SeekToLatest() error {
+  return consumer.seekToTime(-1)
+}
+
+// How the consumer's messages are read, see SetChecksumTable and KeyedPayloads
+func (consumer *BrokerConsumer) messageFormat() messageFormat {
+  return messageFormat{crcTable: consumer.broker.crcTable, keyed: consumer.KeyedPayloads}
+}
+
+// Once, before the first fetch with WithLatestOffset: move to the latest offset. When the broker
+// can't give it, consumption goes on from the current offset rather than failing.
+func (consumer *BrokerConsumer) resolveLatestOffset(conn net.Conn) {
+  if !consumer.startAtLatest {
+    return
+  }
+  consumer.startAtLatest = false
+  offsets, err := consumer.broker.getOffsetsWithConn(conn, -1, 1)
+  if err == nil && len(offsets) == 0 {
+    err = errors.New("no offset returned")
+  }
+  if err != nil {
+    consumer.broker.logger.Printf("WARN: [%s] couldn't look up the latest offset, consuming from %d: %v\n", consumer.broker.topic, consumer.offset, err)
+    return
+  }
+  consumer.setOffset(offsets[0])
+}
+
+// Seek to the single offset GetOffsets returns for time (-1 latest, -2 earliest)
+func (consumer *BrokerConsumer) seekToTime(time int64) error {
+  offsets, err := consumer.GetOffsets(time, 1)
+  if err != nil {
+    return err
+  }
+  if len(offsets) == 0 {
+    return fmt.Errorf("no offset returned for time %d", time)
+  }
+  consumer.Seek(offsets[0])
+  return nil
+}
+
+// Keeps consuming forward until quit (or Close), outputing errors, but not dying on them.
+// Returns the number of messages handled and the number of fetches that failed (plus messages passed over by SkipCorrupted).
+// An endpoint that doesn't serve the partition (a *WrongBrokerError) is left for another; once
+// none remain, e.g. with a single broker, consumption stops with that error.
 func (consumer *BrokerConsumer) ConsumeUntilQuit(pollTimeoutMs int64, quit chan os.Signal, msgHandler func(*Message)) (int64, int64, error) {
   messageCount := int64(0)
   skippedMessageCount := int64(0)
   
-  quitReceived := false
-  done := make(chan bool, 1)
-  
+  if consumer.isClosed() {
+    return 0, 0, ErrConsumerClosed
+  }
+  // closed on quit (or Close), which cuts short the waits between fetches but not a fetch in flight
+  stopping := make(chan bool)
+  done := make(chan bool)
+  defer close(done)
   go func() {
-    <-quit
-    quitReceived = true
+    select {
+    case <-quit:
+    case <-consumer.closed:
+    case <-done:
+      return
+    }
+    close(stopping)
   }()
   
-  go func() {
-    var conn *net.TCPConn
-    var lastConnectError error
-
-    conn, lastConnectError = consumer.broker.connect()
-    
-    for !quitReceived {
-      if lastConnectError != nil { 
-        conn, lastConnectError = consumer.broker.connect()
-        if lastConnectError != nil {
-          log.Printf("ERROR: [%s] Couldn't connect to Kafka server: %#v, sleeping %d seconds to retry...\n",  consumer.broker.topic, lastConnectError, CONNECTION_RETRY_WAIT_IN_SECONDS)
-          time.Sleep(time.Duration(CONNECTION_RETRY_WAIT_IN_SECONDS * 1000) * time.Millisecond)
-        }
-      } 
+  var conn net.Conn
+  var lastConnectError error
+  // deferred so that a panicking msgHandler doesn't leak the connection either
+  defer func() {
+    if lastConnectError == nil {
+      conn.Close()
+    }
+  }()
+
+  conn, lastConnectError = consumer.broker.dial()
+  if lastConnectError == nil {
+    consumer.emit(ConsumeEvent{Type: EVENT_CONNECTED})
+  }
+  idleSince := time.Now()
+  lag := lagState{}
+  backoff := consumer.newPollBackoff(pollTimeoutMs)
+  var stopErr error
+  
+loop:
+  for {
+    select {
+    case <-stopping:
+      break loop
+    default:
+    }
+    if lastConnectError != nil { 
+      consumer.emit(ConsumeEvent{Type: EVENT_RECONNECTING})
+      conn, lastConnectError = consumer.broker.dial()
       if lastConnectError == nil {
-        _, err := consumer.consumeWithConn(conn, msgHandler)
-        if err != nil && err != io.EOF {
-          log.Printf("ERROR: [%s] %#v\n",  consumer.broker.topic, err)
-          skippedMessageCount++
-        } else {
-          messageCount++
+        consumer.emit(ConsumeEvent{Type: EVENT_CONNECTED})
+      } else {
+        consumer.emit(ConsumeEvent{Type: EVENT_ERROR, Err: lastConnectError})
+        consumer.broker.logger.Printf("ERROR: [%s] Couldn't connect to Kafka server: %v, sleeping %d seconds to retry...\n",  consumer.broker.topic, lastConnectError, CONNECTION_RETRY_WAIT_IN_SECONDS)
+        select {
+        case <-stopping:
+        case <-time.After(CONNECTION_RETRY_WAIT_IN_SECONDS * time.Second):
         }
-      
-        time.Sleep(time.Duration(pollTimeoutMs) * time.Millisecond)
+        continue
       }
+    } 
+    before := consumer.offset
+    corrupted := consumer.corrupted.Load()
+    num, err := consumer.consumeWithConn(conn, msgHandler)
+    consumer.onPoll(num, err)
+    consumer.idleHeartbeat(num, &idleSince)
+    consumer.checkLag(&lag)
+    if num > 0 {
+      messageCount += int64(num)
     }
-    done <- true
-  }()
-  
-  <-done // wait until the last iteration finishes before returning
-  return messageCount, skippedMessageCount, nil
+    skippedMessageCount += int64(consumer.corrupted.Load() - corrupted)
+    if err != nil && err != io.EOF && err != ErrConsumerClosed {
+      consumer.broker.logger.Printf("ERROR: [%s] %#v\n",  consumer.broker.topic, err)
+      skippedMessageCount++
+      if isConnectionError(err) || consumer.broker.canFailOver(err) {
+        // e.g. a timeout, the connection may be out of step with the broker so start over on a new one
+        conn.Close()
+        lastConnectError = err
+      } else if errors.Is(err, ErrWrongPartition) {
+        // no endpoint left that might serve the partition, retrying would only spin
+        stopErr = err
+        break
+      }
+    }
+    consumer.pollWait(conn, backoff.next(consumer.offset != before), stopping)
+  }
+  consumer.emit(ConsumeEvent{Type: EVENT_STOPPED})
+  return messageCount, skippedMessageCount, stopErr
 }
 
 func (consumer *BrokerConsumer) ConsumeOnChannel(msgChan chan *Message, pollTimeoutMs int64, quit chan bool) (int, error) {
-  conn, err := consumer.broker.connect()
+  num, err := consumer.ConsumeOnChannelE(msgChan, pollTimeoutMs, quit)
+  if err != nil && num >= 0 {
+    consumer.broker.logger.Printf("Fatal Error: %v\n", err)
+    panic(err)
+  }
+  return num, err
+}
+
+// Like ConsumeOnChannel, but a fetch error stops consumption and is returned rather than panicking.
+// The consumer's offset is left where consumption stopped, so it can be resumed.
+// On quit or Close, messages already decoded from the last fetch are still delivered before msgChan is closed,
+// so keep receiving from msgChan until it's closed.
+func (consumer *BrokerConsumer) ConsumeOnChannelE(msgChan chan *Message, pollTimeoutMs int64, quit chan bool) (int, error) {
+  if consumer.isClosed() {
+    return -1, ErrConsumerClosed
+  }
+  conn, err := consumer.broker.dial()
   if err != nil {
+    consumer.emit(ConsumeEvent{Type: EVENT_ERROR, Err: err})
     return -1, err
   }
+  consumer.emit(ConsumeEvent{Type: EVENT_CONNECTED})
 
   num := 0
-  done := make(chan bool, 1)
-  go func() {
-    for {
-      _, err := consumer.consumeWithConn(conn, func(msg *Message) {
-        msgChan <- msg
-        num += 1
-      })
+  err = consumer.pollUntilQuit(conn, pollTimeoutMs, quit, func(conn net.Conn, stopping chan bool) (int, error) {
+    fetched, err := consumer.consumeWithConn(conn, func(msg *Message) {
+      deliver(consumer, conn, msgChan, msg, nil)
+      num += 1
+    })
+    if consumer.WaitForDelivery {
+      awaitDrained(consumer, conn, msgChan)
+    }
+    return fetched, err
+  })
+  close(msgChan)
+  consumer.emit(ConsumeEvent{Type: EVENT_STOPPED})
+  return num, err
+}
 
-      if err != nil {
-        if err != io.EOF {
-          log.Println("Fatal Error: ", err)
-          panic(err)
+// Like ConsumeOnChannelE, but delivers the messages of each fetch together in one slice, saving a
+// channel operation per message when fetches return many small messages. Returns the number of messages
+// delivered. Fetches without messages send nothing. A batch is only committed to the OffsetStore once it
+// has been taken off batchChan; on quit a batch still waiting to be taken is dropped, leaving the offset
+// before it so the next consume picks it up again.
+func (consumer *BrokerConsumer) ConsumeBatchesOnChannel(batchChan chan []*Message, pollTimeoutMs int64, quit chan bool) (int, error) {
+  if consumer.isClosed() {
+    return -1, ErrConsumerClosed
+  }
+  conn, err := consumer.broker.dial()
+  if err != nil {
+    consumer.emit(ConsumeEvent{Type: EVENT_ERROR, Err: err})
+    return -1, err
+  }
+  consumer.emit(ConsumeEvent{Type: EVENT_CONNECTED})
+
+  num := 0
+  err = consumer.pollUntilQuit(conn, pollTimeoutMs, quit, func(conn net.Conn, stopping chan bool) (int, error) {
+    before := consumer.offset
+    batch := make([]*Message, 0)
+    resumes := make([]uint64, 0)
+    fetched, _, err := consumer.consumeFetchCommitting(conn, nil, func(msg *Message) error {
+      batch = append(batch, msg)
+      return nil
+    }, func(resumeAt uint64) error {
+      resumes = append(resumes, resumeAt)
+      return nil
+    })
+    // on a decode error the messages before it are still delivered, and the offset moved past them
+    if len(batch) > 0 {
+      if !deliver(consumer, conn, batchChan, batch, stopping) {
+        consumer.setOffset(before)
+        return 0, nil
+      }
+      num += len(batch)
+      for _, resumeAt := range resumes {
+        if commitErr := consumer.commitHandled(resumeAt); commitErr != nil {
+          err = fmt.Errorf("committing offset %d: %w", resumeAt, commitErr)
+          break
         }
-        quit <- true // force quit
-        break
       }
-      time.Sleep(time.Millisecond * time.Duration(pollTimeoutMs))
     }
-    done <- true
-  }()
-  // wait to be told to stop..
-  <-quit
-  conn.Close()
-  close(msgChan)
-  <-done
+    err = consumer.reportFetch(conn, before, fetched, err)
+    if consumer.WaitForDelivery {
+      awaitDrained(consumer, conn, batchChan)
+    }
+    return fetched, err
+  })
+  close(batchChan)
+  consumer.emit(ConsumeEvent{Type: EVENT_STOPPED})
   return num, err
 }
 
-type MessageHandlerFunc func(msg *Message)
+// Sends v on ch. While the receiver isn't ready the consumer reports delivery as blocked (see Stats)
+// and keeps conn alive (see BlockedKeepAlive). Returns false if stopping (which may be nil) was closed first.
+func deliver[T any](consumer *BrokerConsumer, conn net.Conn, ch chan T, v T, stopping chan bool) bool {
+  select {
+  case ch <- v:
+    return true
+  default:
+  }
+  blocked := consumer.startBlocked()
+  defer blocked.stop()
+  for {
+    select {
+    case ch <- v:
+      return true
+    case <-stopping:
+      return false
+    case <-blocked.keepAlive:
+      consumer.keepAlive(conn)
+    }
+  }
+}
 
-func (consumer *BrokerConsumer) Consume(handlerFunc MessageHandlerFunc) (int, error) {
-  conn, err := consumer.broker.connect()
-  if err != nil {
-    return -1, err
+// Waits until the receiver has taken everything off ch, see WaitForDelivery
+func awaitDrained[T any](consumer *BrokerConsumer, conn net.Conn, ch chan T) {
+  if len(ch) == 0 {
+    return
   }
-  defer conn.Close()
+  blocked := consumer.startBlocked()
+  defer blocked.stop()
+  poll := time.NewTicker(DELIVERY_POLL_INTERVAL_MS * time.Millisecond)
+  defer poll.Stop()
+  for len(ch) > 0 {
+    select {
+    case <-poll.C:
+    case <-blocked.keepAlive:
+      consumer.keepAlive(conn)
+    }
+  }
+}
 
-  num, err := consumer.consumeWithConn(conn, handlerFunc)
+// A stretch of time a channel consumer spends waiting on its receiver
+type blockedDelivery struct {
+  consumer  *BrokerConsumer
+  ticker    *time.Ticker
+  keepAlive <-chan time.Time // nil without BlockedKeepAlive
+}
 
-  if err != nil {
-    log.Println("Fatal Error: ", err)
+func (consumer *BrokerConsumer) startBlocked() *blockedDelivery {
+  consumer.blockedSince.Store(time.Now().UnixNano())
+  blocked := &blockedDelivery{consumer: consumer}
+  if consumer.BlockedKeepAlive > 0 {
+    blocked.ticker = time.NewTicker(consumer.BlockedKeepAlive)
+    blocked.keepAlive = blocked.ticker.C
   }
+  return blocked
+}
 
-  return num, err
+func (blocked *blockedDelivery) stop() {
+  if blocked.ticker != nil {
+    blocked.ticker.Stop()
+  }
+  blocked.consumer.blockedSince.Store(0)
 }
 
-func (consumer *BrokerConsumer) consumeWithConn(conn *net.TCPConn, handlerFunc MessageHandlerFunc) (int, error) {
-  _, err := conn.Write(consumer.broker.EncodeConsumeRequest(consumer.offset, consumer.maxSize))
+// Send an offsets request on conn so it isn't idle. A failure closes conn, so the next fetch
+// fails with a connection error and reconnects.
+func (consumer *BrokerConsumer) keepAlive(conn net.Conn) error {
+  if consumer.prefetched != nil {
+    return nil // the connection is busy with the prefetch
+  }
+  _, err := consumer.broker.getOffsetsWithConn(consumer.timed(conn), -1, 1)
   if err != nil {
-    return -1, err
+    consumer.broker.logger.Printf("ERROR: [%s] keep-alive failed: %v\n", consumer.broker.topic, err)
+    conn.Close()
   }
+  return err
+}
+
+// The wait between the fetches of a polling loop, see MaxPollInterval
+type pollBackoff struct {
+  base    time.Duration
+  max     time.Duration
+  current time.Duration
+}
 
-  length, payload, err := consumer.broker.readResponse(conn)
+func (consumer *BrokerConsumer) newPollBackoff(pollTimeoutMs int64) *pollBackoff {
+  base := time.Millisecond * time.Duration(pollTimeoutMs)
+  return &pollBackoff{base: base, max: consumer.MaxPollInterval, current: base}
+}
 
-  if err != nil {
-    return -1, err
+// How long to wait after a fetch, which brought new messages when progressed
+func (p *pollBackoff) next(progressed bool) time.Duration {
+  if progressed {
+    p.current = p.base
+    return p.base
   }
+  wait := p.current
+  if p.max > p.base {
+    p.current *= POLL_BACKOFF_MULTIPLIER
+    if p.current > p.max || p.current <= 0 {
+      p.current = p.max
+    }
+  }
+  return wait
+}
 
-  num := 0
-  if length > 2 {
-    // parse out the messages
-    var currentOffset uint64 = 0
-    for currentOffset < uint64(len(payload)) && currentOffset <= uint64(length-4) {
-      totalLength, msgs := Decode(payload[currentOffset:], consumer.codecs)
-      if msgs == nil {
-        // update the broker's offset for next consumption incase they want to skip this message and keep going
-        consumer.offset += currentOffset
-        return num, errors.New("Error Decoding Message")
-      }
-      msgOffset := consumer.offset + currentOffset
-      for _, msg := range msgs {
-        // update all of the messages offset
-        // multiple messages can be at the same offset (compressed for example)
-        msg.offset = msgOffset
-        handlerFunc(&msg)
-        num += 1
+// Wait interval before the next fetch on conn, sending heartbeats every HeartbeatInterval meanwhile.
+// Returns false when stopping is closed first. A failed heartbeat ends the wait early, so the fetch
+// finds the connection closed and reconnects.
+func (consumer *BrokerConsumer) pollWait(conn net.Conn, interval time.Duration, stopping chan bool) bool {
+  wait := time.NewTimer(interval)
+  defer wait.Stop()
+  var heartbeat <-chan time.Time
+  if consumer.HeartbeatInterval > 0 {
+    ticker := time.NewTicker(consumer.HeartbeatInterval)
+    defer ticker.Stop()
+    heartbeat = ticker.C
+  }
+  for {
+    select {
+    case <-stopping:
+      return false
+    case <-wait.C:
+      return true
+    case <-heartbeat:
+      if consumer.keepAlive(conn) != nil {
+        return true
       }
-      currentOffset += uint64(4 + totalLength)
     }
-    // update the broker's offset for next consumption
-    consumer.offset += currentOffset
   }
+}
 
-  return num, err
+// Calls fetch on conn every pollTimeoutMs until quit, reconnecting after connection errors; stopping is
+// closed on quit. Any other fetch error ends polling and is returned. fetch is never called again once this returns.
+func (consumer *BrokerConsumer) pollUntilQuit(conn net.Conn, pollTimeoutMs int64, quit chan bool, fetch func(conn net.Conn, stopping chan bool) (int, error)) error {
+  var consumeErr error
+  var connLock sync.Mutex // guards conn, which is replaced on reconnect
+  done := make(chan bool, 1)
+  stopping := make(chan bool)
+  ended := make(chan bool)
+  go func() {
+    idleSince := time.Now()
+    lag := lagState{}
+    backoff := consumer.newPollBackoff(pollTimeoutMs)
+  loop:
+    for {
+      select {
+      case <-stopping:
+        break loop
+      default:
+      }
+      connLock.Lock()
+      current := conn
+      connLock.Unlock()
+      before := consumer.offset
+      fetched, err := fetch(current, stopping)
+      consumer.onPoll(fetched, err)
+      consumer.idleHeartbeat(fetched, &idleSince)
+      consumer.checkLag(&lag)
+
+      if err != nil && err != io.EOF && (isConnectionError(err) || consumer.broker.canFailOver(err)) {
+        select {
+        case <-stopping:
+        default:
+          consumer.broker.logger.Printf("ERROR: [%s] %#v, reconnecting...\n", consumer.broker.topic, err)
+          current.Close()
+          var redialed net.Conn
+          if redialed, err = consumer.redial(stopping); err == nil {
+            connLock.Lock()
+            conn = redialed
+            connLock.Unlock()
+            continue
+          }
+        }
+      }
+
+      if err != nil {
+        select {
+        case <-stopping:
+          // the connection was closed under us on quit
+        default:
+          if err != io.EOF && err != ErrConsumerClosed {
+            consumeErr = err
+          }
+          close(ended) // force quit
+        }
+        break
+      }
+      if !consumer.pollWait(current, backoff.next(consumer.offset != before), stopping) {
+        break loop
+      }
+    }
+    done <- true
+  }()
+  // wait to be told to stop, or for consumption to end by itself..
+  select {
+  case <-quit:
+  case <-consumer.closed:
+  case <-ended:
+  }
+  close(stopping)
+  // unblocks a fetch in progress, the messages of a fetch already read are unaffected
+  connLock.Lock()
+  conn.Close()
+  connLock.Unlock()
+  <-done
+  // the last of the decoded messages is delivered, so nothing is handled any more
+  connLock.Lock()
+  conn.Close() // in case a reconnect raced with the close above
+  connLock.Unlock()
+  return consumeErr
 }
 
-// Get a list of valid offsets (up to maxNumOffsets) before the given time, where 
-// time is in milliseconds (-1, from the latest offset available, -2 from the smallest offset available)
-// The result is a list of offsets, in descending order.
-func (consumer *BrokerConsumer) GetOffsets(time int64, maxNumOffsets uint32) ([]uint64, error) {
-  offsets := make([]uint64, 0)
+// Accounting for a ConsumeOnChannelWithResult run
+type ChannelConsumeResult struct {
+  Delivered  int    // messages sent on the channel
+  Dropped    int    // messages decoded but not sent because of the quit signal
+  LastOffset uint64 // offset of the last delivered message
+}
 
-  conn, err := consumer.broker.connect()
+// Like ConsumeOnChannel, but reports exactly what was delivered across shutdown.
+// The message waiting to be sent when quit arrives is dropped, and the fetch stops there: the consumer's
+// offset is left on it, and the OffsetStore isn't committed past it, so the next consume picks it up
+// again (with the rest of its compressed set). Dropped messages don't count as consumed. msgChan is closed once
+// the consume goroutine has stopped, so it is never sent on after closing.
+// A fetch error stops consumption and is returned, a caught up partition (io.EOF) is not an error.
+func (consumer *BrokerConsumer) ConsumeOnChannelWithResult(msgChan chan *Message, pollTimeoutMs int64, quit chan bool) (ChannelConsumeResult, error) {
+  result := ChannelConsumeResult{}
+  if consumer.isClosed() {
+    return result, ErrConsumerClosed
+  }
+  conn, err := consumer.broker.dial()
   if err != nil {
-    return offsets, err
+    consumer.emit(ConsumeEvent{Type: EVENT_ERROR, Err: err})
+    return result, err
   }
-
   defer conn.Close()
+  consumer.emit(ConsumeEvent{Type: EVENT_CONNECTED})
 
-  _, err = conn.Write(consumer.broker.EncodeOffsetRequest(time, maxNumOffsets))
-  if err != nil {
-    return offsets, err
+  stopping := make(chan bool)
+  done := make(chan error, 1)
+  go func() {
+    var err error
+    idleSince := time.Now()
+    lag := lagState{}
+    backoff := consumer.newPollBackoff(pollTimeoutMs)
+    for {
+      var fetched int
+      before := consumer.offset
+      fetched, _, err = consumer.consumeFetch(conn, nil, func(msg *Message) error {
+        select {
+        case msgChan <- msg:
+          result.Delivered++
+          result.LastOffset = msg.Offset()
+          return nil
+        case <-stopping:
+          result.Dropped++
+          return errQuitDelivery
+        }
+      })
+      dropped := errors.Is(err, errQuitDelivery)
+      if dropped {
+        err = nil
+      }
+      err = consumer.reportFetch(conn, before, fetched, err)
+      consumer.onPoll(fetched, err)
+      if dropped {
+        break
+      }
+      if err != nil {
+        break
+      }
+      consumer.idleHeartbeat(fetched, &idleSince)
+      consumer.checkLag(&lag)
+      select {
+      case <-stopping:
+      case <-time.After(backoff.next(consumer.offset != before)):
+        continue
+      }
+      break
+    }
+    done <- err
+  }()
+
+  select {
+  case <-quit:
+    close(stopping)
+    err = <-done
+  case <-consumer.closed:
+    close(stopping)
+    err = <-done
+  case err = <-done:
   }
+  close(msgChan)
+  consumer.emit(ConsumeEvent{Type: EVENT_STOPPED})
 
-  length, payload, err := consumer.broker.readResponse(conn)
-  if err != nil {
-    return offsets, err
+  if err == io.EOF {
+    err = nil
+  }
+  return result, err
+}
+
+// Whether err came from the connection itself (rather than, say, a bad message), so reconnecting may help
+func isConnectionError(err error) bool {
+  var netErr net.Error
+  return errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// Dial the broker again, waiting with exponential backoff between attempts. Gives up after
+// MaxReconnectAttempts, returning the last dial error, or as soon as stopping is closed.
+func (consumer *BrokerConsumer) redial(stopping chan bool) (net.Conn, error) {
+  backoff := consumer.ReconnectBackoffBase
+  if backoff <= 0 {
+    backoff = DEFAULT_RECONNECT_BACKOFF_MS * time.Millisecond
+  }
+  maxBackoff := consumer.ReconnectBackoffMax
+  if maxBackoff <= 0 {
+    maxBackoff = DEFAULT_MAX_RECONNECT_BACKOFF_MS * time.Millisecond
   }
+  attempts := consumer.MaxReconnectAttempts
+  if attempts == 0 {
+    attempts = DEFAULT_MAX_RECONNECT_ATTEMPTS
+  }
+
+  err := errors.New("reconnecting disabled")
+  for attempt := 1; attempt <= attempts; attempt++ {
+    consumer.emit(ConsumeEvent{Type: EVENT_RECONNECTING})
+    select {
+    case <-stopping:
+      return nil, errors.New("stopped while reconnecting")
+    case <-time.After(backoff):
+    }
+
+    var conn net.Conn
+    if conn, err = consumer.broker.dial(); err == nil {
+      consumer.emit(ConsumeEvent{Type: EVENT_CONNECTED})
+      return conn, nil
+    }
+    consumer.emit(ConsumeEvent{Type: EVENT_ERROR, Err: err})
+    consumer.broker.logger.Printf("ERROR: [%s] reconnect attempt %d of %d failed: %#v\n", consumer.broker.topic, attempt, attempts, err)
 
-  if length > 4 {
-    // get the number of offsets
-    numOffsets := binary.BigEndian.Uint32(payload[0:])
-    var currentOffset uint64 = 4
-    for currentOffset < uint64(length-4) && uint32(len(offsets)) < numOffsets {
-      offset := binary.BigEndian.Uint64(payload[currentOffset:])
-      offsets = append(offsets, offset)
-      currentOffset += 8 // offset size
+    backoff *= 2
+    if backoff > maxBackoff {
+      backoff = maxBackoff
     }
   }
+  return nil, err
+}
+
+// Reports a fetch to OnPoll, if set
+func (consumer *BrokerConsumer) onPoll(fetched int, err error) {
+  if consumer.OnPoll == nil {
+    return
+  }
+  if fetched < 0 {
+    // failed before any message
+    fetched = 0
+  }
+  consumer.OnPoll(fetched, consumer.Offset(), err)
+}
+
+// Logs a liveness line once no messages have arrived for IdleHeartbeat, resetting idleSince whenever messages are fetched.
+func (consumer *BrokerConsumer) idleHeartbeat(num int, idleSince *time.Time) {
+  if num > 0 || consumer.IdleHeartbeat <= 0 {
+    *idleSince = time.Now()
+    return
+  }
+  if time.Since(*idleSince) >= consumer.IdleHeartbeat {
+    consumer.broker.logger.Printf("INFO: [%s] still alive, offset %d, no new messages\n", consumer.broker.topic, consumer.offset)
+    *idleSince = time.Now()
+  }
+}
+
+// Tracks the lag hooks between polls
+type lagState struct {
+  lastCheck time.Time
+  exceeded  bool
+}
+
+// Fires OnLagExceeded/OnLagRecovered when the lag crosses LagThreshold, checking at most once per interval
+func (consumer *BrokerConsumer) checkLag(state *lagState) {
+  if consumer.OnLagExceeded == nil && consumer.OnLagRecovered == nil {
+    return
+  }
+  interval := consumer.LagCheckInterval
+  if interval <= 0 {
+    interval = DEFAULT_LAG_CHECK_INTERVAL_IN_SECONDS * time.Second
+  }
+  if time.Since(state.lastCheck) < interval {
+    return
+  }
+  state.lastCheck = time.Now()
+
+  lag, err := consumer.Lag()
+  if err != nil {
+    consumer.broker.logger.Printf("ERROR: [%s] lag check failed: %#v\n", consumer.broker.topic, err)
+    return
+  }
+  if lag > consumer.LagThreshold && !state.exceeded {
+    state.exceeded = true
+    if consumer.OnLagExceeded != nil {
+      consumer.OnLagExceeded(lag)
+    }
+  } else if lag <= consumer.LagThreshold && state.exceeded {
+    state.exceeded = false
+    if consumer.OnLagRecovered != nil {
+      consumer.OnLagRecovered(lag)
+    }
+  }
+}
+
+// How far the consumer is behind the head of the partition: the bytes between its offset (CurrentOffset) and
+// the latest offset (offsets being byte positions, there's no message count short of fetching them).
+// Asks the broker each time. 0 when the latest offset isn't past the consumer's, e.g. just after catching up.
+func (consumer *BrokerConsumer) Lag() (uint64, error) {
+  offsets, err := consumer.GetOffsets(-1, 1)
+  if err != nil {
+    return 0, err
+  }
+  current := consumer.CurrentOffset()
+  if len(offsets) == 0 || offsets[0] <= current {
+    return 0, nil
+  }
+  return offsets[0] - current, nil
+}
+
+type MessageHandlerFunc func(msg *Message)
+
+// A handler that can stop consumption by returning an error, e.g. when a downstream store is unavailable
+type MessageHandlerFuncE func(msg *Message) error
+
+func (handlerFunc MessageHandlerFunc) withError() MessageHandlerFuncE {
+  return func(msg *Message) error {
+    handlerFunc(msg)
+    return nil
+  }
+}
+
+// Fetch once and hand the messages to handlerFunc. Returns ErrNoMessages once caught up, so a batch
+// job can loop until then: for { if _, err := consumer.Consume(handle); err != nil { break } }
+func (consumer *BrokerConsumer) Consume(handlerFunc MessageHandlerFunc) (int, error) {
+  return consumer.ConsumeE(handlerFunc.withError())
+}
+
+// Like Consume, but a handler error stops consumption and is returned. The consumer's offset is left
+// at the failed message, so consuming again resumes with it.
+func (consumer *BrokerConsumer) ConsumeE(handlerFunc MessageHandlerFuncE) (int, error) {
+  num, _, err := consumer.consumeCounted(handlerFunc)
+  return num, err
+}
+
+// Like Consume, but also returns the number of message bytes consumed: the size of the messages the offset
+// moved past, length prefixes included, not counting the response's own framing. Compare with maxSize to
+// see how full fetches are.
+func (consumer *BrokerConsumer) ConsumeWithBytes(handlerFunc MessageHandlerFunc) (int, int, error) {
+  return consumer.consumeCounted(handlerFunc.withError())
+}
+
+func (consumer *BrokerConsumer) consumeCounted(handlerFunc MessageHandlerFuncE) (int, int, error) {
+  if consumer.isClosed() {
+    return -1, 0, ErrConsumerClosed
+  }
+  conn, err := consumer.broker.connect()
+  if err != nil {
+    return -1, 0, err
+  }
+
+  before := consumer.offset
+  num, err := consumer.consumeWithConnE(conn, handlerFunc)
+  consumer.releaseConn(conn, err)
+  size := int(consumer.offset - before)
+
+  if err != nil {
+    consumer.broker.logger.Printf("Fatal Error: %v\n", err)
+    return num, size, err
+  }
+  // everything fetched may have been skipped (PrefixFilter, ...), but then the offset moved
+  if num == 0 && size == 0 {
+    return 0, 0, ErrNoMessages
+  }
+  return num, size, nil
+}
+
+// Keeps consuming until ctx is cancelled or its deadline passes, fetching again straight away while
+// messages are arriving and waiting DEFAULT_POLL_TIMEOUT_MS between fetches once caught up.
+// Cancelling ctx interrupts the wait, or a fetch in flight by closing the connection.
+// Returns the number of messages handled along with an error wrapping ctx.Err() (test with errors.Is),
+// or the fetch error that stopped it.
+func (consumer *BrokerConsumer) ConsumeWithContext(ctx context.Context, handlerFunc MessageHandlerFunc) (int, error) {
+  if consumer.isClosed() {
+    return -1, ErrConsumerClosed
+  }
+  conn, err := consumer.broker.dial()
+  if err != nil {
+    return -1, err
+  }
+  defer conn.Close()
+  stop := context.AfterFunc(ctx, func() { conn.Close() })
+  defer stop()
+
+  total := 0
+  backoff := consumer.newPollBackoff(DEFAULT_POLL_TIMEOUT_MS)
+  for {
+    before := consumer.offset
+    num, err := consumer.consumeWithConn(conn, handlerFunc)
+    if num > 0 {
+      total += num
+    }
+    if ctx.Err() != nil {
+      return total, fmt.Errorf("consume stopped at offset %d: %w", consumer.offset, ctx.Err())
+    }
+    if err != nil && err != io.EOF {
+      return total, err
+    }
+    if consumer.offset != before {
+      backoff.next(true)
+      continue
+    }
+
+    timer := time.NewTimer(backoff.next(false))
+    select {
+    case <-ctx.Done():
+      timer.Stop()
+      return total, fmt.Errorf("consume stopped at offset %d: %w", consumer.offset, ctx.Err())
+    case <-consumer.closed:
+      timer.Stop()
+      return total, ErrConsumerClosed
+    case <-timer.C:
+    }
+  }
+}
+
+func (consumer *BrokerConsumer) consumeWithConn(conn net.Conn, handlerFunc MessageHandlerFunc) (int, error) {
+  return consumer.consumeWithConnE(conn, handlerFunc.withError())
+}
+
+func (consumer *BrokerConsumer) consumeWithConnE(conn net.Conn, handlerFunc MessageHandlerFuncE) (int, error) {
+  num, _, err := consumer.consumeWithConnUntil(conn, nil, handlerFunc)
+  return num, err
+}
+
+// Performs a single fetch, handing each message to handlerFunc until stop (which may be nil) returns true.
+// Returns the number of messages handled and whether stop ended the fetch early.
+// When stopped, the offset is advanced past the message set entry holding the stopping message.
+// If handlerFunc returns an error the fetch stops there, leaving the offset at the failed message.
+func (consumer *BrokerConsumer) consumeWithConnUntil(conn net.Conn, stop func(msg *Message) bool, handlerFunc MessageHandlerFuncE) (int, bool, error) {
+  start := consumer.offset
+  num, stopped, err := consumer.consumeFetch(conn, stop, handlerFunc)
+  return num, stopped, consumer.reportFetch(conn, start, num, err)
+}
+
+// Account for a fetch from start that handled num messages and ended with err, through the counters and
+// Events. Returns err, as a *WrongBrokerError when conn's endpoint doesn't serve the partition.
+func (consumer *BrokerConsumer) reportFetch(conn net.Conn, start uint64, num int, err error) error {
+  if err != nil && errors.Is(err, ErrWrongPartition) {
+    err = consumer.broker.wrongBroker(conn, err)
+  }
+  if num > 0 {
+    consumer.consumed.Add(uint64(num))
+  }
+  if err != nil && err != io.EOF {
+    consumer.skipped.Add(1)
+    consumer.lastErr.Store(&err)
+  }
+  if consumer.Events != nil {
+    if err != nil && err != io.EOF {
+      consumer.emit(ConsumeEvent{Type: EVENT_ERROR, Err: err})
+    } else if consumer.offset > start {
+      consumer.emit(ConsumeEvent{Type: EVENT_FETCHED, Count: num, Bytes: consumer.offset - start})
+    } else {
+      consumer.emit(ConsumeEvent{Type: EVENT_CAUGHT_UP})
+    }
+  }
+  return err
+}
+
+// The fetch & decode behind consumeWithConnUntil, which reports on it through Events
+func (consumer *BrokerConsumer) consumeFetch(conn net.Conn, stop func(msg *Message) bool, handlerFunc MessageHandlerFuncE) (int, bool, error) {
+  return consumer.consumeFetchCommitting(conn, stop, handlerFunc, consumer.commitHandled)
+}
+
+// Like consumeFetch, passing the offset to resume from after each handled message to commit rather than
+// commitHandled, for callers committing only once the messages are delivered
+func (consumer *BrokerConsumer) consumeFetchCommitting(conn net.Conn, stop func(msg *Message) bool, handlerFunc MessageHandlerFuncE, commit func(resumeAt uint64) error) (int, bool, error) {
+  if consumer.isClosed() {
+    return -1, false, ErrConsumerClosed
+  }
+  if err := consumer.loadStoredOffset(); err != nil {
+    return -1, false, err
+  }
+  consumer.resolveLatestOffset(conn)
+  defer consumer.holdFetchBuffer()()
+  length, payload, err := consumer.fetchComplete(conn)
+  if err != nil {
+    return -1, false, err
+  }
+  // only worth fetching ahead while there are messages, an idle partition is left to the poll interval
+  if next := completeFramesLength(payload); consumer.Prefetch && !consumer.WaitForDelivery && consumer.MaxMessagesPerFetch <= 0 && next > 0 {
+    consumer.startPrefetch(conn, consumer.offset+next)
+  }
+
+  num := 0
+  stopped := false
+  // length counts the error code, readResponse has already refused a response too short for one
+  if length > 2 {
+    // parse out the messages, bounded by the payload itself rather than length-4, which underflows below 4
+    var currentOffset uint64 = 0
+    for !stopped && currentOffset < uint64(len(payload)) {
+      if currentOffset+4 > uint64(len(payload)) ||
+        currentOffset+4+uint64(binary.BigEndian.Uint32(payload[currentOffset:])) > uint64(len(payload)) {
+        // partial message at the end of the fetch (cut off by maxSize or a short read), read again next time
+        break
+      }
+      msgs, consumed, err := decode(payload[currentOffset:], consumer.codecs, consumer.messageFormat())
+      if err != nil && consumer.SkipCorrupted {
+        // the declared length was checked to fit above, so the next message starts after it
+        consumer.corrupted.Add(1)
+        consumer.broker.logger.Printf("ERROR: [%s] skipping corrupt message at offset %d: %v\n", consumer.broker.topic, consumer.offset+currentOffset, err)
+        currentOffset += 4 + uint64(binary.BigEndian.Uint32(payload[currentOffset:]))
+        continue
+      }
+      if err != nil {
+        // update the broker's offset for next consumption incase they want to skip this message and keep going
+        consumer.setOffset(consumer.offset + currentOffset)
+        var checksumErr *ChecksumError
+        if errors.As(err, &checksumErr) {
+          checksumErr.Offset = consumer.offset
+        }
+        return num, false, fmt.Errorf("Error Decoding Message at offset %d: %w", consumer.offset, err)
+      }
+      msgOffset := consumer.offset + currentOffset
+      if consumer.rangeEnd > 0 && msgOffset >= consumer.rangeEnd {
+        // out of ConsumeRange's range, the offset stays on it
+        stopped = true
+        break
+      }
+      if consumer.DetectDuplicates {
+        consumer.checkDuplicate(msgOffset)
+      }
+      for i, msg := range msgs {
+        // update all of the messages offset
+        // multiple messages can be at the same offset (compressed for example)
+        msg.offset = msgOffset
+        msg.nextOffset = msgOffset + uint64(consumed)
+        msg.index = i
+        msg.setSize = len(msgs)
+        msg.partition = consumer.broker.partition
+        msg.targetPartition = consumer.broker.partition
+        if !consumer.admit(&msg) {
+          continue
+        }
+        consumer.limiter.wait(len(msg.payload))
+        if err := handlerFunc(&msg); err != nil {
+          // leave the offset at the failed message so it's handled again on resume
+          consumer.setOffset(consumer.offset + currentOffset)
+          return num, false, err
+        }
+        num += 1
+        // messages of a compressed set share an offset, resuming before the last of them replays the set
+        resumeAt := msg.offset
+        if i == len(msgs)-1 {
+          resumeAt = msg.nextOffset
+        }
+        if err := commit(resumeAt); err != nil {
+          consumer.setOffset(consumer.offset + currentOffset)
+          return num, false, fmt.Errorf("committing offset %d: %w", resumeAt, err)
+        }
+        if stop != nil && stop(&msg) {
+          stopped = true
+          break
+        }
+      }
+      currentOffset += uint64(consumed)
+      if consumer.MaxMessagesPerFetch > 0 && num >= consumer.MaxMessagesPerFetch {
+        // the rest of the fetch is read again by the next one
+        break
+      }
+    }
+    // update the broker's offset for next consumption
+    consumer.setOffset(consumer.offset + currentOffset)
+  }
+
+  return num, stopped, err
+}
+
+// Fetch at the current offset (or pick up the prefetch of it), refetching with a larger maxSize while the
+// response holds only part of a message. Returns an ErrMessageTooLarge if growMaxSize won't.
+func (consumer *BrokerConsumer) fetchComplete(conn net.Conn) (uint32, []byte, error) {
+  length, payload, err := consumer.fetchNext(conn)
+  if err != nil {
+    return length, payload, err
+  }
+  consumer.bytesRead.Add(uint64(length))
+  // the broker cuts the message set at maxSize, so a lone partial message is one that can never fit
+  for len(payload) > 0 && completeFramesLength(payload) == 0 {
+    if err := consumer.growMaxSize(payload); err != nil {
+      return 0, nil, err
+    }
+    length, payload, err = consumer.fetchCurrent(conn)
+    if err != nil {
+      return length, payload, err
+    }
+    consumer.bytesRead.Add(uint64(length))
+  }
+  return length, payload, nil
+}
+
+// Whether msg gets past SkipInitial, PrefixFilter and SampleRate, counting it either way.
+// Must be called for messages in offset order.
+func (consumer *BrokerConsumer) admit(msg *Message) bool {
+  if consumer.skipRemaining > 0 {
+    consumer.skipRemaining--
+    consumer.skippedInitial.Add(1)
+    return false
+  }
+  if consumer.PrefixFilter != nil {
+    if !bytes.HasPrefix(msg.payload, consumer.PrefixFilter) {
+      consumer.prefixSkipped.Add(1)
+      return false
+    }
+    consumer.prefixMatched.Add(1)
+  }
+  if consumer.SampleRate > 0 && consumer.SampleRate < 1 {
+    if !consumer.sample() {
+      consumer.sampledOut.Add(1)
+      return false
+    }
+    consumer.sampled.Add(1)
+  }
+  return true
+}
+
+// Doubles maxSize after a fetch returned only partial, the start of a message too large for it.
+// Returns an ErrMessageTooLarge unless AutoGrowMaxSize is set and MaxSizeLimit not reached.
+func (consumer *BrokerConsumer) growMaxSize(partial []byte) error {
+  needed := "unknown"
+  if len(partial) >= 4 {
+    needed = fmt.Sprintf("%d", 4+uint64(binary.BigEndian.Uint32(partial)))
+  }
+  limit := consumer.MaxSizeLimit
+  if limit == 0 {
+    limit = DEFAULT_MAX_SIZE_LIMIT
+  }
+  if !consumer.AutoGrowMaxSize || consumer.maxSize >= limit {
+    return fmt.Errorf("%w: message at offset %d needs %s bytes, maxSize is %d", ErrMessageTooLarge, consumer.offset, needed, consumer.maxSize)
+  }
+
+  grown := uint64(consumer.maxSize) * 2
+  if grown == 0 {
+    grown = 1
+  }
+  if grown > uint64(limit) {
+    grown = uint64(limit)
+  }
+  consumer.broker.logger.Printf("WARN: [%s] message at offset %d needs %s bytes, growing maxSize from %d to %d\n",
+    consumer.broker.topic, consumer.offset, needed, consumer.maxSize, grown)
+  consumer.setMaxSize(uint32(grown))
+  return nil
+}
+
+// Decides whether the next message falls within SampleRate
+func (consumer *BrokerConsumer) sample() bool {
+  if consumer.sampler == nil {
+    seed := consumer.SampleSeed
+    if seed == 0 {
+      seed = time.Now().UnixNano()
+    }
+    consumer.sampler = rand.New(rand.NewSource(seed))
+  }
+  return consumer.sampler.Float64() < consumer.SampleRate
+}
+
+// Counts and logs offset if it was delivered recently.
+// Compressed messages share their wrapper's offset, so this is checked once per message set entry.
+func (consumer *BrokerConsumer) checkDuplicate(offset uint64) {
+  if consumer.recentOffsets == nil {
+    consumer.recentOffsets = newOffsetWindow(DUPLICATE_WINDOW_SIZE)
+  }
+  if consumer.recentOffsets.add(offset) {
+    consumer.duplicates.Add(1)
+    consumer.broker.logger.Printf("WARN: [%s] duplicate delivery of offset %d\n", consumer.broker.topic, offset)
+  }
+}
+
+// A fetch issued ahead of time by Prefetch
+type prefetch struct {
+  conn   net.Conn
+  offset uint64
+  result chan fetchResult
+}
+
+type fetchResult struct {
+  length  uint32
+  payload []byte
+  err     error
+}
+
+// Fetch at the consumer's offset, using the pending prefetch when it was issued for that offset on conn
+func (consumer *BrokerConsumer) fetchNext(conn net.Conn) (uint32, []byte, error) {
+  pending := consumer.prefetched
+  consumer.prefetched = nil
+  if pending != nil && pending.conn == conn {
+    // wait for it even if it's stale, so the connection is back in step before reuse
+    result := <-pending.result
+    if result.err == nil && pending.offset == consumer.offset {
+      return result.length, result.payload, nil
+    }
+  }
+  return consumer.fetchCurrent(conn)
+}
+
+// Response buffers for ZeroCopy consumers, reused across consumers' lifetimes. Holds *[]byte.
+var fetchBuffers = sync.Pool{New: func() any { return new([]byte) }}
+
+// Under ZeroCopy, hold on to fetchBuf (taking one from fetchBuffers if need be) for a fetch and the handling
+// of its messages, until the returned function is called
+func (consumer *BrokerConsumer) holdFetchBuffer() func() {
+  if !consumer.ZeroCopy || consumer.Prefetch {
+    return func() {}
+  }
+  consumer.bufLock.Lock()
+  defer consumer.bufLock.Unlock()
+  if consumer.fetchBuf == nil {
+    consumer.fetchBuf = fetchBuffers.Get().(*[]byte)
+  }
+  consumer.fetching = true
+  return func() {
+    consumer.bufLock.Lock()
+    defer consumer.bufLock.Unlock()
+    consumer.fetching = false
+    if consumer.isClosed() {
+      // Close left it to us
+      consumer.releaseFetchBuffer()
+    }
+  }
+}
+
+// Give fetchBuf back to fetchBuffers unless a fetch is using it, bufLock held
+func (consumer *BrokerConsumer) releaseFetchBuffer() {
+  if consumer.fetchBuf != nil && !consumer.fetching {
+    fetchBuffers.Put(consumer.fetchBuf)
+    consumer.fetchBuf = nil
+  }
+}
+
+// Fetch at the current offset, into fetchBuf under ZeroCopy (see holdFetchBuffer)
+func (consumer *BrokerConsumer) fetchCurrent(conn net.Conn) (uint32, []byte, error) {
+  if consumer.fetchBuf != nil && consumer.ZeroCopy && !consumer.Prefetch {
+    return consumer.broker.fetchInto(consumer.timed(conn), consumer.offset, consumer.maxSize, consumer.fetchBuf)
+  }
+  return consumer.broker.fetch(consumer.timed(conn), consumer.offset, consumer.maxSize)
+}
+
+// Issue a fetch at offset in the background, picked up by the next fetchNext on conn
+func (consumer *BrokerConsumer) startPrefetch(conn net.Conn, offset uint64) {
+  pending := &prefetch{conn: conn, offset: offset, result: make(chan fetchResult, 1)}
+  maxSize := consumer.maxSize
+  go func() {
+    length, payload, err := consumer.broker.fetch(consumer.timed(conn), offset, maxSize)
+    pending.result <- fetchResult{length, payload, err}
+  }()
+  consumer.prefetched = pending
+}
+
+// The number of bytes taken by the complete messages at the start of a message set
+func completeFramesLength(payload []byte) uint64 {
+  return walkFrames(payload, nil)
+}
+
+// Calls fn (if not nil) with the size (length prefix included) of each complete message frame at the
+// start of a message set, stopping at a partial frame. Returns the number of bytes walked.
+func walkFrames(payload []byte, fn func(size uint32)) uint64 {
+  var current uint64 = 0
+  for current+4 <= uint64(len(payload)) {
+    size := 4 + uint64(binary.BigEndian.Uint32(payload[current:]))
+    if current+size > uint64(len(payload)) {
+      break
+    }
+    if fn != nil {
+      fn(uint32(size))
+    }
+    current += size
+  }
+  return current
+}
+
+// Estimates the average message size (in bytes on the wire, length prefix included) from up to
+// sampleMessages message set entries at the current offset, without advancing it.
+// If fewer are available the average of those measured is still returned, with an error saying how many.
+func (consumer *BrokerConsumer) AvgMessageSize(sampleMessages int) (avg float64, err error) {
+  conn, err := consumer.broker.connect()
+  if err != nil {
+    return 0, err
+  }
+  defer func() { consumer.releaseConn(conn, err) }()
+
+  measured := 0
+  var total uint64 = 0
+  offset := consumer.offset
+  for measured < sampleMessages {
+    _, payload, err := consumer.broker.fetch(consumer.timed(conn), offset, consumer.maxSize)
+    if err != nil {
+      return 0, err
+    }
+    walked := walkFrames(payload, func(size uint32) {
+      if measured < sampleMessages {
+        measured++
+        total += uint64(size)
+      }
+    })
+    if walked == 0 {
+      break
+    }
+    offset += walked
+  }
+
+  if measured == 0 {
+    return 0, fmt.Errorf("no messages available to measure at offset %d", consumer.offset)
+  }
+  avg = float64(total) / float64(measured)
+  if measured < sampleMessages {
+    return avg, fmt.Errorf("only %d of %d messages available to measure", measured, sampleMessages)
+  }
+  return avg, nil
+}
+
+// Issues a single fetch request, returning the raw response length & message set payload
+func (b *Broker) fetch(conn net.Conn, offset uint64, maxSize uint32) (uint32, []byte, error) {
+  return b.fetchInto(conn, offset, maxSize, nil)
+}
+
+// Like fetch, reading the response into *buf (see readResponseInto)
+func (b *Broker) fetchInto(conn net.Conn, offset uint64, maxSize uint32, buf *[]byte) (uint32, []byte, error) {
+  _, err := b.write(conn, b.EncodeConsumeRequest(offset, maxSize))
+  if err != nil {
+    return 0, []byte{}, err
+  }
+
+  // <ERROR CODE: uint16><MESSAGE SET: up to maxSize bytes>
+  return b.readResponseInto(conn, b.responseLimit(2+uint64(maxSize)), buf)
+}
+
+// Fetch and decode up to maxMessages messages at the current offset, without advancing it, so the
+// same messages are read again by the next Peek or Consume. One fetch is made, so fewer may be returned.
+// Filters (SkipInitial, PrefixFilter, SampleRate) don't apply and nothing is committed to an OffsetStore.
+// A decode error is returned along with the messages before it. maxMessages must be positive.
+func (consumer *BrokerConsumer) Peek(maxMessages int) (msgs []*Message, err error) {
+  if maxMessages <= 0 {
+    return nil, fmt.Errorf("maxMessages must be positive, was %d", maxMessages)
+  }
+  conn, err := consumer.broker.connect()
+  if err != nil {
+    return nil, err
+  }
+  defer func() { consumer.releaseConn(conn, err) }()
+
+  _, payload, err := consumer.broker.fetch(consumer.timed(conn), consumer.offset, consumer.maxSize)
+  if err != nil {
+    return nil, err
+  }
+  for len(payload) > 0 && completeFramesLength(payload) == 0 {
+    if err = consumer.growMaxSize(payload); err != nil {
+      return nil, err
+    }
+    if _, payload, err = consumer.broker.fetch(consumer.timed(conn), consumer.offset, consumer.maxSize); err != nil {
+      return nil, err
+    }
+  }
+
+  msgs, _, decodeErr := decodeMessageSet(payload, consumer.offset, consumer.codecs, consumer.messageFormat())
+  if len(msgs) > maxMessages {
+    msgs = msgs[:maxMessages]
+  }
+  for _, msg := range msgs {
+    msg.partition = consumer.broker.partition
+    msg.targetPartition = consumer.broker.partition
+  }
+  return msgs, decodeErr
+}
+
+// Fetch the single message starting at offset, without moving the consumer's own offset.
+// Returns an error if there is no message at offset, or offset falls in the middle of a message.
+// For a compressed message set entry, the first of its messages is returned.
+func (consumer *BrokerConsumer) FetchOne(offset uint64) (msg *Message, err error) {
+  conn, err := consumer.broker.connect()
+  if err != nil {
+    return nil, err
+  }
+  defer func() { consumer.releaseConn(conn, err) }()
+
+  length, payload, err := consumer.broker.fetch(consumer.timed(conn), offset, consumer.maxSize)
+  if err != nil {
+    return nil, err
+  }
+  if length <= 2 {
+    return nil, fmt.Errorf("no message available at offset %d", offset)
+  }
+
+  msgs, _, err := decode(payload, consumer.codecs, consumer.messageFormat())
+  if err != nil {
+    return nil, fmt.Errorf("offset %d does not start a message: %w", offset, err)
+  }
+  msg = &msgs[0]
+  msg.offset = offset
+  msg.partition = consumer.broker.partition
+  msg.targetPartition = consumer.broker.partition
+  return msg, nil
+}
+
+// Fetch once at offset, asking for up to maxSize bytes, and return the messages decoded from it, leaving the
+// consumer's own offset and maxSize alone. offset must start a message. Filters (SkipInitial, PrefixFilter,
+// SampleRate) don't apply and nothing is committed. Returns no messages at the end of the partition, an
+// ErrMessageTooLarge when the message at offset doesn't fit in maxSize, and a decode error along with the
+// messages before it.
+func (consumer *BrokerConsumer) FetchAt(offset uint64, maxSize uint32) (msgs []*Message, err error) {
+  conn, err := consumer.broker.connect()
+  if err != nil {
+    return nil, err
+  }
+  defer func() { consumer.releaseConn(conn, err) }()
+
+  _, payload, err := consumer.broker.fetch(consumer.timed(conn), offset, maxSize)
+  if err != nil {
+    return nil, err
+  }
+  if len(payload) > 0 && completeFramesLength(payload) == 0 {
+    return nil, fmt.Errorf("%w: message at offset %d is cut at maxSize %d", ErrMessageTooLarge, offset, maxSize)
+  }
+
+  msgs, _, decodeErr := decodeMessageSet(payload, offset, consumer.codecs, consumer.messageFormat())
+  for _, msg := range msgs {
+    msg.partition = consumer.broker.partition
+    msg.targetPartition = consumer.broker.partition
+  }
+  return msgs, decodeErr
+}
+
+// Samples the messages at the current offset (without advancing it) and returns the size of the
+// largest message frame observed. If the maxSize the consumer was created with is smaller, a
+// fetch would never return that message and the consumer would stall, so a warning is logged,
+// and with WarmUpAutoAdjust set maxSize is raised to fit it.
+func (consumer *BrokerConsumer) WarmUp() (maxObserved uint32, err error) {
+  conn, err := consumer.broker.connect()
+  if err != nil {
+    return 0, err
+  }
+  defer func() { consumer.releaseConn(conn, err) }()
+
+  sampleSize := consumer.maxSize
+  if sampleSize < WARMUP_SAMPLE_SIZE {
+    sampleSize = WARMUP_SAMPLE_SIZE
+  }
+  _, payload, err := consumer.broker.fetch(consumer.timed(conn), consumer.offset, sampleSize)
+  if err != nil {
+    return 0, err
+  }
+
+  maxObserved = largestFrame(payload)
+  if maxObserved > consumer.maxSize {
+    consumer.broker.logger.Printf("WARN: [%s] maxSize %d is smaller than the largest message observed (%d bytes) at offset %d\n",
+      consumer.broker.topic, consumer.maxSize, maxObserved, consumer.offset)
+    if consumer.WarmUpAutoAdjust {
+      consumer.setMaxSize(maxObserved)
+    }
+  }
+  return maxObserved, nil
+}
+
+// Walks the length prefixes of a message set and returns the largest frame size (prefix included).
+// A trailing frame cut short by the fetch size still counts, its declared length is what matters
+// (capped at the largest uint32, which a corrupt length prefix plus the prefix itself may pass).
+func largestFrame(payload []byte) uint32 {
+  var largest uint64 = 0
+  var current uint64 = 0
+  for current+4 <= uint64(len(payload)) {
+    frame := 4 + uint64(binary.BigEndian.Uint32(payload[current:]))
+    if frame > largest {
+      largest = frame
+    }
+    if current+frame > uint64(len(payload)) {
+      // cut short, nothing follows it
+      break
+    }
+    current += frame
+  }
+  if largest > math.MaxUint32 {
+    return math.MaxUint32
+  }
+  return uint32(largest)
+}
+
+// Consumes everything available from the earliest offset the broker still holds, which may be
+// beyond 0 once retention has deleted old segments, whatever the OffsetStore holds. Returns once caught up.
+func (consumer *BrokerConsumer) ConsumeFromEarliest(handlerFunc MessageHandlerFunc) (int, error) {
+  offsets, err := consumer.GetOffsets(-2, 1)
+  if err != nil {
+    return -1, err
+  }
+  if len(offsets) > 0 {
+    // over the OffsetStore's offset too
+    consumer.Seek(offsets[0])
+    // the earliest offset starts a message, there's nothing for SkipInitial to resync onto
+    consumer.skipRemaining = 0
+  }
+  return consumer.ConsumeUntil(func(msg *Message) bool { return false }, handlerFunc)
+}
+
+// Keeps fetching and handling messages until pred returns true for a message, or there are
+// no more messages available. pred is evaluated after the message has been handed to handlerFunc,
+// and the offset advances through the stopping message.
+// Note: messages sharing a compressed message set entry with the stopping message are not delivered.
+func (consumer *BrokerConsumer) ConsumeUntil(pred func(msg *Message) (stop bool), handlerFunc MessageHandlerFunc) (total int, err error) {
+  return consumer.consumeUntilE(pred, handlerFunc.withError())
+}
+
+// Like ConsumeUntil (pred may be nil), but a handler error stops consumption and is returned, leaving the
+// offset at the failed message as ConsumeE does
+func (consumer *BrokerConsumer) consumeUntilE(pred func(msg *Message) (stop bool), handlerFunc MessageHandlerFuncE) (total int, err error) {
+  conn, err := consumer.broker.connect()
+  if err != nil {
+    return -1, err
+  }
+  defer func() { consumer.releaseConn(conn, err) }()
+
+  for {
+    before := consumer.offset
+    num, stopped, err := consumer.consumeWithConnUntil(conn, pred, handlerFunc)
+    if num > 0 {
+      total += num
+    }
+    if err != nil {
+      consumer.broker.logger.Printf("Fatal Error: %v\n", err)
+      return total, err
+    }
+    // everything fetched may have been skipped (PrefixFilter, ...), only a fetch that didn't move is caught up
+    if stopped || consumer.offset == before {
+      return total, nil
+    }
+  }
+}
+
+// Seeks to start and consumes forward, handing messages before end to handlerFunc. Returns once the next
+// message is at or beyond end, leaving the consumer's offset on it, or with ErrNoMessages if the partition
+// runs out before end. Messages of a compressed set starting before end are all delivered.
+func (consumer *BrokerConsumer) ConsumeRange(start uint64, end uint64, handlerFunc MessageHandlerFunc) (int, error) {
+  consumer.Seek(start)
+  if start >= end {
+    return 0, nil
+  }
+  conn, err := consumer.broker.connect()
+  if err != nil {
+    return -1, err
+  }
+  var fetchErr error
+  defer func() { consumer.releaseConn(conn, fetchErr) }()
+
+  consumer.rangeEnd = end
+  defer func() { consumer.rangeEnd = 0 }()
+  total := 0
+  for consumer.offset < end {
+    before := consumer.offset
+    var num int
+    var stopped bool
+    num, stopped, fetchErr = consumer.consumeWithConnUntil(conn, nil, handlerFunc.withError())
+    if num > 0 {
+      total += num
+    }
+    if fetchErr != nil {
+      return total, fetchErr
+    }
+    if stopped {
+      return total, nil
+    }
+    if consumer.offset == before {
+      return total, ErrNoMessages
+    }
+  }
+  return total, nil
+}
+
+// Fetches until it has the next n messages, leaving the offset just past the last of them, and returns them.
+// Returns fewer once MaxEmptyPolls fetches in a row have found nothing new. As with ConsumeUntil, messages
+// sharing a compressed message set entry with the n-th are skipped.
+func (consumer *BrokerConsumer) ConsumeN(n int) ([]*Message, error) {
+  msgs := make([]*Message, 0, n)
+  if n <= 0 {
+    return msgs, nil
+  }
+  conn, err := consumer.broker.connect()
+  if err != nil {
+    return msgs, err
+  }
+  var fetchErr error
+  defer func() { consumer.releaseConn(conn, fetchErr) }()
+
+  maxEmptyPolls := consumer.MaxEmptyPolls
+  if maxEmptyPolls <= 0 {
+    maxEmptyPolls = DEFAULT_MAX_EMPTY_POLLS
+  }
+  for emptyPolls := 0; len(msgs) < n && emptyPolls < maxEmptyPolls; {
+    before := consumer.offset
+    _, _, fetchErr = consumer.consumeWithConnUntil(conn, func(msg *Message) bool {
+      return len(msgs) == n
+    }, func(msg *Message) error {
+      msgs = append(msgs, msg)
+      return nil
+    })
+    if fetchErr != nil {
+      return msgs, fetchErr
+    }
+    if consumer.offset != before {
+      emptyPolls = 0
+      continue
+    }
+    if emptyPolls++; emptyPolls < maxEmptyPolls {
+      time.Sleep(EMPTY_POLL_WAIT_MS * time.Millisecond)
+    }
+  }
+  return msgs, nil
+}
+
+// Get a list of valid offsets (up to maxNumOffsets) before the given time, where 
+// time is in milliseconds (-1, from the latest offset available, -2 from the smallest offset available)
+// The result is a list of offsets, in descending order: the latest is first, the earliest last.
+// See GetOffsetsAscending for the reverse. A maxNumOffsets of 0 returns no offsets without asking the broker.
+func (consumer *BrokerConsumer) GetOffsets(time int64, maxNumOffsets uint32) ([]uint64, error) {
+  response, err := consumer.GetOffsetsDetailed(time, maxNumOffsets)
+  return response.Offsets, err
+}
+
+// As GetOffsets, but keeps the requested time and the count the broker reported alongside the offsets
+func (consumer *BrokerConsumer) GetOffsetsDetailed(time int64, maxNumOffsets uint32) (OffsetResponse, error) {
+  if maxNumOffsets == 0 {
+    return OffsetResponse{Time: time, Offsets: make([]uint64, 0)}, nil
+  }
+  conn, err := consumer.broker.connect()
+  if err != nil {
+    return OffsetResponse{Time: time, Offsets: make([]uint64, 0)}, err
+  }
+
+  response, err := consumer.broker.getOffsetResponseWithConn(consumer.timed(conn), time, maxNumOffsets)
+  consumer.broker.release(conn, err)
+  return response, err
+}
+
+func (b *Broker) getOffsetsWithConn(conn net.Conn, time int64, maxNumOffsets uint32) ([]uint64, error) {
+  response, err := b.getOffsetResponseWithConn(conn, time, maxNumOffsets)
+  return response.Offsets, err
+}
+
+func (b *Broker) getOffsetResponseWithConn(conn net.Conn, time int64, maxNumOffsets uint32) (OffsetResponse, error) {
+  return b.exchangeOffsets(conn, b.EncodeOffsetRequest(time, maxNumOffsets), time, maxNumOffsets)
+}
+
+// Send an offsets request for time & maxNumOffsets on conn and read the response. The request may be for
+// another topic/partition than the broker's own, see GetOffsetsForPartitions.
+func (b *Broker) exchangeOffsets(conn net.Conn, request []byte, time int64, maxNumOffsets uint32) (OffsetResponse, error) {
+  response := OffsetResponse{Time: time, Offsets: make([]uint64, 0)}
+
+  _, err := b.write(conn, request)
+  if err != nil {
+    return response, err
+  }
+
+  // <ERROR CODE: uint16><NUMBER OF OFFSETS: uint32><OFFSET: uint64>...
+  _, payload, err := b.readResponse(conn, b.responseLimit(6+8*uint64(maxNumOffsets)))
+  if err != nil {
+    return response, err
+  }
 
-  return offsets, err
+  return parseOffsetResponse(time, payload)
 }
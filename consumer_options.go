@@ -0,0 +1,172 @@
+/*
+ *  Copyright (c) 2011 NeuStar, Inc.
+ *  All rights reserved.  
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at 
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *  
+ *  NeuStar, the Neustar logo and related names and logos are registered
+ *  trademarks, service marks or tradenames of NeuStar, Inc. All other 
+ *  product names, company names, marks, logos and symbols may be trademarks
+ *  of their respective owners.
+ */
+
+package kafka
+
+import (
+  "crypto/tls"
+  "hash/crc32"
+  "net"
+  "time"
+)
+
+// Configures a BrokerConsumer created by NewConsumer
+type ConsumerOption func(consumer *BrokerConsumer)
+
+// Create a new broker consumer, configured by opts. Without options it starts at offset 0 with a maxSize
+// of 0, which is only enough for GetOffsets, so consumers will want at least WithMaxSize.
+// hostname - host and optionally port, delimited by ':'. Several, separated by commas, are connected to
+// in turn, failing over from any that can't be reached.
+// topic to consume
+// partition to consume from
+func NewConsumer(hostname string, topic string, partition int, opts ...ConsumerOption) *BrokerConsumer {
+  consumer := &BrokerConsumer{broker: newBroker(hostname, topic, partition),
+    codecs: DefaultCodecsMap,
+    closed: make(chan bool)}
+  for _, opt := range opts {
+    opt(consumer)
+  }
+  return consumer
+}
+
+// Start consuming from offset
+func WithOffset(offset uint64) ConsumerOption {
+  return func(consumer *BrokerConsumer) {
+    consumer.offset = offset
+    consumer.startAtLatest = false
+  }
+}
+
+// Start consuming from the latest offset, looked up on the first fetch so constructing the consumer
+// stays offline. A committed offset in the OffsetStore, or a Seek, still wins. See NewBrokerLatestConsumer.
+func WithLatestOffset() ConsumerOption {
+  return func(consumer *BrokerConsumer) {
+    consumer.startAtLatest = true
+  }
+}
+
+// Fetch up to maxSize bytes at a time (this should be at least as big as the biggest message to be published)
+func WithMaxSize(maxSize uint32) ConsumerOption {
+  return func(consumer *BrokerConsumer) {
+    consumer.maxSize = maxSize
+  }
+}
+
+// See SetLogger
+func WithLogger(logger Logger) ConsumerOption {
+  return func(consumer *BrokerConsumer) {
+    consumer.SetLogger(logger)
+  }
+}
+
+// See BrokerConsumer.ReadTimeout
+func WithReadTimeout(timeout time.Duration) ConsumerOption {
+  return func(consumer *BrokerConsumer) {
+    consumer.ReadTimeout = timeout
+  }
+}
+
+// See BrokerConsumer.WriteTimeout
+func WithWriteTimeout(timeout time.Duration) ConsumerOption {
+  return func(consumer *BrokerConsumer) {
+    consumer.WriteTimeout = timeout
+  }
+}
+
+// Resume from, and commit to, store every commitInterval handled messages (see BrokerConsumer.OffsetStore)
+func WithOffsetStore(store OffsetStore, commitInterval int) ConsumerOption {
+  return func(consumer *BrokerConsumer) {
+    consumer.OffsetStore = store
+    consumer.CommitInterval = commitInterval
+  }
+}
+
+// Commit to the OffsetStore once d has passed since the last commit, see BrokerConsumer.OffsetStore
+func WithCommitEvery(d time.Duration) ConsumerOption {
+  return func(consumer *BrokerConsumer) {
+    consumer.CommitEvery = d
+  }
+}
+
+// See SetDialer
+func WithDialer(dialer func(network, addr string) (net.Conn, error)) ConsumerOption {
+  return func(consumer *BrokerConsumer) {
+    consumer.SetDialer(dialer)
+  }
+}
+
+// See SetTLS
+func WithTLS(config *tls.Config) ConsumerOption {
+  return func(consumer *BrokerConsumer) {
+    consumer.SetTLS(config)
+  }
+}
+
+// See SetChecksumTable
+func WithChecksumTable(table *crc32.Table) ConsumerOption {
+  return func(consumer *BrokerConsumer) {
+    consumer.SetChecksumTable(table)
+  }
+}
+
+// See SetOnTiming
+func WithOnTiming(onTiming func(label string, d time.Duration)) ConsumerOption {
+  return func(consumer *BrokerConsumer) {
+    consumer.SetOnTiming(onTiming)
+  }
+}
+
+// See SetKeepAlive
+func WithKeepAlive(period time.Duration) ConsumerOption {
+  return func(consumer *BrokerConsumer) {
+    consumer.SetKeepAlive(period)
+  }
+}
+
+// See BrokerConsumer.HeartbeatInterval
+func WithHeartbeatInterval(interval time.Duration) ConsumerOption {
+  return func(consumer *BrokerConsumer) {
+    consumer.HeartbeatInterval = interval
+  }
+}
+
+// See SetRateLimit
+func WithRateLimit(messagesPerSecond float64, bytesPerSecond float64) ConsumerOption {
+  return func(consumer *BrokerConsumer) {
+    consumer.SetRateLimit(messagesPerSecond, bytesPerSecond)
+  }
+}
+
+// Back off polling an idle partition up to max, see BrokerConsumer.MaxPollInterval
+func WithPollBackoff(max time.Duration) ConsumerOption {
+  return func(consumer *BrokerConsumer) {
+    consumer.MaxPollInterval = max
+  }
+}
+
+// Connect to the first of hostnames that can be reached, replacing the constructor's hostname.
+// Each must serve the topic/partition, e.g. the replicas behind a load balancer.
+func WithBrokers(hostnames ...string) ConsumerOption {
+  return func(consumer *BrokerConsumer) {
+    consumer.broker.setHostnames(hostnames)
+  }
+}
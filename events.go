@@ -0,0 +1,74 @@
+/*
+ *  Copyright (c) 2011 NeuStar, Inc.
+ *  All rights reserved.  
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at 
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *  
+ *  NeuStar, the Neustar logo and related names and logos are registered
+ *  trademarks, service marks or tradenames of NeuStar, Inc. All other 
+ *  product names, company names, marks, logos and symbols may be trademarks
+ *  of their respective owners.
+ */
+
+package kafka
+
+type ConsumeEventType int
+
+const (
+  EVENT_CONNECTED    ConsumeEventType = iota // connected to the broker
+  EVENT_FETCHED                              // a fetch returned messages, see Count & Bytes
+  EVENT_ERROR                                // a connect or fetch failed, see Err
+  EVENT_RECONNECTING                         // about to retry connecting
+  EVENT_CAUGHT_UP                            // a fetch returned no messages, the partition has nothing newer
+  EVENT_STOPPED                              // the consume loop has exited
+)
+
+func (t ConsumeEventType) String() string {
+  switch t {
+  case EVENT_CONNECTED:
+    return "Connected"
+  case EVENT_FETCHED:
+    return "Fetched"
+  case EVENT_ERROR:
+    return "Error"
+  case EVENT_RECONNECTING:
+    return "Reconnecting"
+  case EVENT_CAUGHT_UP:
+    return "CaughtUp"
+  case EVENT_STOPPED:
+    return "Stopped"
+  }
+  return "Unknown"
+}
+
+// Something a consume loop did, published on BrokerConsumer.Events
+type ConsumeEvent struct {
+  Type   ConsumeEventType
+  Offset uint64 // the consumer's offset after the event
+  Count  int    // EVENT_FETCHED: messages handled
+  Bytes  uint64 // EVENT_FETCHED: bytes of the message set consumed
+  Err    error  // EVENT_ERROR
+}
+
+// Publish an event if Events is set. The send never blocks: if the channel isn't
+// being drained the event is dropped rather than stalling the consume loop.
+func (consumer *BrokerConsumer) emit(event ConsumeEvent) {
+  if consumer.Events == nil {
+    return
+  }
+  event.Offset = consumer.offset
+  select {
+  case consumer.Events <- event:
+  default:
+  }
+}
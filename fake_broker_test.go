@@ -0,0 +1,250 @@
+/*
+ *  Copyright (c) 2011 NeuStar, Inc.
+ *  All rights reserved.  
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at 
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *  
+ *  NeuStar, the Neustar logo and related names and logos are registered
+ *  trademarks, service marks or tradenames of NeuStar, Inc. All other 
+ *  product names, company names, marks, logos and symbols may be trademarks
+ *  of their respective owners.
+ */
+
+package kafka
+
+import (
+  "encoding/binary"
+  "io"
+  "net"
+  "sync"
+)
+
+// A stand-in broker for tests, speaking the wire protocol on a local port (see Addr) or over in-memory
+// connections (see Dial). Every topic and partition share one log: produce requests append to it, fetches
+// read it from offset 0 cut at their maxSize, and offsets requests get its start (time -2) or end unless
+// SetOffsets says otherwise. Responses can be scripted ahead of that, e.g. error codes or truncated frames.
+type FakeBroker struct {
+  lock     sync.Mutex
+  listener net.Listener
+  conns    map[net.Conn]bool
+  log      []byte
+  offsets  []uint64
+  script   []fakeResponse
+  requests []RequestType
+}
+
+type fakeResponse struct {
+  frame  []byte
+  hangUp bool // close the connection once frame is written
+}
+
+// Start a FakeBroker listening on a free local port
+func NewFakeBroker() (*FakeBroker, error) {
+  listener, err := net.Listen(NETWORK, "127.0.0.1:0")
+  if err != nil {
+    return nil, err
+  }
+  f := &FakeBroker{listener: listener, conns: make(map[net.Conn]bool)}
+  go func() {
+    for {
+      conn, err := listener.Accept()
+      if err != nil {
+        return
+      }
+      go f.serve(conn)
+    }
+  }()
+  return f, nil
+}
+
+// The host:port to connect to
+func (f *FakeBroker) Addr() string {
+  return f.listener.Addr().String()
+}
+
+// Open an in-memory connection to the broker, bypassing TCP: usable as a dialer (see SetDialer)
+func (f *FakeBroker) Dial(network, addr string) (net.Conn, error) {
+  client, server := net.Pipe()
+  go f.serve(server)
+  return client, nil
+}
+
+// Add messages to the end of the log
+func (f *FakeBroker) Append(messages ...*Message) {
+  f.lock.Lock()
+  defer f.lock.Unlock()
+  f.log = append(f.log, EncodeMessageSet(messages)...)
+}
+
+// Answer offsets requests with offsets (up to the requested number), nil goes back to the log's start or end
+func (f *FakeBroker) SetOffsets(offsets ...uint64) {
+  f.lock.Lock()
+  defer f.lock.Unlock()
+  f.offsets = offsets
+}
+
+// Answer the next request with the broker error code (see BrokerError). Produce requests, which get no
+// response, don't count.
+func (f *FakeBroker) RespondWithError(code int16) {
+  f.queue(fakeResponse{frame: fakeFrame(code, nil)})
+}
+
+// Answer the next request with frame as it is, length prefix included, then close the connection; a frame
+// shorter than its length prefix says is one cut short. Produce requests don't count.
+func (f *FakeBroker) RespondWithFrame(frame []byte) {
+  f.queue(fakeResponse{frame: frame, hangUp: true})
+}
+
+func (f *FakeBroker) queue(response fakeResponse) {
+  f.lock.Lock()
+  defer f.lock.Unlock()
+  f.script = append(f.script, response)
+}
+
+// The types of the requests received so far, in order
+func (f *FakeBroker) Requests() []RequestType {
+  f.lock.Lock()
+  defer f.lock.Unlock()
+  return append([]RequestType{}, f.requests...)
+}
+
+// Stop listening and close the connections to the broker
+func (f *FakeBroker) Close() error {
+  err := f.listener.Close()
+  f.lock.Lock()
+  defer f.lock.Unlock()
+  for conn := range f.conns {
+    conn.Close()
+  }
+  return err
+}
+
+func (f *FakeBroker) serve(conn net.Conn) {
+  f.lock.Lock()
+  f.conns[conn] = true
+  f.lock.Unlock()
+  defer func() {
+    f.lock.Lock()
+    delete(f.conns, conn)
+    f.lock.Unlock()
+    conn.Close()
+  }()
+
+  size := make([]byte, 4)
+  for {
+    if _, err := io.ReadFull(conn, size); err != nil {
+      return
+    }
+    request := make([]byte, 4+binary.BigEndian.Uint32(size))
+    copy(request, size)
+    if _, err := io.ReadFull(conn, request[4:]); err != nil {
+      return
+    }
+    response := f.respond(request)
+    if response.frame == nil {
+      continue
+    }
+    if _, err := conn.Write(response.frame); err != nil || response.hangUp {
+      return
+    }
+  }
+}
+
+// The response to request (size prefix included), a nil frame for none
+func (f *FakeBroker) respond(request []byte) fakeResponse {
+  f.lock.Lock()
+  defer f.lock.Unlock()
+  if len(request) < 4+2 {
+    return fakeResponse{frame: fakeFrame(-1, nil)}
+  }
+  requestType := RequestType(binary.BigEndian.Uint16(request[4:]))
+  f.requests = append(f.requests, requestType)
+  switch requestType {
+  case REQUEST_PRODUCE:
+    f.produce(request[4+2:], 1)
+    return fakeResponse{}
+  case REQUEST_MULTIPRODUCE:
+    if len(request) >= 4+2+2 {
+      f.produce(request[4+2+2:], int(binary.BigEndian.Uint16(request[4+2:])))
+    }
+    return fakeResponse{}
+  }
+
+  if len(f.script) > 0 {
+    next := f.script[0]
+    f.script = f.script[1:]
+    return next
+  }
+  switch requestType {
+  case REQUEST_FETCH:
+    fetch, err := DecodeConsumeRequest(request)
+    if err != nil {
+      return fakeResponse{frame: fakeFrame(-1, nil)}
+    }
+    messageSet := []byte{}
+    if fetch.Offset < uint64(len(f.log)) {
+      end := fetch.Offset + uint64(fetch.MaxSize)
+      if end > uint64(len(f.log)) {
+        end = uint64(len(f.log))
+      }
+      messageSet = f.log[fetch.Offset:end]
+    }
+    return fakeResponse{frame: fakeFrame(0, messageSet)}
+  case REQUEST_OFFSETS:
+    offsetRequest, err := DecodeOffsetRequest(request)
+    if err != nil {
+      return fakeResponse{frame: fakeFrame(-1, nil)}
+    }
+    offsets := f.offsets
+    if offsets == nil {
+      offsets = []uint64{uint64(len(f.log))}
+      if offsetRequest.Time == -2 {
+        offsets = []uint64{0}
+      }
+    }
+    if uint32(len(offsets)) > offsetRequest.MaxNumOffsets {
+      offsets = offsets[:offsetRequest.MaxNumOffsets]
+    }
+    // <NUMBER OF OFFSETS: uint32><OFFSET: uint64>*
+    body := binary.BigEndian.AppendUint32(nil, uint32(len(offsets)))
+    for _, offset := range offsets {
+      body = binary.BigEndian.AppendUint64(body, offset)
+    }
+    return fakeResponse{frame: fakeFrame(0, body)}
+  }
+  return fakeResponse{frame: fakeFrame(-1, nil)}
+}
+
+// Append the message sets of count produce requests, each <TOPIC SIZE: uint16><TOPIC: bytes><PARTITION: uint32>
+// <MESSAGE SET SIZE: uint32><MESSAGE SET: bytes>
+func (f *FakeBroker) produce(requests []byte, count int) {
+  for i := 0; i < count && len(requests) >= 2; i++ {
+    header := 2 + int(binary.BigEndian.Uint16(requests)) + 4
+    if len(requests) < header+4 {
+      return
+    }
+    end := header + 4 + int(binary.BigEndian.Uint32(requests[header:]))
+    if len(requests) < end {
+      return
+    }
+    f.log = append(f.log, requests[header+4:end]...)
+    requests = requests[end:]
+  }
+}
+
+// <LENGTH: uint32><ERROR CODE: uint16><BODY: bytes>
+func fakeFrame(code int16, body []byte) []byte {
+  frame := binary.BigEndian.AppendUint32(nil, uint32(2+len(body)))
+  frame = binary.BigEndian.AppendUint16(frame, uint16(code))
+  return append(frame, body...)
+}
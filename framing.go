@@ -0,0 +1,115 @@
+/*
+ *  Copyright (c) 2011 NeuStar, Inc.
+ *  All rights reserved.  
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at 
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *  
+ *  NeuStar, the Neustar logo and related names and logos are registered
+ *  trademarks, service marks or tradenames of NeuStar, Inc. All other 
+ *  product names, company names, marks, logos and symbols may be trademarks
+ *  of their respective owners.
+ */
+
+package kafka
+
+import (
+  "io"
+)
+
+// How ConsumeToWriter separates payloads in its output stream
+type Framing int
+
+const (
+  // each message written as an encoded message set entry (see Message.Encode), readable back with Decode
+  FRAMING_LENGTH_PREFIX Framing = iota
+  // each payload followed by '\n'
+  FRAMING_NEWLINE
+  // each payload followed by a null byte, binary-safe for piping (e.g. xargs -0)
+  FRAMING_NULL
+  // payloads written back to back
+  FRAMING_NONE
+)
+
+// Writes msg to w using the framing
+func (framing Framing) write(w io.Writer, msg *Message) error {
+  var delimiter []byte
+  switch framing {
+  case FRAMING_LENGTH_PREFIX:
+    _, err := w.Write(msg.Encode())
+    return err
+  case FRAMING_NEWLINE:
+    delimiter = []byte{'\n'}
+  case FRAMING_NULL:
+    delimiter = []byte{0}
+  }
+  // the payload may share its backing array with the fetch buffer, so write the delimiter separately
+  _, err := w.Write(msg.PayloadRef())
+  if err == nil && delimiter != nil {
+    _, err = w.Write(delimiter)
+  }
+  return err
+}
+
+// Consumes the available messages, writing each one to w framed according to consumer.Framing.
+// Stops at the first write error, which is returned, leaving the offset on the message that failed to
+// write so consuming again retries it.
+func (consumer *BrokerConsumer) ConsumeToWriter(w io.Writer) (int, error) {
+  return consumer.consumeUntilE(nil, func(msg *Message) error {
+    return consumer.Framing.write(w, msg)
+  })
+}
+
+// Like tail -f: from the latest offset, writes each new message's payload to w followed by '\n' until quit,
+// reconnecting as ConsumeOnChannelE does. Stops at the first write error, which is returned.
+// Returns the number of messages written.
+func (consumer *BrokerConsumer) Tail(w io.Writer, pollTimeoutMs int64, quit chan bool) (int, error) {
+  if err := consumer.SeekToLatest(); err != nil {
+    return -1, err
+  }
+
+  msgChan := make(chan *Message)
+  stop := make(chan bool)
+  writeFailed := make(chan bool)
+  finished := make(chan bool)
+  go func() {
+    select {
+    case <-quit:
+    case <-writeFailed:
+    case <-finished:
+    }
+    close(stop)
+  }()
+  var consumeErr error
+  go func() {
+    _, consumeErr = consumer.ConsumeOnChannelE(msgChan, pollTimeoutMs, stop)
+    close(finished)
+  }()
+
+  num := 0
+  var writeErr error
+  for msg := range msgChan {
+    if writeErr != nil {
+      continue // draining what was decoded before the stop
+    }
+    if writeErr = FRAMING_NEWLINE.write(w, msg); writeErr != nil {
+      close(writeFailed)
+      continue
+    }
+    num++
+  }
+  <-finished
+  if writeErr != nil {
+    return num, writeErr
+  }
+  return num, consumeErr
+}
@@ -0,0 +1,72 @@
+/*
+ *  Copyright (c) 2011 NeuStar, Inc.
+ *  All rights reserved.  
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at 
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *  
+ *  NeuStar, the Neustar logo and related names and logos are registered
+ *  trademarks, service marks or tradenames of NeuStar, Inc. All other 
+ *  product names, company names, marks, logos and symbols may be trademarks
+ *  of their respective owners.
+ */
+
+package kafka
+
+import (
+  "encoding/json"
+  "fmt"
+)
+
+// What the JSON handlers do with a payload that isn't valid JSON
+type JSONInvalid int
+
+const (
+  // return the error, stopping ConsumeE (and friends) at the message
+  JSON_FAIL JSONInvalid = iota
+  // log the error through the consumer's logger (see SetLogger) and carry on with the next message
+  JSON_SKIP
+)
+
+// Unmarshal the payload of msg into v, as json.Unmarshal does. The error says which offset held invalid JSON.
+func DecodeJSON(msg *Message, v interface{}) error {
+  if err := json.Unmarshal(msg.PayloadRef(), v); err != nil {
+    return fmt.Errorf("invalid JSON payload at offset %d: %w", msg.Offset(), err)
+  }
+  return nil
+}
+
+// Adapt a handler of JSON objects for the consumer's ConsumeE, decoding each payload into a map
+func (consumer *BrokerConsumer) JSONHandlerFunc(handler func(v map[string]interface{}), invalid JSONInvalid) MessageHandlerFuncE {
+  return consumer.JSONTargetHandlerFunc(func() interface{} {
+    return &map[string]interface{}{}
+  }, func(msg *Message, v interface{}) {
+    handler(*v.(*map[string]interface{}))
+  }, invalid)
+}
+
+// Adapt a handler for the consumer's ConsumeE, decoding each payload into a value from newTarget (a pointer,
+// e.g. to a struct) which is handed to handler along with its message
+func (consumer *BrokerConsumer) JSONTargetHandlerFunc(newTarget func() interface{}, handler func(msg *Message, v interface{}), invalid JSONInvalid) MessageHandlerFuncE {
+  return func(msg *Message) error {
+    v := newTarget()
+    if err := DecodeJSON(msg, v); err != nil {
+      if invalid == JSON_SKIP {
+        consumer.broker.logger.Printf("WARN: [%s] skipping message: %v\n", consumer.broker.topic, err)
+        return nil
+      }
+      return err
+    }
+    handler(msg, v)
+    return nil
+  }
+}
@@ -23,73 +23,508 @@
 package kafka
 
 import (
-  "bufio"
+  "crypto/tls"
   "encoding/binary"
   "errors"
   "fmt"
+  "hash/crc32"
   "io"
-  "log"
+  "math"
   "net"
+  "strings"
+  "sync"
+  "time"
 )
 
 const (
   NETWORK = "tcp"
+  // unless set with SetMaxResponseBytes, a response may be this many times the size expected of it
+  // (plus MAX_RESPONSE_SLACK_BYTES) before readResponse refuses to allocate it
+  MAX_RESPONSE_SIZE_MULTIPLE = 4
+  MAX_RESPONSE_SLACK_BYTES   = 1024
+  // idle connections a broker keeps for reuse, unless changed with SetMaxIdleConnections
+  DEFAULT_MAX_IDLE_CONNECTIONS = 2
+  // how long an endpoint that failed to connect is passed over for the others
+  ENDPOINT_COOLDOWN_IN_SECONDS = 30
+  // the labels durations are reported to an OnTiming hook under (see SetOnTiming)
+  TIMING_CONNECT = "connect" // dialing a new connection, TLS handshake included
+  TIMING_WRITE   = "write"   // writing a request
+  TIMING_READ    = "read"    // waiting for and reading a response
 )
 
 type Broker struct {
   topic     string
   partition int
-  hostname  string
+  // host:port endpoints to connect to, in order of preference, all serving the topic/partition
+  hostnames []string
+  localAddr *net.TCPAddr // source address to dial from, nil lets the OS choose
+  // opens connections to the broker, e.g. through a proxy, over TLS, or to an in-memory net.Pipe in tests.
+  // nil dials TCP with net.Dial (from localAddr when set).
+  Dialer func(network, addr string) (net.Conn, error)
+  // TCP keepalive period for the TCP connections dialed, 0 leaves the default and negative disables keepalive
+  keepAlive time.Duration
+  // when set, connections are wrapped in a TLS client with this config (see setTLS)
+  tlsConfig *tls.Config
+  // when set, called with how long each connect, request write and response read took
+  onTiming  func(label string, d time.Duration)
+  // table message checksums are computed and verified with, nil is IEEE (see setChecksumTable)
+  crcTable  *crc32.Table
+  logger    Logger
+  // cap on the declared length of a response, 0 derives it from the request
+  maxResponseBytes uint32
+
+  // pool of idle connections handed out by connect and given back by release
+  lock    sync.Mutex
+  idle    []net.Conn
+  maxIdle int
+  // endpoints that failed to connect, and when they may be tried again (guarded by lock)
+  deadUntil map[string]time.Time
 }
 
+// hostname may list several endpoints separated by commas, see setHostnames
 func newBroker(hostname string, topic string, partition int) *Broker {
-  return &Broker{topic: topic,
+  b := &Broker{topic: topic,
     partition: partition,
-    hostname:  hostname}
+    logger:    DefaultLogger,
+    maxIdle:   DEFAULT_MAX_IDLE_CONNECTIONS,
+    deadUntil: make(map[string]time.Time)}
+  b.setHostnames(strings.Split(hostname, ","))
+  return b
+}
+
+// Store the endpoints the broker fails over between, in order of preference
+func (b *Broker) setHostnames(hostnames []string) {
+  b.hostnames = make([]string, 0, len(hostnames))
+  for _, hostname := range hostnames {
+    if hostname = strings.TrimSpace(hostname); hostname != "" {
+      b.hostnames = append(b.hostnames, hostname)
+    }
+  }
+  if len(b.hostnames) == 0 {
+    // leave the error to the dial
+    b.hostnames = []string{""}
+  }
+}
+
+// The endpoints to try, those cooling down after a failure last
+func (b *Broker) endpoints() []string {
+  b.lock.Lock()
+  defer b.lock.Unlock()
+  now := time.Now()
+  live := make([]string, 0, len(b.hostnames))
+  dead := make([]string, 0)
+  for _, hostname := range b.hostnames {
+    if until, ok := b.deadUntil[hostname]; ok && now.Before(until) {
+      dead = append(dead, hostname)
+    } else {
+      live = append(live, hostname)
+    }
+  }
+  return append(live, dead...)
+}
+
+// Connect to the first of hostnames that accepts, passing over any that recently failed
+// (for ENDPOINT_COOLDOWN_IN_SECONDS) unless they all have. Tries dialFn on each endpoint in turn,
+// returning the first connection made, or the last error as a *ConnectError
+func (b *Broker) dialEndpoints(dialFn func(hostname string) (net.Conn, error)) (net.Conn, error) {
+  var err error
+  endpoints := b.endpoints()
+  for _, hostname := range endpoints {
+    var conn net.Conn
+    if conn, err = dialFn(hostname); err == nil {
+      b.lock.Lock()
+      delete(b.deadUntil, hostname)
+      b.lock.Unlock()
+      return &endpointConn{Conn: conn, endpoint: hostname}, nil
+    }
+    b.markDead(hostname)
+    if len(b.hostnames) > 1 {
+      b.logger.Printf("WARN: [%s] couldn't connect to %s, trying the next endpoint: %v\n", b.topic, hostname, err)
+    }
+  }
+  return nil, &ConnectError{Endpoint: endpoints[len(endpoints)-1], Tried: len(endpoints), Topic: b.topic, Partition: b.partition, Err: err}
+}
+
+// No connection could be made to the broker. Unwraps to the dial's error, e.g. a *net.OpError.
+type ConnectError struct {
+  Endpoint  string // the last endpoint tried
+  Tried     int    // how many endpoints were tried, in turn
+  Topic     string
+  Partition int
+  Err       error
+}
+
+func (e *ConnectError) Error() string {
+  if e.Tried > 1 {
+    return fmt.Sprintf("connecting to %s (the last of %d endpoints) for %s:%d: %v", e.Endpoint, e.Tried, e.Topic, e.Partition, e.Err)
+  }
+  return fmt.Sprintf("connecting to %s for %s:%d: %v", e.Endpoint, e.Topic, e.Partition, e.Err)
+}
+
+func (e *ConnectError) Unwrap() error {
+  return e.Err
+}
+
+// Pass over endpoint for ENDPOINT_COOLDOWN_IN_SECONDS, unless all of the others are too
+func (b *Broker) markDead(endpoint string) {
+  b.lock.Lock()
+  b.deadUntil[endpoint] = time.Now().Add(ENDPOINT_COOLDOWN_IN_SECONDS * time.Second)
+  b.lock.Unlock()
+}
+
+// Whether some endpoint isn't cooling down after a failure
+func (b *Broker) hasLiveEndpoint() bool {
+  b.lock.Lock()
+  defer b.lock.Unlock()
+  now := time.Now()
+  for _, hostname := range b.hostnames {
+    if until, ok := b.deadUntil[hostname]; !ok || !now.Before(until) {
+      return true
+    }
+  }
+  return false
+}
+
+// A connection from dialEndpoints, remembering which endpoint it's to
+type endpointConn struct {
+  net.Conn
+  endpoint string
+}
+
+// The connected endpoint doesn't serve the topic/partition (it answered ErrWrongPartition). Unwraps to the
+// *BrokerError, so errors.Is(err, ErrWrongPartition) holds.
+type WrongBrokerError struct {
+  Endpoint  string
+  Topic     string
+  Partition int
+  Err       error
+}
+
+func (e *WrongBrokerError) Error() string {
+  return fmt.Sprintf("%s doesn't serve partition %d of %s: %v", e.Endpoint, e.Partition, e.Topic, e.Err)
 }
 
-func (b *Broker) connect() (conn *net.TCPConn, error error) {
-  raddr, err := net.ResolveTCPAddr(NETWORK, b.hostname)
+func (e *WrongBrokerError) Unwrap() error {
+  return e.Err
+}
+
+// Turn err, an ErrWrongPartition from conn, into a *WrongBrokerError, passing over conn's endpoint from now on
+func (b *Broker) wrongBroker(conn net.Conn, err error) error {
+  endpoint := ""
+  if ec, ok := conn.(*endpointConn); ok {
+    endpoint = ec.endpoint
+    b.markDead(endpoint)
+  }
+  return &WrongBrokerError{Endpoint: endpoint, Topic: b.topic, Partition: b.partition, Err: err}
+}
+
+// Whether a fetch that failed with err should move to another endpoint: it's a *WrongBrokerError
+// and some endpoint hasn't answered that (or failed to connect) lately
+func (b *Broker) canFailOver(err error) bool {
+  var wrongBroker *WrongBrokerError
+  return errors.As(err, &wrongBroker) && b.hasLiveEndpoint()
+}
+
+// Route logging to logger, nil restores DefaultLogger
+func (b *Broker) setLogger(logger Logger) {
+  if logger == nil {
+    logger = DefaultLogger
+  }
+  b.logger = logger
+}
+
+// Get a connection for a request/response exchange, reusing an idle one when there is one.
+// Give it back with release when done.
+func (b *Broker) connect() (net.Conn, error) {
+  b.lock.Lock()
+  if n := len(b.idle); n > 0 {
+    conn := b.idle[n-1]
+    b.idle = b.idle[:n-1]
+    b.lock.Unlock()
+    return conn, nil
+  }
+  b.lock.Unlock()
+  return b.dial()
+}
+
+// Return a connection from connect to the pool. A connection that saw an error (err != nil) may be
+// out of step with the broker, so it's closed instead, as is any beyond maxIdle.
+func (b *Broker) release(conn net.Conn, err error) {
+  b.lock.Lock()
+  defer b.lock.Unlock()
+  if err != nil || len(b.idle) >= b.maxIdle {
+    conn.Close()
+    return
+  }
+  b.idle = append(b.idle, conn)
+}
+
+// Close the idle connections in the pool
+func (b *Broker) Close() error {
+  b.lock.Lock()
+  idle := b.idle
+  b.idle = nil
+  b.lock.Unlock()
+
+  var err error
+  for _, conn := range idle {
+    if closeErr := conn.Close(); closeErr != nil && err == nil {
+      err = closeErr
+    }
+  }
+  return err
+}
+
+// Open a new connection, bypassing the pool, for long lived use by a consume loop.
+// Fails over between the broker's endpoints.
+func (b *Broker) dial() (net.Conn, error) {
+  defer b.reportTiming(b.startTiming(TIMING_CONNECT))
+  conn, err := b.dialEndpoints(b.dialEndpoint)
   if err != nil {
-    log.Println("Fatal Error: ", err)
+    b.logger.Printf("Fatal Error: %v\n", err)
     return nil, err
   }
-  conn, err = net.DialTCP(NETWORK, nil, raddr)
+  return conn, nil
+}
+
+func (b *Broker) dialEndpoint(hostname string) (net.Conn, error) {
+  var conn net.Conn
+  var err error
+  if b.Dialer != nil {
+    conn, err = b.Dialer(NETWORK, hostname)
+  } else if b.localAddr != nil {
+    conn, err = (&net.Dialer{LocalAddr: b.localAddr}).Dial(NETWORK, hostname)
+  } else {
+    conn, err = net.Dial(NETWORK, hostname)
+  }
+  if err != nil && b.localAddr != nil {
+    return nil, fmt.Errorf("from local address %s: %w", b.localAddr, err)
+  }
+  if tcpConn, ok := conn.(*net.TCPConn); ok && err == nil && b.keepAlive != 0 {
+    if err = tcpConn.SetKeepAlive(b.keepAlive > 0); err == nil && b.keepAlive > 0 {
+      err = tcpConn.SetKeepAlivePeriod(b.keepAlive)
+    }
+    if err != nil {
+      conn.Close()
+      return nil, fmt.Errorf("setting keepalive: %w", err)
+    }
+  }
+  if err == nil && b.tlsConfig != nil {
+    return b.handshake(conn, hostname)
+  }
+  return conn, err
+}
+
+// Wrap conn to hostname in a TLS client, completing the handshake before any request is written
+func (b *Broker) handshake(conn net.Conn, hostname string) (net.Conn, error) {
+  config := b.tlsConfig.Clone()
+  if config.ServerName == "" {
+    // verify the certificate against the endpoint's host
+    if host, _, err := net.SplitHostPort(hostname); err == nil {
+      config.ServerName = host
+    } else {
+      config.ServerName = hostname
+    }
+  }
+  tlsConn := tls.Client(conn, config)
+  if err := tlsConn.Handshake(); err != nil {
+    conn.Close()
+    return nil, fmt.Errorf("TLS handshake: %w", err)
+  }
+  return tlsConn, nil
+}
+
+// Write request to conn, reporting how long it took to onTiming
+func (b *Broker) write(conn net.Conn, request []byte) (int, error) {
+  defer b.reportTiming(b.startTiming(TIMING_WRITE))
+  return conn.Write(request)
+}
+
+// A Timing of label for onTiming, nil when it isn't set
+func (b *Broker) startTiming(label string) *Timing {
+  if b.onTiming == nil {
+    return nil
+  }
+  return StartTiming(label)
+}
+
+// Stop timing and report it to onTiming, if it was started
+func (b *Broker) reportTiming(timing *Timing) {
+  if timing != nil {
+    b.onTiming(timing.label, timing.Duration())
+  }
+}
+
+// Connect over TLS with config, nil goes back to plain connections. Its ServerName defaults to
+// each endpoint's host, InsecureSkipVerify skips verifying the broker's certificate (e.g. self-signed).
+func (b *Broker) setTLS(config *tls.Config) {
+  b.tlsConfig = config
+}
+
+// Compute and verify message checksums with table instead of IEEE, e.g. crc32.MakeTable(crc32.Castagnoli)
+// for producers or forks using that polynomial. nil goes back to IEEE.
+func (b *Broker) setChecksumTable(table *crc32.Table) {
+  b.crcTable = table
+}
+
+// messages with their checksums computed with the configured table, messages themselves when that is IEEE
+func (b *Broker) checksummed(messages []*Message) []*Message {
+  if b.crcTable == nil {
+    return messages
+  }
+  out := make([]*Message, len(messages))
+  for i, message := range messages {
+    out[i] = message.withChecksum(b.crcTable)
+  }
+  return out
+}
+
+// Bind outgoing connections to a local address, e.g. to pick the interface on a multi-homed host.
+// The port may be 0 to let the OS choose one.
+func (b *Broker) setLocalAddr(addr net.Addr) error {
+  if addr == nil {
+    b.localAddr = nil
+    return nil
+  }
+  if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+    b.localAddr = tcpAddr
+    return nil
+  }
+  tcpAddr, err := net.ResolveTCPAddr(NETWORK, addr.String())
   if err != nil {
-    log.Println("Fatal Error: ", err)
-    return nil, err
+    return fmt.Errorf("invalid local address %s: %v", addr, err)
   }
-  return conn, error
+  b.localAddr = tcpAddr
+  return nil
+}
+
+// Errors the broker reports in a response's error code, test with errors.Is
+var (
+  ErrUnknown          = errors.New("unknown broker error")
+  ErrOffsetOutOfRange = errors.New("offset out of range")
+  ErrInvalidMessage   = errors.New("invalid message")
+  ErrInvalidPartition = errors.New("invalid partition")
+  // the broker's name for ErrInvalidPartition
+  ErrWrongPartition   = ErrInvalidPartition
+  ErrInvalidFetchSize = errors.New("invalid fetch size")
+)
+
+// Error codes of the Kafka 0.7 wire protocol
+var brokerErrors = map[int16]error{
+  -1: ErrUnknown,
+  1:  ErrOffsetOutOfRange,
+  2:  ErrInvalidMessage,
+  3:  ErrInvalidPartition,
+  4:  ErrInvalidFetchSize,
+}
+
+// A non zero error code in a broker response
+type BrokerError struct {
+  Code int16
+}
+
+func (e *BrokerError) Error() string {
+  return fmt.Sprintf("Broker Response Error: %d (%v)", e.Code, e.Unwrap())
+}
+
+// The Err... value for the code, ErrUnknown for codes this package doesn't know
+func (e *BrokerError) Unwrap() error {
+  if err, ok := brokerErrors[e.Code]; ok {
+    return err
+  }
+  return ErrUnknown
+}
+
+// A connection whose every Read and Write must complete within a timeout of starting, zero clears the deadline
+type deadlineConn struct {
+  net.Conn
+  readTimeout  time.Duration
+  writeTimeout time.Duration
+}
+
+func (c *deadlineConn) Read(b []byte) (int, error) {
+  if err := c.Conn.SetReadDeadline(deadline(c.readTimeout)); err != nil {
+    return 0, err
+  }
+  return c.Conn.Read(b)
+}
+
+func (c *deadlineConn) Write(b []byte) (int, error) {
+  if err := c.Conn.SetWriteDeadline(deadline(c.writeTimeout)); err != nil {
+    return 0, err
+  }
+  return c.Conn.Write(b)
+}
+
+// The deadline for an operation starting now, the zero time (no deadline) for a zero timeout
+func deadline(timeout time.Duration) time.Time {
+  if timeout <= 0 {
+    return time.Time{}
+  }
+  return time.Now().Add(timeout)
+}
+
+// The largest response length to accept for a request expecting up to expected bytes back
+func (b *Broker) responseLimit(expected uint64) uint32 {
+  if b.maxResponseBytes > 0 {
+    return b.maxResponseBytes
+  }
+  limit := MAX_RESPONSE_SIZE_MULTIPLE*expected + MAX_RESPONSE_SLACK_BYTES
+  if limit > math.MaxUint32 {
+    return math.MaxUint32
+  }
+  return uint32(limit)
 }
 
 // returns length of response & payload & err
-func (b *Broker) readResponse(conn *net.TCPConn) (uint32, []byte, error) {
-  reader := bufio.NewReader(conn)
+// limit - the largest response length accepted, guarding against a corrupt or out of step
+// length field making us allocate a huge buffer
+func (b *Broker) readResponse(conn net.Conn, limit uint32) (uint32, []byte, error) {
+  return b.readResponseInto(conn, limit, nil)
+}
+
+// Like readResponse, but reads into *buf when it's large enough, growing it otherwise (buf may be nil
+// for a fresh slice each time). What's returned is only valid until *buf is read into again.
+func (b *Broker) readResponseInto(conn net.Conn, limit uint32, buf *[]byte) (uint32, []byte, error) {
+  defer b.reportTiming(b.startTiming(TIMING_READ))
+  // read straight from conn, a buffered reader could read ahead into the next response
   length := make([]byte, 4)
-  lenRead, err := io.ReadFull(reader, length)
-  if err != nil {
+  if lenRead, err := io.ReadFull(conn, length); err != nil {
+    if err == io.ErrUnexpectedEOF {
+      return 0, []byte{}, fmt.Errorf("response length cut short after %d bytes: %w", lenRead, err)
+    }
+    // io.EOF: closed between responses
     return 0, []byte{}, err
   }
-  if lenRead != 4 || lenRead < 0 {
-    return 0, []byte{}, errors.New("invalid length of the packet length field")
-  }
 
   expectedLength := binary.BigEndian.Uint32(length)
-  messages := make([]byte, expectedLength)
-  lenRead, err = io.ReadFull(reader, messages)
-  if err != nil {
+  if expectedLength > limit {
+    return 0, []byte{}, fmt.Errorf("response length %d exceeds the limit of %d bytes", expectedLength, limit)
+  }
+  var messages []byte
+  if buf != nil && uint32(cap(*buf)) >= expectedLength {
+    messages = (*buf)[:expectedLength]
+  } else {
+    messages = make([]byte, expectedLength)
+    if buf != nil {
+      *buf = messages
+    }
+  }
+  if lenRead, err := io.ReadFull(conn, messages); err != nil {
+    if err == io.EOF || err == io.ErrUnexpectedEOF {
+      // closed mid-frame, that's never the clean io.EOF between responses
+      return 0, []byte{}, fmt.Errorf("response cut short after %d of %d bytes: %w", lenRead, expectedLength, io.ErrUnexpectedEOF)
+    }
     return 0, []byte{}, err
   }
 
-  if uint32(lenRead) != expectedLength {
-    return 0, []byte{}, errors.New(fmt.Sprintf("Fatal Error: Unexpected Length: %d  expected:  %d", lenRead, expectedLength))
+  if len(messages) < 2 {
+    return 0, []byte{}, fmt.Errorf("response of %d bytes is too short for an error code", len(messages))
   }
-
-  errorCode := binary.BigEndian.Uint16(messages[0:2])
+  errorCode := int16(binary.BigEndian.Uint16(messages[0:2]))
   if errorCode != 0 {
-    log.Println("errorCode: ", errorCode)
-    return 0, []byte{}, errors.New(
-      fmt.Sprintf("Broker Response Error: %d", errorCode))
+    b.logger.Printf("errorCode: %d\n", errorCode)
+    return 0, []byte{}, &BrokerError{Code: errorCode}
   }
   return expectedLength, messages[2:], nil
 }
@@ -27,6 +27,22 @@ import (
   //"fmt"
   "bytes"
   "compress/gzip"
+  "context"
+  "crypto/tls"
+  "errors"
+  "fmt"
+  "encoding/binary"
+  "hash/crc32"
+  "io"
+  "math"
+  "net"
+  "net/http"
+  "net/http/httptest"
+  "os"
+  "strings"
+  "sync"
+  "sync/atomic"
+  "time"
 )
 
 func TestMessageCreation(t *testing.T) {
@@ -259,6 +275,130 @@ func TestPublishRequestEncoding(t *testing.T) {
   }
 }
 
+func TestBatchPublishPayloadsSplitsRequests(t *testing.T) {
+  // collects the message set of each produce request, the broker doesn't answer those
+  requests := make(chan []byte, 10)
+  address := serve(t, func(conn net.Conn) {
+    defer conn.Close()
+    size := make([]byte, 4)
+    for {
+      if _, err := io.ReadFull(conn, size); err != nil {
+        return
+      }
+      request := make([]byte, binary.BigEndian.Uint32(size))
+      if _, err := io.ReadFull(conn, request); err != nil {
+        return
+      }
+      // <REQUEST_TYPE: uint16><TOPIC SIZE: uint16><TOPIC><PARTITION: uint32><MESSAGE SET SIZE: uint32>
+      requests <- request[2+2+len("test")+4+4:]
+    }
+  })
+
+  payloads := make([][]byte, 10)
+  for i := range payloads {
+    payloads[i] = []byte(fmt.Sprintf("payload %d", i))
+  }
+  publisher := NewBrokerPublisher(address, "test", 0)
+  publisher.SetMaxRequestSize(100)
+  num, err := publisher.BatchPublishPayloads(payloads)
+  if err != nil || num != len(payloads) {
+    t.Fatalf("expected %d messages sent but got: %d, %v", len(payloads), num, err)
+  }
+
+  log := []byte{}
+  for batches := 0; ; batches++ {
+    if decoded, _, _ := decodeMessageSet(log, 0, DefaultCodecsMap, messageFormat{}); len(decoded) == len(payloads) {
+      break
+    }
+    select {
+    case messageSet := <-requests:
+      if 4+2+2+len("test")+4+4+len(messageSet) > 100 {
+        t.Fatalf("request of %d bytes over the max request size", len(messageSet))
+      }
+      log = append(log, messageSet...)
+    case <-time.After(time.Second):
+      t.Fatalf("expected more produce requests after %d", batches)
+    }
+  }
+  if len(requests) > 0 {
+    t.Fatal("expected no further produce requests")
+  }
+
+  // read back by a consumer
+  consumer := NewBrokerConsumer(serveLog(t, log), "test", 0, 0, 1048576)
+  consumer.SetLogger(NopLogger)
+  received := [][]byte{}
+  if _, err := consumer.Consume(func(msg *Message) { received = append(received, msg.Payload()) }); err != nil {
+    t.Fatal(err)
+  }
+  if len(received) != len(payloads) {
+    t.Fatalf("expected %d messages back but got: %d", len(payloads), len(received))
+  }
+  for i := range payloads {
+    if !bytes.Equal(received[i], payloads[i]) {
+      t.Fatalf("expected payload %q but got: %q", payloads[i], received[i])
+    }
+  }
+
+  if _, err := publisher.BatchPublishPayloads([][]byte{make([]byte, 100)}); !errors.Is(err, ErrRequestTooLarge) {
+    t.Fatalf("expected ErrRequestTooLarge but got: %v", err)
+  }
+}
+
+func TestPublishAndVerifyFailures(t *testing.T) {
+  broker, err := NewFakeBroker()
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer broker.Close()
+  publisher := NewBrokerPublisher("fake", "test", 0)
+  publisher.SetDialer(broker.Dial)
+  publisher.SetLogger(NopLogger)
+  defer publisher.Close()
+
+  // the broker keeps saying the log is empty, so the message is read back but the offset never moves
+  broker.SetOffsets(0)
+  if _, err := publisher.PublishAndVerify(NewMessage([]byte("one"))); err == nil || !strings.Contains(err.Error(), "did not advance") {
+    t.Fatalf("expected the offset not advancing to fail verification but got: %v", err)
+  }
+
+  // another message is at the offset it reads back
+  if _, err := publisher.PublishAndVerify(NewMessage([]byte("two"))); err == nil || !strings.Contains(err.Error(), "differs") {
+    t.Fatalf("expected a mismatch to fail verification but got: %v", err)
+  }
+}
+
+func TestPublishSyncRoundTrip(t *testing.T) {
+  address := serveBroker(t)
+  publisher := NewBrokerPublisher(address, "test", 0)
+  publisher.SetLogger(NopLogger)
+
+  offsets := make([]uint64, 3)
+  for i := range offsets {
+    offset, err := publisher.PublishSync([]byte(fmt.Sprintf("payload %d", i)))
+    if err != nil {
+      t.Fatal(err)
+    }
+    offsets[i] = offset
+  }
+  if offsets[0] != 0 || offsets[1] != uint64(len(NewMessage([]byte("payload 0")).Encode())) {
+    t.Fatalf("unexpected offsets: %v", offsets)
+  }
+
+  // each published message is read back at the offset returned for it
+  consumer := NewBrokerConsumer(address, "test", 0, 0, 1048576)
+  consumer.SetLogger(NopLogger)
+  msgs, err := consumer.ConsumeN(3)
+  if err != nil || len(msgs) != 3 {
+    t.Fatalf("expected 3 messages back but got: %d, %v", len(msgs), err)
+  }
+  for i, msg := range msgs {
+    if msg.Offset() != offsets[i] || msg.PayloadString() != fmt.Sprintf("payload %d", i) {
+      t.Fatalf("expected payload %d at %d but got: %q at %d", i, offsets[i], msg.PayloadString(), msg.Offset())
+    }
+  }
+}
+
 func TestConsumeRequestEncoding(t *testing.T) {
 
   pubBroker := NewBrokerPublisher("localhost:9092", "test", 0)
@@ -275,3 +415,3571 @@ func TestConsumeRequestEncoding(t *testing.T) {
     t.Fail()
   }
 }
+
+func TestRequestRoundTrip(t *testing.T) {
+  fetch := FetchRequest{Topic: "test", Partition: 3, Offset: 1234, MaxSize: 1048576}
+  decoded, err := DecodeConsumeRequest(fetch.Encode())
+  if err != nil || decoded != fetch {
+    t.Fatalf("expected %+v but got: %+v, %v", fetch, decoded, err)
+  }
+
+  offsets := OffsetRequest{Topic: "test", Partition: 1, Time: -2, MaxNumOffsets: 5}
+  decodedOffsets, err := DecodeOffsetRequest(offsets.Encode())
+  if err != nil || decodedOffsets != offsets {
+    t.Fatalf("expected %+v but got: %+v, %v", offsets, decodedOffsets, err)
+  }
+
+  if _, err := DecodeOffsetRequest(fetch.Encode()); !errors.Is(err, ErrMalformedRequest) {
+    t.Fatalf("expected ErrMalformedRequest for a fetch request but got: %v", err)
+  }
+  request := fetch.Encode()
+  if _, err := DecodeConsumeRequest(request[:len(request)-1]); !errors.Is(err, ErrMalformedRequest) {
+    t.Fatalf("expected ErrMalformedRequest for a truncated request but got: %v", err)
+  }
+}
+
+func TestDebugRequests(t *testing.T) {
+  sent := make(chan []byte, 2)
+  address := serve(t, func(conn net.Conn) {
+    answerRequests(conn, func(request []byte) []byte {
+      sent <- append(uint32bytes(len(request)), request...)
+      return uint32bytes(0)
+    })
+  })
+  consumer := NewBrokerConsumer(address, "test", 3, 1234, 1048576)
+  defer consumer.Close()
+
+  // nothing is sent until the consumer itself sends it
+  request := consumer.DebugConsumeRequest()
+  if fetch, err := DecodeConsumeRequest(request); err != nil || fetch.Offset != 1234 || fetch.MaxSize != 1048576 || fetch.Partition != 3 {
+    t.Fatalf("expected the fetch at the consumer's offset but got: %+v, %v", fetch, err)
+  }
+  offsetRequest := consumer.DebugOffsetRequest(-2, 5)
+  select {
+  case <-sent:
+    t.Fatalf("expected nothing to be sent")
+  default:
+  }
+
+  consumer.Consume(func(msg *Message) {})
+  if actual := <-sent; !bytes.Equal(actual, request) {
+    t.Fatalf("expected the fetch sent to be %x but got: %x", request, actual)
+  }
+  consumer.GetOffsets(-2, 5)
+  if actual := <-sent; !bytes.Equal(actual, offsetRequest) {
+    t.Fatalf("expected the offsets request sent to be %x but got: %x", offsetRequest, actual)
+  }
+}
+
+func TestOffsetWindowEviction(t *testing.T) {
+  window := newOffsetWindow(2)
+  if window.add(1) || window.add(2) {
+    t.Fatal("first sighting reported as duplicate")
+  }
+  if !window.add(2) {
+    t.Fatal("repeat not reported as duplicate")
+  }
+  // pushes 1 out of the window
+  window.add(3)
+  if window.add(1) {
+    t.Fatal("evicted offset reported as duplicate")
+  }
+}
+
+func TestFramingWrite(t *testing.T) {
+  msg := NewMessage([]byte("testing"))
+  expected := map[Framing][]byte{
+    FRAMING_NEWLINE: []byte("testing\n"),
+    FRAMING_NULL:    []byte("testing\x00"),
+    FRAMING_NONE:    []byte("testing"),
+  }
+  for framing, want := range expected {
+    buf := bytes.NewBuffer([]byte{})
+    framing.write(buf, msg)
+    if !bytes.Equal(want, buf.Bytes()) {
+      t.Fatalf("framing %d expected: % X but got: % X", framing, want, buf.Bytes())
+    }
+  }
+
+  // the default framing round trips through Decode
+  buf := bytes.NewBuffer([]byte{})
+  Framing(FRAMING_LENGTH_PREFIX).write(buf, msg)
+  _, msgsDecoded := DecodeWithDefaultCodecs(buf.Bytes())
+  if len(msgsDecoded) != 1 || !bytes.Equal(msgsDecoded[0].payload, msg.payload) {
+    t.Fatal("length prefixed frame did not round trip")
+  }
+}
+
+func TestLargestFrame(t *testing.T) {
+  small := NewMessage([]byte("small")).Encode()
+  large := NewMessage([]byte("a larger message")).Encode()
+  payload := append(append([]byte{}, small...), large...)
+  // a truncated trailing frame still reports its declared size
+  payload = append(payload, large[:6]...)
+
+  if largest := largestFrame(payload); largest != uint32(len(large)) {
+    t.Fatalf("expected largest frame: %d but got: %d", len(large), largest)
+  }
+  if largest := largestFrame([]byte{}); largest != 0 {
+    t.Fatalf("expected no frames but got: %d", largest)
+  }
+
+  // a length that overflows once the prefix is added, which used to loop forever
+  corrupt := append(append([]byte{}, small...), 0xFF, 0xFF, 0xFF, 0xFC, 0x01)
+  done := make(chan uint32, 1)
+  go func() { done <- largestFrame(corrupt) }()
+  select {
+  case largest := <-done:
+    if largest != math.MaxUint32 {
+      t.Fatalf("expected the largest frame to be capped but got: %d", largest)
+    }
+  case <-time.After(time.Second):
+    t.Fatal("largestFrame did not return")
+  }
+}
+
+func TestParseOffsetResponse(t *testing.T) {
+  offsets, err := ParseOffsetResponse([]byte{})
+  if err != nil || len(offsets) != 0 {
+    t.Fatalf("empty payload, expected no offsets but got: %v, %v", offsets, err)
+  }
+
+  offsets, err = ParseOffsetResponse([]byte{0x00, 0x00, 0x00, 0x00})
+  if err != nil || len(offsets) != 0 {
+    t.Fatalf("zero offsets, expected no offsets but got: %v, %v", offsets, err)
+  }
+
+  single := []byte{0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00}
+  offsets, err = ParseOffsetResponse(single)
+  if err != nil || len(offsets) != 1 || offsets[0] != 256 {
+    t.Fatalf("expected [256] but got: %v, %v", offsets, err)
+  }
+
+  many := []byte{0x00, 0x00, 0x00, 0x03}
+  for _, offset := range []uint64{300, 200, 100} {
+    many = append(many, uint64ToUint64bytes(offset)...)
+  }
+  offsets, err = ParseOffsetResponse(many)
+  if err != nil || len(offsets) != 3 || offsets[0] != 300 || offsets[1] != 200 || offsets[2] != 100 {
+    t.Fatalf("expected [300 200 100] but got: %v, %v", offsets, err)
+  }
+
+  // declares 3 offsets but is cut short in the last one
+  if _, err = ParseOffsetResponse(many[:len(many)-1]); err == nil {
+    t.Fatal("expected an error for a truncated response")
+  }
+  if _, err = ParseOffsetResponse([]byte{0x00, 0x00}); err == nil {
+    t.Fatal("expected an error for a response shorter than the offset count")
+  }
+
+  response, err := parseOffsetResponse(-1, many)
+  if err != nil || response.Time != -1 || response.Count != 3 || len(response.Offsets) != 3 {
+    t.Fatalf("expected 3 offsets for time -1 but got: %+v, %v", response, err)
+  }
+  if _, err = parseOffsetResponse(-1, append(many, 0x00)); err == nil {
+    t.Fatal("expected an error for trailing bytes after the offsets")
+  }
+}
+
+func TestGetOffsetsDetailed(t *testing.T) {
+  broker, err := NewFakeBroker()
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer broker.Close()
+  broker.SetOffsets(300, 200, 100)
+  consumer := NewConsumer("fake", "test", 0, WithDialer(broker.Dial), WithLogger(NopLogger))
+  defer consumer.Close()
+
+  response, err := consumer.GetOffsetsDetailed(-1, 2)
+  if err != nil || response.Time != -1 || response.Count != 2 || len(response.Offsets) != 2 || response.Offsets[1] != 200 {
+    t.Fatalf("expected 2 offsets for time -1 but got: %+v, %v", response, err)
+  }
+
+  // claims 3 offsets but carries 1, which must not be read past
+  short := append([]byte{0x00, 0x00, 0x00, 0x0e, 0x00, 0x00, 0x00, 0x00, 0x00, 0x03}, uint64ToUint64bytes(100)...)
+  broker.RespondWithFrame(short)
+  if response, err := consumer.GetOffsetsDetailed(-1, 3); err == nil {
+    t.Fatalf("expected an error for a response shorter than its count but got: %+v", response)
+  }
+  broker.RespondWithFrame(short)
+  if offsets, err := consumer.GetOffsets(-1, 3); err == nil {
+    t.Fatalf("expected GetOffsets to report it too but got: %v", offsets)
+  }
+}
+
+func TestKeyedMessageRoundTrip(t *testing.T) {
+  msg := NewKeyedMessage([]byte("key"), []byte("testing"))
+
+  // an ordinary magic 1 message, the key is framed inside its payload
+  expected := []byte{0x00, 0x00, 0x00, 0x18, 0x01, 0x00}
+  encoded := msg.Encode()
+  if !bytes.Equal(expected, encoded[:6]) {
+    t.Fatalf("expected header: % X but got: % X", expected, encoded[:6])
+  }
+
+  msgsDecoded, consumed, err := DecodeKeyed(encoded, DefaultCodecsMap)
+  if err != nil || consumed != len(encoded) || len(msgsDecoded) != 1 {
+    t.Fatalf("keyed message did not decode: %v", err)
+  }
+  if !bytes.Equal(msgsDecoded[0].Key(), []byte("key")) {
+    t.Fatalf("expected key: key but got: %s", msgsDecoded[0].Key())
+  }
+  if !bytes.Equal(msgsDecoded[0].Payload(), []byte("testing")) {
+    t.Fatalf("expected payload: testing but got: %s", msgsDecoded[0].Payload())
+  }
+  if !bytes.Equal(msgsDecoded[0].Encode(), encoded) {
+    t.Fatal("decoded keyed message did not encode back to the same bytes")
+  }
+
+  // without opting in, the framing is just part of the payload
+  _, plain := DecodeWithDefaultCodecs(encoded)
+  if len(plain) != 1 || plain[0].Key() != nil || !bytes.Equal(plain[0].Payload(), encoded[10:]) {
+    t.Fatalf("expected the framed payload as is but got: %v", plain)
+  }
+
+  // keyed messages inside a compressed set
+  compressed := NewCompressedMessages(msg, NewKeyedMessage(nil, []byte("two"))).Encode()
+  if msgsDecoded, _, err = DecodeKeyed(compressed, DefaultCodecsMap); err != nil || len(msgsDecoded) != 2 ||
+    string(msgsDecoded[0].Key()) != "key" || msgsDecoded[1].PayloadString() != "two" {
+    t.Fatalf("expected both keyed messages from the compressed set but got: %v, %v", msgsDecoded, err)
+  }
+
+  // and through a consumer that opted in
+  consumer := NewBrokerConsumer(serveLog(t, append(encoded, compressed...)), "test", 0, 0, 1048576)
+  defer consumer.Close()
+  consumer.KeyedPayloads = true
+  keys := []string{}
+  if num, err := consumer.Consume(func(msg *Message) { keys = append(keys, string(msg.Key())+"="+msg.PayloadString()) }); err != nil || num != 3 {
+    t.Fatalf("expected 3 keyed messages but got: %d, %v", num, err)
+  }
+  if strings.Join(keys, ",") != "key=testing,key=testing,=two" {
+    t.Fatalf("unexpected keys and payloads: %q", keys)
+  }
+}
+
+func TestKeyedMessageNullKey(t *testing.T) {
+  msg := NewKeyedMessage(nil, []byte("testing"))
+  encoded := msg.Encode()
+  // key length is -1
+  if !bytes.Equal([]byte{0xFF, 0xFF, 0xFF, 0xFF}, encoded[10:14]) {
+    t.Fatalf("expected null key length but got: % X", encoded[10:14])
+  }
+
+  msgsDecoded, _, err := DecodeKeyed(encoded, DefaultCodecsMap)
+  if err != nil || len(msgsDecoded) != 1 {
+    t.Fatalf("keyed message did not decode: %v", err)
+  }
+  if msgsDecoded[0].Key() != nil {
+    t.Fatalf("expected nil key but got: % X", msgsDecoded[0].Key())
+  }
+  if !bytes.Equal(msgsDecoded[0].Payload(), []byte("testing")) {
+    t.Fatalf("expected payload: testing but got: %s", msgsDecoded[0].Payload())
+  }
+
+  // an empty key is distinct from no key
+  msgsDecoded, _, _ = DecodeKeyed(NewKeyedMessage([]byte{}, []byte("testing")).Encode(), DefaultCodecsMap)
+  if len(msgsDecoded) != 1 || msgsDecoded[0].Key() == nil || len(msgsDecoded[0].Key()) != 0 {
+    t.Fatal("expected an empty, non nil key")
+  }
+}
+
+func TestEncodeMessageSetGolden(t *testing.T) {
+  msgs := []*Message{NewMessage([]byte("testing")), NewMessage([]byte("golden"))}
+
+  golden := []byte{
+    /* length ..........  magic comp  chksum ................  payload ... */
+    0x00, 0x00, 0x00, 0x0d, 0x01, 0x00, 0xe8, 0xf3, 0x5a, 0x06, 0x74, 0x65, 0x73, 0x74, 0x69, 0x6e, 0x67,
+    // crc32 of "golden" computed independently (python zlib.crc32)
+    0x00, 0x00, 0x00, 0x0c, 0x01, 0x00, 0x33, 0xff, 0x86, 0x27, 0x67, 0x6f, 0x6c, 0x64, 0x65, 0x6e}
+
+  if encoded := EncodeMessageSet(msgs); !bytes.Equal(golden, encoded) {
+    t.Fatalf("expected: % X\n but got: % X", golden, encoded)
+  }
+  if encoded := EncodeMessageSet(msgs); !bytes.Equal(golden, encoded) {
+    t.Fatal("encoding is not stable across calls")
+  }
+}
+
+func TestWALConsumerRecover(t *testing.T) {
+  path := t.TempDir() + "/wal"
+  consumer := NewBrokerConsumer("localhost:9092", "test", 0, 0, 1048576)
+  w, err := NewWALConsumer(consumer, path)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  // simulate a crash while handling the message at offset 100
+  inFlight := NewMessage([]byte("testing"))
+  inFlight.offset = 100
+  inFlight.nextOffset = 100 + uint64(len(inFlight.Encode()))
+  if err = w.append(inFlight); err != nil {
+    t.Fatal(err)
+  }
+  w.Close()
+
+  w, err = NewWALConsumer(consumer, path)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer w.Close()
+  var replayed *Message
+  num, err := w.Recover(func(msg *Message) { replayed = msg })
+  if err != nil || num != 1 {
+    t.Fatalf("expected 1 replayed message but got: %d, %v", num, err)
+  }
+  if replayed.Offset() != 100 || !bytes.Equal(replayed.Payload(), []byte("testing")) {
+    t.Fatalf("replayed the wrong message: %d % X", replayed.Offset(), replayed.Payload())
+  }
+  if consumer.offset != inFlight.nextOffset {
+    t.Fatalf("expected to resume at: %d but was: %d", inFlight.nextOffset, consumer.offset)
+  }
+
+  // the log is clear once recovered
+  if num, err = w.Recover(func(msg *Message) {}); err != nil || num != 0 {
+    t.Fatalf("expected an empty log but got: %d, %v", num, err)
+  }
+}
+
+func TestWALConsumerRecoverCompressedSet(t *testing.T) {
+  set := NewCompressedMessages(NewMessage([]byte("one")), NewMessage([]byte("two")), NewMessage([]byte("three")))
+  addr := serveLog(t, EncodeMessageSet([]*Message{set, NewMessage([]byte("four"))}))
+  path := t.TempDir() + "/wal"
+
+  // crash while handling "two"
+  w, err := NewWALConsumer(NewBrokerConsumer(addr, "test", 0, 0, 1048576), path)
+  if err != nil {
+    t.Fatal(err)
+  }
+  func() {
+    defer func() { recover() }()
+    w.Consume(func(msg *Message) {
+      if msg.PayloadString() == "two" {
+        panic("crash")
+      }
+    })
+  }()
+  w.Close()
+
+  // restart from the last committed position, the start of the set
+  w, err = NewWALConsumer(NewBrokerConsumer(addr, "test", 0, 0, 1048576), path)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer w.Close()
+  payloads := []string{}
+  num, err := w.Consume(func(msg *Message) { payloads = append(payloads, msg.PayloadString()) })
+  if err != nil || num != 3 {
+    t.Fatalf("expected 3 messages but got: %d, %v", num, err)
+  }
+  if strings.Join(payloads, ",") != "two,three,four" {
+    t.Fatalf("expected two to be replayed, then the rest but got: %q", payloads)
+  }
+}
+
+func TestDecodeMixedMagicMessageSet(t *testing.T) {
+  // hand-crafted: <LENGTH><MAGIC 0><CHECKSUM><PAYLOAD> and <LENGTH><MAGIC 1><COMPRESSION><CHECKSUM><PAYLOAD>
+  magic0 := func(payload string) []byte {
+    msg := append(uint32bytes(1+4+len(payload)), 0x00)
+    msg = append(msg, uint32toUint32bytes(crc32.ChecksumIEEE([]byte(payload)))...)
+    return append(msg, payload...)
+  }
+  magic1 := func(payload string) []byte {
+    msg := append(uint32bytes(1+1+4+len(payload)), 0x01, 0x00)
+    msg = append(msg, uint32toUint32bytes(crc32.ChecksumIEEE([]byte(payload)))...)
+    return append(msg, payload...)
+  }
+  packets := [][]byte{magic0("one"), magic1("two"), magic0("three"), magic1("four")}
+  log := bytes.Join(packets, nil)
+
+  consumer := NewBrokerConsumer(serveLog(t, log), "test", 0, 0, 1048576)
+  consumer.SetLogger(NopLogger)
+  received := make([]*Message, 0)
+  if _, err := consumer.Consume(func(msg *Message) { received = append(received, msg) }); err != nil {
+    t.Fatal(err)
+  }
+  if len(received) != len(packets) {
+    t.Fatalf("expected %d messages but got: %d", len(packets), len(received))
+  }
+  offset := uint64(0)
+  for i, payload := range []string{"one", "two", "three", "four"} {
+    msg := received[i]
+    if msg.PayloadString() != payload || msg.Offset() != offset {
+      t.Fatalf("expected %q at offset %d but got: %q at %d", payload, offset, msg.PayloadString(), msg.Offset())
+    }
+    if msg.magic != byte(i%2) {
+      t.Fatalf("expected magic %d for %q but got: %d", i%2, payload, msg.magic)
+    }
+    // each re-encodes to the bytes it was read from
+    if !bytes.Equal(msg.Encode(), packets[i]) {
+      t.Fatalf("expected % X re-encoded but got: % X", packets[i], msg.Encode())
+    }
+    offset += uint64(len(packets[i]))
+  }
+  if consumer.offset != uint64(len(log)) {
+    t.Fatalf("expected offset %d but got: %d", len(log), consumer.offset)
+  }
+}
+
+func TestRegisterCodec(t *testing.T) {
+  const REVERSE_ID = 9
+  // a made-up codec that stores the message set reversed, prefixed with a 'R'
+  reversed := func(data []byte) []byte {
+    out := []byte{'R'}
+    for i := len(data) - 1; i >= 0; i-- {
+      out = append(out, data[i])
+    }
+    return out
+  }
+  packet := func(body []byte) []byte {
+    msg := append(uint32bytes(1+1+4+len(body)), MAGIC_DEFAULT, REVERSE_ID)
+    msg = append(msg, uint32toUint32bytes(crc32.ChecksumIEEE(body))...)
+    return append(msg, body...)
+  }
+  messageSet := EncodeMessageSet([]*Message{NewMessage([]byte("one")), NewMessage([]byte("two"))})
+
+  if _, _, err := DecodeE(packet(reversed(messageSet)), DefaultCodecsMap); !errors.Is(err, ErrUnknownCodec) {
+    t.Fatalf("expected ErrUnknownCodec before registering but got: %v", err)
+  }
+
+  RegisterCodec(REVERSE_ID, func(data []byte) ([]byte, error) {
+    if len(data) == 0 || data[0] != 'R' {
+      return nil, errors.New("not reversed")
+    }
+    out := make([]byte, 0, len(data)-1)
+    for i := len(data) - 1; i > 0; i-- {
+      out = append(out, data[i])
+    }
+    return out, nil
+  })
+  defer delete(DefaultCodecsMap, REVERSE_ID)
+
+  msgs, _, err := DecodeE(packet(reversed(messageSet)), DefaultCodecsMap)
+  if err != nil || len(msgs) != 2 || msgs[0].PayloadString() != "one" || msgs[1].PayloadString() != "two" {
+    t.Fatalf("expected the message set decompressed but got: %v, %v", msgs, err)
+  }
+  // a decompression failure is reported, not turned into an empty payload
+  if _, _, err = DecodeE(packet(messageSet), DefaultCodecsMap); err == nil || !strings.Contains(err.Error(), "not reversed") {
+    t.Fatalf("expected the codec's error but got: %v", err)
+  }
+}
+
+func TestHeadersEmptyForHeaderlessFormats(t *testing.T) {
+  magic0 := []byte{0x00, 0x00, 0x00, 0x0c, 0x00, 0xe8, 0xf3, 0x5a, 0x06, 0x74, 0x65, 0x73, 0x74, 0x69, 0x6e, 0x67}
+  packets := [][]byte{magic0,
+    NewMessage([]byte("testing")).Encode(),
+    NewKeyedMessage([]byte("key"), []byte("testing")).Encode(),
+  }
+  for _, packet := range packets {
+    _, msgsDecoded := DecodeWithDefaultCodecs(packet)
+    if len(msgsDecoded) != 1 {
+      t.Fatalf("failed to decode: % X", packet)
+    }
+    if headers := msgsDecoded[0].Headers(); headers == nil || len(headers) != 0 {
+      t.Fatalf("expected empty headers for magic %d but got: %v", msgsDecoded[0].magic, headers)
+    }
+  }
+}
+
+func TestChecksumMismatch(t *testing.T) {
+  encoded := NewMessage([]byte("testing")).Encode()
+  encoded[len(encoded)-1] = 'G' // corrupt the payload
+
+  _, _, err := DecodeE(encoded, DefaultCodecsMap)
+  if !errors.Is(err, ErrChecksumMismatch) {
+    t.Fatalf("expected a checksum mismatch but got: %v", err)
+  }
+  var checksumErr *ChecksumError
+  if !errors.As(err, &checksumErr) {
+    t.Fatalf("expected a *ChecksumError but got: %T", err)
+  }
+  if checksumErr.Expected != 0xE8F35A06 || checksumErr.Actual != crc32.ChecksumIEEE([]byte("testinG")) {
+    t.Fatalf("unexpected checksums: %08X %08X", checksumErr.Expected, checksumErr.Actual)
+  }
+}
+
+func TestSkipCorrupted(t *testing.T) {
+  corrupt := NewMessage([]byte("testing")).Encode()
+  corrupt[len(corrupt)-1] = 'G'
+  log := append(append(NewMessage([]byte("one")).Encode(), corrupt...), NewMessage([]byte("two")).Encode()...)
+
+  consumer := NewBrokerConsumer(serveLog(t, log), "test", 0, 0, 1048576)
+  consumer.SetLogger(NopLogger)
+  defer consumer.Close()
+  if _, err := consumer.Consume(func(msg *Message) {}); !errors.Is(err, ErrChecksumMismatch) {
+    t.Fatalf("expected to fail on the corrupt message by default but got: %v", err)
+  }
+
+  consumer.SkipCorrupted = true
+  payloads := []string{}
+  num, err := consumer.Consume(func(msg *Message) { payloads = append(payloads, msg.PayloadString()) })
+  if err != nil || num != 1 || payloads[0] != "two" {
+    t.Fatalf("expected to skip to the message after the corrupt one but got: %d, %v, %v", num, payloads, err)
+  }
+  if consumer.Offset() != uint64(len(log)) || consumer.Stats().Corrupted != 1 {
+    t.Fatalf("unexpected offset: %d or corrupted count: %d", consumer.Offset(), consumer.Stats().Corrupted)
+  }
+}
+
+func TestCorruptGzipPayload(t *testing.T) {
+  // a valid checksum over a gzip stream cut short
+  zipped := new(GzipPayloadCodec).Encode(EncodeMessageSet([]*Message{NewMessage([]byte("testing"))}))
+  corrupt := (&Message{magic: MAGIC_DEFAULT, compression: GZIP_COMPRESSION_ID, payload: zipped[:len(zipped)/2]}).withChecksum(nil)
+  if msgs, _, err := DecodeE(corrupt.Encode(), DefaultCodecsMap); err == nil {
+    t.Fatalf("expected the corruption to be reported but got: %d messages", len(msgs))
+  }
+
+  log := append(corrupt.Encode(), NewMessage([]byte("two")).Encode()...)
+  consumer := NewBrokerConsumer(serveLog(t, log), "test", 0, 0, 1048576)
+  consumer.SetLogger(NopLogger)
+  defer consumer.Close()
+  if _, err := consumer.Consume(func(msg *Message) {}); err == nil || consumer.Offset() != 0 {
+    t.Fatalf("expected to fail on the corrupt message but got: %v at offset %d", err, consumer.Offset())
+  }
+  consumer.SkipCorrupted = true
+  if num, err := consumer.Consume(func(msg *Message) {}); err != nil || num != 1 || consumer.Stats().Corrupted != 1 {
+    t.Fatalf("expected to skip the corrupt message but got: %d, %v, %+v", num, err, consumer.Stats())
+  }
+}
+
+func TestZeroCopy(t *testing.T) {
+  first := NewMessage([]byte("one")).Encode()
+  log := append(append([]byte{}, first...), NewMessage([]byte("two")).Encode()...)
+  consumer := NewBrokerConsumer(serveLog(t, log), "test", 0, 0, uint32(len(first)))
+  consumer.ZeroCopy = true
+  defer consumer.Close()
+
+  var ref, copied []byte
+  if _, err := consumer.Consume(func(msg *Message) { ref, copied = msg.PayloadRef(), msg.Payload() }); err != nil {
+    t.Fatal(err)
+  }
+  if _, err := consumer.Consume(func(msg *Message) {}); err != nil {
+    t.Fatal(err)
+  }
+  // the second fetch was read into the first one's buffer
+  if string(ref) != "two" || string(copied) != "one" {
+    t.Fatalf("expected the reference to be overwritten but not the copy, got: %s, %s", ref, copied)
+  }
+}
+
+func BenchmarkConsume(b *testing.B) {
+  msgs := make([]*Message, 1000)
+  for i := range msgs {
+    msgs[i] = NewMessage(bytes.Repeat([]byte("testing"), 100))
+  }
+  log := EncodeMessageSet(msgs)
+  for _, zeroCopy := range []bool{false, true} {
+    b.Run(fmt.Sprintf("ZeroCopy=%v", zeroCopy), func(b *testing.B) {
+      addr := serve(b, func(conn net.Conn) {
+        answerRequests(conn, func(request []byte) []byte { return log })
+      })
+      consumer := NewBrokerConsumer(addr, "test", 0, 0, uint32(len(log)))
+      consumer.ZeroCopy = zeroCopy
+      defer consumer.Close()
+      b.ReportAllocs()
+      b.SetBytes(int64(len(log)))
+      b.ResetTimer()
+      for i := 0; i < b.N; i++ {
+        consumer.Seek(0)
+        if _, err := consumer.Consume(func(msg *Message) { _ = msg.PayloadRef() }); err != nil {
+          b.Fatal(err)
+        }
+      }
+    })
+  }
+}
+
+// An OffsetStore calling commit with each committed offset
+type commitFunc func(offset uint64) error
+
+func (commit commitFunc) Load(topic string, partition int) (uint64, error) {
+  return 0, nil
+}
+
+func (commit commitFunc) Commit(topic string, partition int, offset uint64) error {
+  return commit(offset)
+}
+
+func TestConsumeConcurrent(t *testing.T) {
+  msgs := make([]*Message, 50)
+  for i := range msgs {
+    msgs[i] = NewMessage([]byte(fmt.Sprintf("message %d", i)))
+  }
+  log := EncodeMessageSet(msgs)
+  consumer := NewBrokerConsumer(serveLog(t, log), "test", 0, 0, 1048576)
+  defer consumer.Close()
+
+  var lock sync.Mutex
+  handled := map[uint64]bool{}
+  consumer.OffsetStore = commitFunc(func(offset uint64) error {
+    lock.Lock()
+    defer lock.Unlock()
+    for _, msg := range msgs {
+      if msg.nextOffset <= offset && !handled[msg.offset] {
+        t.Errorf("committed %d before handling the message at %d", offset, msg.offset)
+      }
+    }
+    return nil
+  })
+  // offsets as they'll be decoded, for the check above
+  for i, offset := 0, uint64(0); i < len(msgs); i++ {
+    msgs[i].offset, msgs[i].nextOffset = offset, offset+uint64(msgs[i].Size())
+    offset = msgs[i].nextOffset
+  }
+
+  num, err := consumer.ConsumeConcurrent(8, func(msg *Message) {
+    time.Sleep(time.Duration(msg.offset%3) * time.Millisecond) // finish out of order
+    lock.Lock()
+    handled[msg.offset] = true
+    lock.Unlock()
+  })
+  if err != nil || num != len(msgs) || len(handled) != len(msgs) {
+    t.Fatalf("expected %d messages handled but got: %d (%d), %v", len(msgs), num, len(handled), err)
+  }
+  if consumer.Offset() != uint64(len(log)) {
+    t.Fatalf("expected offset: %d but got: %d", len(log), consumer.Offset())
+  }
+  if _, err := consumer.ConsumeConcurrent(8, func(msg *Message) {}); err != ErrNoMessages {
+    t.Fatalf("expected ErrNoMessages once caught up but got: %v", err)
+  }
+}
+
+func TestMaxMessagesPerFetch(t *testing.T) {
+  msgs := []*Message{NewMessage([]byte("one")), NewMessage([]byte("two")), NewMessage([]byte("three"))}
+  log := EncodeMessageSet(msgs)
+  consumer := NewBrokerConsumer(serveLog(t, log), "test", 0, 0, 1048576)
+  defer consumer.Close()
+  consumer.MaxMessagesPerFetch = 2
+
+  // one fetch response holds all three, split across two polls
+  payloads := []string{}
+  handler := func(msg *Message) { payloads = append(payloads, msg.PayloadString()) }
+  if num, err := consumer.Consume(handler); err != nil || num != 2 {
+    t.Fatalf("expected 2 messages but got: %d, %v", num, err)
+  }
+  if expected := uint64(msgs[0].Size() + msgs[1].Size()); consumer.Offset() != expected {
+    t.Fatalf("expected offset: %d, just after the second message, but got: %d", expected, consumer.Offset())
+  }
+  if num, err := consumer.Consume(handler); err != nil || num != 1 {
+    t.Fatalf("expected the last message but got: %d, %v", num, err)
+  }
+  if strings.Join(payloads, ",") != "one,two,three" || consumer.Offset() != uint64(len(log)) {
+    t.Fatalf("unexpected payloads: %v or offset: %d", payloads, consumer.Offset())
+  }
+
+  consumer.Seek(0)
+  if num, err := consumer.ConsumeConcurrent(4, func(msg *Message) {}); err != nil || num != 2 || consumer.Offset() != uint64(msgs[0].Size()+msgs[1].Size()) {
+    t.Fatalf("expected ConsumeConcurrent to stop after 2 messages but got: %d, %v at %d", num, err, consumer.Offset())
+  }
+}
+
+func TestCommitIntervalFlushesOnClose(t *testing.T) {
+  msgs := make([]*Message, 1050)
+  for i := range msgs {
+    msgs[i] = NewMessage([]byte("testing"))
+  }
+  log := EncodeMessageSet(msgs)
+  commits := []uint64{}
+  store := commitFunc(func(offset uint64) error {
+    commits = append(commits, offset)
+    return nil
+  })
+
+  consumer := NewConsumer(serveLog(t, log), "test", 0, WithMaxSize(uint32(len(log))), WithOffsetStore(store, 100))
+  if num, err := consumer.Consume(func(msg *Message) {}); err != nil || num != len(msgs) {
+    t.Fatalf("expected %d messages but got: %d, %v", len(msgs), num, err)
+  }
+  if len(commits) != 10 || commits[9] != uint64(1000*msgs[0].Size()) {
+    t.Fatalf("expected a commit every 100 messages but got: %v", commits)
+  }
+  consumer.Close()
+  if len(commits) != 11 || commits[10] != uint64(len(log)) {
+    t.Fatalf("expected Close to commit the final position: %d but got: %v", len(log), commits)
+  }
+  consumer.Close()
+  if len(commits) != 11 {
+    t.Fatalf("expected nothing left to commit but got: %v", commits)
+  }
+
+  commits = commits[:0]
+  consumer = NewConsumer(serveLog(t, log), "test", 0, WithMaxSize(uint32(len(log))), WithOffsetStore(store, 0), WithCommitEvery(time.Hour))
+  consumer.Consume(func(msg *Message) {})
+  if len(commits) != 0 {
+    t.Fatalf("expected no commits within CommitEvery but got: %v", commits)
+  }
+  if err := consumer.FlushOffset(); err != nil || len(commits) != 1 || commits[0] != uint64(len(log)) {
+    t.Fatalf("expected FlushOffset to commit the final position but got: %v, %v", commits, err)
+  }
+  consumer.Close()
+}
+
+// Consumers that fetch once and close, the pool hands ZeroCopy's buffer from one to the next
+func BenchmarkShortLivedConsumers(b *testing.B) {
+  msgs := make([]*Message, 1000)
+  for i := range msgs {
+    msgs[i] = NewMessage(bytes.Repeat([]byte("testing"), 100))
+  }
+  log := EncodeMessageSet(msgs)
+  addr := serve(b, func(conn net.Conn) {
+    answerRequests(conn, func(request []byte) []byte { return log })
+  })
+  for _, zeroCopy := range []bool{false, true} {
+    b.Run(fmt.Sprintf("ZeroCopy=%v", zeroCopy), func(b *testing.B) {
+      b.ReportAllocs()
+      b.SetBytes(int64(len(log)))
+      for i := 0; i < b.N; i++ {
+        consumer := NewBrokerConsumer(addr, "test", 0, 0, uint32(len(log)))
+        consumer.ZeroCopy = zeroCopy
+        if _, err := consumer.Consume(func(msg *Message) { _ = msg.PayloadRef() }); err != nil {
+          b.Fatal(err)
+        }
+        consumer.Close()
+      }
+    })
+  }
+}
+
+func TestZeroCopyBufferPool(t *testing.T) {
+  log := NewMessage([]byte("testing")).Encode()
+  consumer := NewBrokerConsumer(serveLog(t, log), "test", 0, 0, 1048576)
+  consumer.ZeroCopy = true
+  // closing from the handler, the buffer is only given back once the fetch is handled
+  var ref []byte
+  consumer.Consume(func(msg *Message) {
+    consumer.Close()
+    if consumer.fetchBuf == nil || string(msg.PayloadRef()) != "testing" {
+      t.Fatal("expected the buffer to be held until the fetch is handled")
+    }
+    ref = msg.PayloadRef()
+  })
+  if consumer.fetchBuf != nil || len(ref) == 0 {
+    t.Fatal("expected the buffer back in the pool after the fetch")
+  }
+}
+
+func TestDecodeEErrors(t *testing.T) {
+  encoded := NewMessage([]byte("testing")).Encode()
+  msgs, consumed, err := DecodeE(append(append([]byte{}, encoded...), encoded...), DefaultCodecsMap)
+  if err != nil || len(msgs) != 1 || consumed != len(encoded) {
+    t.Fatalf("expected 1 message taking %d bytes but got: %d, %d, %v", len(encoded), len(msgs), consumed, err)
+  }
+
+  if _, consumed, err = DecodeE(encoded[:len(encoded)-1], DefaultCodecsMap); !errors.Is(err, ErrTruncatedMessage) || consumed != 0 {
+    t.Fatalf("expected a truncated message but got: %d, %v", consumed, err)
+  }
+  // a length too short for the header
+  if _, _, err = DecodeE([]byte{0x00, 0x00, 0x00, 0x01, 0x01}, DefaultCodecsMap); !errors.Is(err, ErrTruncatedMessage) {
+    t.Fatalf("expected a truncated message but got: %v", err)
+  }
+  badMagic := append([]byte{}, encoded...)
+  badMagic[4] = 9
+  if _, _, err = DecodeE(badMagic, DefaultCodecsMap); !errors.Is(err, ErrInvalidMagic) {
+    t.Fatalf("expected an invalid magic but got: %v", err)
+  }
+}
+
+func TestMultiFetchRequestEncoding(t *testing.T) {
+  request := EncodeMultiFetchRequest([]FetchRequest{
+    {Topic: "test", Partition: 0, Offset: 0, MaxSize: 1048576},
+    {Topic: "ab", Partition: 1, Offset: 16, MaxSize: 256},
+  })
+
+  expected := []byte{0x00, 0x00, 0x00, 0x2E, 0x00, 0x02, 0x00, 0x02,
+    0x00, 0x04, 0x74, 0x65, 0x73, 0x74, 0x00, 0x00, 0x00, 0x00,
+    0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x10, 0x00, 0x00,
+    0x00, 0x02, 0x61, 0x62, 0x00, 0x00, 0x00, 0x01,
+    0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x10, 0x00, 0x00, 0x01, 0x00}
+
+  if !bytes.Equal(expected, request) {
+    t.Errorf("expected: % X\n but got: % X", expected, request)
+  }
+}
+
+func TestMultiConsumer(t *testing.T) {
+  // <RESPONSE SIZE: uint32><ERROR CODE: uint16><MESSAGE SET> for one fetch
+  subResponse := func(code int16, messageSet []byte) []byte {
+    return append(append(uint32bytes(2+len(messageSet)), byte(code>>8), byte(code)), messageSet...)
+  }
+  first := EncodeMessageSet([]*Message{NewMessage([]byte("one")), NewMessage([]byte("two"))})
+  second := EncodeMessageSet([]*Message{NewMessage([]byte("three"))})
+  withError := append(append(subResponse(0, first), subResponse(1, nil)...), subResponse(0, second)...)
+  // the second fetch's response declares more than there is, leaving nothing for the third
+  truncated := append(subResponse(0, second), subResponse(0, first)[:8]...)
+  address := serveFetches(t, []byte{}, withError, truncated)
+
+  consumer := NewMultiConsumer(address, []FetchRequest{
+    {Topic: "a", Partition: 0, MaxSize: 1048576},
+    {Topic: "b", Partition: 1, MaxSize: 1048576},
+    {Topic: "c", Partition: 2, MaxSize: 1048576},
+  })
+  defer consumer.Close()
+  consumer.broker.setLogger(NopLogger)
+  var delivered []string
+  handler := func(topic string, partition int, msg *Message) {
+    delivered = append(delivered, fmt.Sprintf("%s:%d:%s", topic, partition, msg.PayloadString()))
+  }
+
+  // an empty response carries no fetches at all
+  if _, err := consumer.Consume(handler); err == nil {
+    t.Fatalf("expected an error for a response without the fetches")
+  }
+
+  // an error code fails its fetch only
+  num, err := consumer.Consume(handler)
+  var errs FetchErrors
+  if !errors.As(err, &errs) || len(errs) != 1 || !errors.Is(errs[TopicPartition{"b", 1}], ErrOffsetOutOfRange) || num != 3 {
+    t.Fatalf("expected the error for b:1 only after 3 messages but got: %d, %v", num, err)
+  }
+  if strings.Join(delivered, ",") != "a:0:one,a:0:two,c:2:three" {
+    t.Fatalf("unexpected deliveries: %v", delivered)
+  }
+  fetches := consumer.Fetches()
+  if fetches[0].Offset != uint64(len(first)) || fetches[1].Offset != 0 || fetches[2].Offset != uint64(len(second)) {
+    t.Fatalf("expected the offsets of the delivered partitions to advance but got: %+v", fetches)
+  }
+
+  // so does a truncated sub-response, after the fetches before it
+  delivered = nil
+  num, err = consumer.Consume(handler)
+  if !errors.As(err, &errs) || len(errs) != 2 || errs[TopicPartition{"b", 1}] == nil || errs[TopicPartition{"c", 2}] == nil || num != 1 {
+    t.Fatalf("expected errors for b:1 and c:2 after 1 message but got: %d, %v", num, err)
+  }
+  fetches = consumer.Fetches()
+  if delivered[0] != "a:0:three" || fetches[0].Offset != uint64(len(first)+len(second)) || fetches[2].Offset != uint64(len(second)) {
+    t.Fatalf("expected a:0 to advance and c:2 to stay but got: %v, %+v", delivered, fetches)
+  }
+}
+
+func TestDecodeMessageSetPartialTail(t *testing.T) {
+  first := NewMessage([]byte("testing")).Encode()
+  second := NewMessage([]byte("partial")).Encode()
+  payload := append(append([]byte{}, first...), second[:len(second)-1]...)
+
+  msgs, consumed, err := decodeMessageSet(payload, 100, DefaultCodecsMap, messageFormat{})
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(msgs) != 1 || msgs[0].Offset() != 100 || !bytes.Equal(msgs[0].Payload(), []byte("testing")) {
+    t.Fatalf("expected only the complete message but got: %d", len(msgs))
+  }
+  if consumed != uint64(len(first)) {
+    t.Fatalf("expected to consume: %d but consumed: %d", len(first), consumed)
+  }
+}
+
+func TestCompressedMessageSetOffsets(t *testing.T) {
+  plain := NewMessage([]byte("plain")).Encode()
+  compressed := NewCompressedMessages(NewMessage([]byte("one")), NewMessage([]byte("two"))).Encode()
+  payload := append(append([]byte{}, plain...), compressed...)
+
+  msgs, _, err := decodeMessageSet(payload, 1000, DefaultCodecsMap, messageFormat{})
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(msgs) != 3 {
+    t.Fatalf("expected 3 messages but got: %d", len(msgs))
+  }
+  wrapperOffset := uint64(1000 + len(plain))
+  for i, expected := range []string{"one", "two"} {
+    msg := msgs[i+1]
+    if msg.PayloadString() != expected {
+      t.Fatalf("expected payload: %s but got: %s", expected, msg.PayloadString())
+    }
+    // nested messages report the offset of their compressed wrapper
+    if msg.Offset() != wrapperOffset {
+      t.Fatalf("expected offset: %d but got: %d", wrapperOffset, msg.Offset())
+    }
+  }
+}
+
+func TestBrokerConnectionPool(t *testing.T) {
+  listener, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer listener.Close()
+  go func() {
+    for {
+      conn, err := listener.Accept()
+      if err != nil {
+        return
+      }
+      defer conn.Close()
+    }
+  }()
+
+  broker := newBroker(listener.Addr().String(), "test", 0)
+  first, err := broker.connect()
+  if err != nil {
+    t.Fatal(err)
+  }
+  broker.release(first, nil)
+  reused, _ := broker.connect()
+  if reused != first {
+    t.Fatal("expected the idle connection to be reused")
+  }
+
+  // a connection that saw an error is discarded
+  broker.release(reused, errors.New("broken"))
+  fresh, _ := broker.connect()
+  if fresh == first {
+    t.Fatal("expected a failed connection not to be reused")
+  }
+
+  broker.release(fresh, nil)
+  broker.Close()
+  if len(broker.idle) != 0 {
+    t.Fatal("expected Close to drain the pool")
+  }
+}
+
+type recordingLogger struct {
+  lines []string
+}
+
+func (l *recordingLogger) Printf(format string, args ...interface{}) {
+  l.lines = append(l.lines, format)
+}
+
+func TestSetLogger(t *testing.T) {
+  logger := &recordingLogger{}
+  // no port, so resolving the address fails without touching the network
+  consumer := NewBrokerConsumer("localhost", "test", 0, 0, 1024)
+  consumer.SetLogger(logger)
+  if _, err := consumer.Consume(func(msg *Message) {}); err == nil {
+    t.Fatal("expected an error connecting without a port")
+  }
+  if len(logger.lines) == 0 {
+    t.Fatal("expected the failure to be logged through the injected logger")
+  }
+
+  consumer.SetLogger(nil)
+  if consumer.broker.logger != DefaultLogger {
+    t.Fatal("expected nil to restore the default logger")
+  }
+}
+
+func TestIdleHeartbeat(t *testing.T) {
+  address := serveFetches(t)
+  heartbeats := func(interval time.Duration) int {
+    logger := &recordingLogger{}
+    consumer := NewBrokerConsumer(address, "test", 0, 0, 1048576)
+    defer consumer.Close()
+    consumer.SetLogger(logger)
+    consumer.IdleHeartbeat = interval
+    quit := make(chan os.Signal, 1)
+    start := time.Now()
+    consumer.OnPoll = func(fetched int, offset uint64, err error) {
+      if time.Since(start) > 100*time.Millisecond {
+        select {
+        case quit <- os.Interrupt:
+        default:
+        }
+      }
+    }
+    consumer.ConsumeUntilQuit(5, quit, func(msg *Message) {})
+    count := 0
+    for _, line := range logger.lines {
+      if strings.Contains(line, "still alive") {
+        count++
+      }
+    }
+    return count
+  }
+  // logged every 30ms of idling, the poll interval doesn't matter
+  if n := heartbeats(30 * time.Millisecond); n < 2 || n > 4 {
+    t.Fatalf("expected a heartbeat about every 30ms over 100ms but got: %d", n)
+  }
+  if n := heartbeats(0); n != 0 {
+    t.Fatalf("expected no heartbeats when unset but got: %d", n)
+  }
+}
+
+// An OffsetStore with nothing committed that wraps ErrNoCommittedOffset, as a store adding context does
+type wrappingStore struct{}
+
+func (wrappingStore) Load(topic string, partition int) (uint64, error) {
+  return 0, fmt.Errorf("loading %s/%d: %w", topic, partition, ErrNoCommittedOffset)
+}
+
+func (wrappingStore) Commit(topic string, partition int, offset uint64) error {
+  return nil
+}
+
+func TestWrappedNoCommittedOffset(t *testing.T) {
+  log := EncodeMessageSet([]*Message{NewMessage([]byte("one"))})
+  consumer := NewBrokerConsumer(serveLog(t, log), "test", 0, 0, 1048576)
+  defer consumer.Close()
+  consumer.OffsetStore = wrappingStore{}
+  if num, err := consumer.Consume(func(msg *Message) {}); err != nil || num != 1 {
+    t.Fatalf("expected to start from the consumer's offset but got: %d, %v", num, err)
+  }
+}
+
+func TestFileOffsetStore(t *testing.T) {
+  store := NewFileOffsetStore(t.TempDir())
+  if _, err := store.Load("test", 0); err != ErrNoCommittedOffset {
+    t.Fatalf("expected ErrNoCommittedOffset but got: %v", err)
+  }
+  if err := store.Commit("test", 0, 1234); err != nil {
+    t.Fatal(err)
+  }
+  if offset, err := store.Load("test", 0); err != nil || offset != 1234 {
+    t.Fatalf("expected offset 1234 but got: %d, %v", offset, err)
+  }
+
+  // a committed offset overrides the constructor's, an explicit Seek overrides both
+  consumer := NewBrokerConsumer("localhost:9092", "test", 0, 0, 1048576)
+  consumer.OffsetStore = store
+  if err := consumer.loadStoredOffset(); err != nil || consumer.offset != 1234 {
+    t.Fatalf("expected to resume from 1234 but got: %d, %v", consumer.offset, err)
+  }
+  consumer = NewBrokerConsumer("localhost:9092", "test", 0, 0, 1048576)
+  consumer.OffsetStore = store
+  consumer.Seek(99)
+  if err := consumer.loadStoredOffset(); err != nil || consumer.offset != 99 {
+    t.Fatalf("expected Seek to win but got: %d, %v", consumer.offset, err)
+  }
+}
+
+// Serves each fetch request on a local listener with the next of responses (message sets), then with
+// empty ones. Returns the address to connect to.
+func serveFetches(t *testing.T, responses ...[]byte) string {
+  return serve(t, func(conn net.Conn) { answerFetches(conn, &responses) })
+}
+
+// Serves fetch requests on a local listener from log, a message set starting at offset 0, returning
+// what's at the requested offset cut at the requested maxSize as a broker does. Returns the address to connect to.
+func serveLog(t *testing.T, log []byte) string {
+  return serve(t, func(conn net.Conn) {
+    answerRequests(conn, func(request []byte) []byte {
+      offset := binary.BigEndian.Uint64(request[len(request)-12:])
+      maxSize := uint64(binary.BigEndian.Uint32(request[len(request)-4:]))
+      if offset >= uint64(len(log)) {
+        return []byte{}
+      }
+      end := offset + maxSize
+      if end > uint64(len(log)) {
+        end = uint64(len(log))
+      }
+      return log[offset:end]
+    })
+  })
+}
+
+func serve(t testing.TB, handle func(conn net.Conn)) string {
+  listener, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatal(err)
+  }
+  t.Cleanup(func() { listener.Close() })
+  go func() {
+    for {
+      conn, err := listener.Accept()
+      if err != nil {
+        return
+      }
+      go handle(conn)
+    }
+  }()
+  return listener.Addr().String()
+}
+
+// Answers each request read from conn with the next of responses, or an empty message set once they run out
+func answerFetches(conn net.Conn, responses *[][]byte) {
+  answerRequests(conn, func(request []byte) []byte {
+    var messageSet []byte
+    if len(*responses) > 0 {
+      messageSet, *responses = (*responses)[0], (*responses)[1:]
+    }
+    return messageSet
+  })
+}
+
+// Answers each request read from conn (without its size) with respond's message set, until conn is closed
+func answerRequests(conn net.Conn, respond func(request []byte) []byte) {
+  defer conn.Close()
+  size := make([]byte, 4)
+  for {
+    if _, err := io.ReadFull(conn, size); err != nil {
+      return
+    }
+    request := make([]byte, binary.BigEndian.Uint32(size))
+    if _, err := io.ReadFull(conn, request); err != nil {
+      return
+    }
+    messageSet := respond(request)
+    response := append(uint32bytes(2+len(messageSet)), 0, 0)
+    if _, err := conn.Write(append(response, messageSet...)); err != nil {
+      return
+    }
+  }
+}
+
+// Serves a single partition log on a local listener as a broker does: produce requests append to it
+// (unanswered), offsets requests give the latest (-1) or earliest (-2) offset, and fetches read from it.
+// Returns the address to connect to.
+func serveBroker(t *testing.T) string {
+  broker, err := NewFakeBroker()
+  if err != nil {
+    t.Fatal(err)
+  }
+  t.Cleanup(func() { broker.Close() })
+  return broker.Addr()
+}
+
+func TestConsumeOnChannelDrainsOnQuit(t *testing.T) {
+  msgs := make([]*Message, 500)
+  for i := range msgs {
+    msgs[i] = NewMessage([]byte("testing"))
+  }
+  consumer := NewBrokerConsumer(serveFetches(t, EncodeMessageSet(msgs)), "test", 0, 0, 1048576)
+  consumer.SetLogger(NopLogger)
+
+  msgChan := make(chan *Message)
+  quit := make(chan bool)
+  result := make(chan int, 1)
+  go func() {
+    num, _ := consumer.ConsumeOnChannelE(msgChan, 10, quit)
+    result <- num
+  }()
+
+  // quit as soon as the batch starts arriving, with the rest of it still to be sent
+  <-msgChan
+  quit <- true
+  time.Sleep(50 * time.Millisecond) // give shutdown the chance to race with the pending sends
+  received := 1
+  for range msgChan {
+    received++
+  }
+  if received != len(msgs) {
+    t.Fatalf("expected all %d decoded messages to be delivered but got: %d", len(msgs), received)
+  }
+  if num := <-result; num != received {
+    t.Fatalf("expected a count of %d but got: %d", received, num)
+  }
+}
+
+func TestConsumeOnChannelWithResultCommitsDelivered(t *testing.T) {
+  msgs := make([]*Message, 50)
+  for i := range msgs {
+    msgs[i] = NewMessage([]byte(fmt.Sprintf("message %d", i)))
+  }
+  store := NewFileOffsetStore(t.TempDir())
+  consumer := NewConsumer(serveLog(t, EncodeMessageSet(msgs)), "test", 0, WithMaxSize(1048576),
+    WithLogger(NopLogger), WithOffsetStore(store, 1))
+
+  msgChan := make(chan *Message)
+  quit := make(chan bool)
+  done := make(chan ChannelConsumeResult, 1)
+  go func() {
+    result, err := consumer.ConsumeOnChannelWithResult(msgChan, 10, quit)
+    if err != nil {
+      t.Errorf("unexpected error: %v", err)
+    }
+    done <- result
+  }()
+
+  // take one message, then quit with the next one waiting to be sent
+  delivered := <-msgChan
+  close(quit)
+  result := <-done
+  consumer.Close()
+  if _, ok := <-msgChan; ok {
+    t.Fatal("expected msgChan to be closed")
+  }
+
+  if result.Delivered != 1 || result.Dropped != 1 || result.LastOffset != delivered.Offset() {
+    t.Fatalf("unexpected result: %+v", result)
+  }
+  resume := delivered.Offset() + uint64(delivered.Size())
+  committed, err := store.Load("test", 0)
+  if err != nil || committed > resume {
+    t.Fatalf("expected at most offset %d committed but got: %d, %v", resume, committed, err)
+  }
+  if consumer.Offset() != resume || consumer.Stats().Consumed != 1 {
+    t.Fatalf("expected to resume at %d with 1 consumed but got: %d, %+v", resume, consumer.Offset(), consumer.Stats())
+  }
+}
+
+func TestConsumeOverInjectedConn(t *testing.T) {
+  responses := [][]byte{EncodeMessageSet([]*Message{NewMessage([]byte("testing")), NewMessage([]byte("piped"))})}
+  var dialed string
+  consumer := NewBrokerConsumer("broker:9092", "test", 0, 0, 1048576)
+  consumer.SetDialer(func(network, addr string) (net.Conn, error) {
+    dialed = addr
+    client, server := net.Pipe()
+    go answerFetches(server, &responses)
+    return client, nil
+  })
+  defer consumer.Close()
+
+  var payloads []string
+  num, err := consumer.Consume(func(msg *Message) { payloads = append(payloads, msg.PayloadString()) })
+  if err != nil || num != 2 {
+    t.Fatalf("expected 2 messages but got: %d, %v", num, err)
+  }
+  if dialed != "broker:9092" || payloads[0] != "testing" || payloads[1] != "piped" {
+    t.Fatalf("unexpected dial of %s delivering: %v", dialed, payloads)
+  }
+}
+
+func TestConsumeLeavesPartialMessage(t *testing.T) {
+  first := NewMessage([]byte("testing")).Encode()
+  second := NewMessage([]byte("partial")).Encode()
+  payload := append(append([]byte{}, first...), second[:len(second)-1]...)
+  consumer := NewBrokerConsumer(serveFetches(t, payload), "test", 0, 0, 1048576)
+  defer consumer.Close()
+
+  num, err := consumer.Consume(func(msg *Message) {})
+  if err != nil || num != 1 {
+    t.Fatalf("expected only the complete message but got: %d, %v", num, err)
+  }
+  if consumer.offset != uint64(len(first)) {
+    t.Fatalf("expected the offset to stop at the partial message: %d but got: %d", len(first), consumer.offset)
+  }
+}
+
+func TestSnappyCompressedMessagesRoundTrip(t *testing.T) {
+  payloads := []string{"testing", "testing snappy", strings.Repeat("repeated ", 20000), ""}
+  msgs := make([]*Message, len(payloads))
+  for i, payload := range payloads {
+    msgs[i] = NewMessage([]byte(payload))
+  }
+  msg := NewCompressedMessagesWithCodec(DefaultCodecsMap[SNAPPY_COMPRESSION_ID], msgs...)
+  encoded := msg.Encode()
+  if encoded[5] != SNAPPY_COMPRESSION_ID {
+    t.Fatalf("expected compression attribute: %d but got: %d", SNAPPY_COMPRESSION_ID, encoded[5])
+  }
+  if len(encoded) >= len(EncodeMessageSet(msgs)) {
+    t.Fatal("expected the message set to compress")
+  }
+
+  msgsDecoded, _, err := DecodeE(encoded, DefaultCodecsMap)
+  if err != nil || len(msgsDecoded) != len(payloads) {
+    t.Fatalf("expected %d messages but got: %d, %v", len(payloads), len(msgsDecoded), err)
+  }
+  for i, payload := range payloads {
+    if msgsDecoded[i].PayloadString() != payload {
+      t.Fatalf("message %d did not round trip", i)
+    }
+  }
+}
+
+func TestSnappyDecodeBareBlock(t *testing.T) {
+  // length 10, literal "ab", then a copy of 8 bytes from 2 back, overlapping its own output
+  block := []byte{0x0a, 0x04, 'a', 'b', 0x1e, 0x02, 0x00}
+  if decoded := new(SnappyPayloadCodec).Decode(block); string(decoded) != "ababababab" {
+    t.Fatalf("expected: ababababab but got: %q", decoded)
+  }
+}
+
+func TestSnappyCorruptPayload(t *testing.T) {
+  // a valid checksum over a payload that doesn't decompress
+  corrupt := (&Message{magic: MAGIC_DEFAULT, compression: SNAPPY_COMPRESSION_ID,
+    payload: append(append([]byte{}, xerialHeader...), 0, 0, 0, 3, 0xff, 0xff, 0xff)}).withChecksum(nil)
+  if msgs, _, err := DecodeE(corrupt.Encode(), DefaultCodecsMap); !errors.Is(err, errSnappyCorrupt) {
+    t.Fatalf("expected the corruption to be reported but got: %d messages, %v", len(msgs), err)
+  }
+}
+
+func TestConsumeReadTimeout(t *testing.T) {
+  listener, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer listener.Close()
+  // accept, but never reply
+  go func() {
+    conn, err := listener.Accept()
+    if err == nil {
+      defer conn.Close()
+      io.Copy(io.Discard, conn)
+    }
+  }()
+
+  consumer := NewBrokerConsumer(listener.Addr().String(), "test", 0, 0, 1048576)
+  consumer.SetLogger(NopLogger)
+  consumer.ReadTimeout = 50 * time.Millisecond
+  _, err = consumer.Consume(func(msg *Message) {})
+  if !isConnectionError(err) || !errors.Is(err, os.ErrDeadlineExceeded) {
+    t.Fatalf("expected a retriable timeout but got: %v", err)
+  }
+}
+
+func TestConsumeBatchesOnChannel(t *testing.T) {
+  first := EncodeMessageSet([]*Message{NewMessage([]byte("one")), NewMessage([]byte("two"))})
+  second := EncodeMessageSet([]*Message{NewMessage([]byte("three"))})
+  consumer := NewBrokerConsumer(serveFetches(t, first, second), "test", 0, 0, 1048576)
+  consumer.SetLogger(NopLogger)
+
+  batchChan := make(chan []*Message)
+  quit := make(chan bool)
+  result := make(chan int, 1)
+  go func() {
+    num, _ := consumer.ConsumeBatchesOnChannel(batchChan, 10, quit)
+    result <- num
+  }()
+
+  // one batch per fetch
+  if batch := <-batchChan; len(batch) != 2 || batch[0].PayloadString() != "one" || batch[1].PayloadString() != "two" {
+    t.Fatalf("unexpected first batch of %d messages", len(batch))
+  }
+  if batch := <-batchChan; len(batch) != 1 || batch[0].PayloadString() != "three" {
+    t.Fatalf("unexpected second batch of %d messages", len(batch))
+  }
+  quit <- true
+  for range batchChan {
+    t.Fatal("expected no more batches")
+  }
+  if num := <-result; num != 3 {
+    t.Fatalf("expected 3 messages delivered but got: %d", num)
+  }
+  if consumer.offset != uint64(len(first)+len(second)) {
+    t.Fatalf("expected offset: %d but got: %d", len(first)+len(second), consumer.offset)
+  }
+}
+
+func TestConsumeBatchesOnChannelCommitsDelivered(t *testing.T) {
+  first := EncodeMessageSet([]*Message{NewMessage([]byte("one")), NewMessage([]byte("two"))})
+  second := EncodeMessageSet([]*Message{NewMessage([]byte("three"))})
+  consumer := NewBrokerConsumer(serveFetches(t, first, second), "test", 0, 0, 1048576)
+  defer consumer.Close()
+  consumer.SetLogger(NopLogger)
+  store := NewFileOffsetStore(t.TempDir())
+  consumer.OffsetStore = store
+  stored := func() uint64 {
+    offset, err := store.Load("test", 0)
+    if err != nil && !errors.Is(err, ErrNoCommittedOffset) {
+      t.Fatal(err)
+    }
+    return offset
+  }
+  waitBlocked := func() {
+    for deadline := time.Now().Add(time.Second); !consumer.Stats().DeliveryBlocked; time.Sleep(time.Millisecond) {
+      if time.Now().After(deadline) {
+        t.Fatal("expected a batch waiting to be delivered")
+      }
+    }
+  }
+
+  batchChan := make(chan []*Message)
+  quit := make(chan bool)
+  result := make(chan int, 1)
+  go func() {
+    num, _ := consumer.ConsumeBatchesOnChannel(batchChan, 10, quit)
+    result <- num
+  }()
+
+  // fetched but not taken, so not committed
+  waitBlocked()
+  if offset := stored(); offset != 0 {
+    t.Fatalf("expected nothing committed before the batch was taken but got: %d", offset)
+  }
+  if batch := <-batchChan; len(batch) != 2 {
+    t.Fatalf("unexpected first batch of %d messages", len(batch))
+  }
+
+  // the second batch is dropped on quit, leaving it to be fetched again
+  waitBlocked()
+  quit <- true
+  for range batchChan {
+    t.Fatal("expected the waiting batch to be dropped")
+  }
+  if num := <-result; num != 2 {
+    t.Fatalf("expected 2 messages delivered but got: %d", num)
+  }
+  if stored() != uint64(len(first)) || consumer.Offset() != uint64(len(first)) {
+    t.Fatalf("expected offset %d stored and kept but got: %d, %d", len(first), stored(), consumer.Offset())
+  }
+}
+
+func TestConsumeOnChannelWaitForDelivery(t *testing.T) {
+  var fetches, keepAlives atomic.Int32
+  messageSet := EncodeMessageSet([]*Message{NewMessage([]byte("one")), NewMessage([]byte("two"))})
+  address := serve(t, func(conn net.Conn) {
+    answerRequests(conn, func(request []byte) []byte {
+      if binary.BigEndian.Uint16(request) == REQUEST_OFFSETS {
+        keepAlives.Add(1)
+        return append(uint32bytes(1), make([]byte, 8)...)
+      }
+      if fetches.Add(1) == 1 {
+        return messageSet
+      }
+      return []byte{}
+    })
+  })
+  consumer := NewBrokerConsumer(address, "test", 0, 0, 1048576)
+  consumer.SetLogger(NopLogger)
+  consumer.WaitForDelivery = true
+  consumer.Prefetch = true // ignored
+  consumer.BlockedKeepAlive = 20 * time.Millisecond
+
+  msgChan := make(chan *Message, 4)
+  quit := make(chan bool)
+  go consumer.ConsumeOnChannelE(msgChan, 1, quit)
+
+  // both messages sit in the buffer unreceived, so no further fetch is issued
+  time.Sleep(150 * time.Millisecond)
+  if n := fetches.Load(); n != 1 {
+    t.Fatalf("expected 1 fetch while undelivered but got: %d", n)
+  }
+  if stats := consumer.Stats(); !stats.DeliveryBlocked || stats.BlockedFor < 100*time.Millisecond {
+    t.Fatalf("expected delivery blocked for a while, got: %v %v", stats.DeliveryBlocked, stats.BlockedFor)
+  }
+  if keepAlives.Load() < 2 {
+    t.Fatalf("expected keep-alives while blocked but got: %d", keepAlives.Load())
+  }
+
+  <-msgChan
+  <-msgChan
+  time.Sleep(50 * time.Millisecond)
+  if fetches.Load() < 2 {
+    t.Fatal("expected fetching to resume once delivered")
+  }
+  if consumer.Stats().DeliveryBlocked {
+    t.Fatal("expected delivery no longer blocked")
+  }
+  quit <- true
+  for range msgChan {
+  }
+}
+
+func TestConsumeOnChannelHeartbeatReconnects(t *testing.T) {
+  var connections, heartbeats atomic.Int32
+  address := serve(t, func(conn net.Conn) {
+    first := connections.Add(1) == 1
+    answerRequests(conn, func(request []byte) []byte {
+      if binary.BigEndian.Uint16(request) == REQUEST_OFFSETS {
+        if heartbeats.Add(1) == 1 && first {
+          conn.Close() // dropped between fetches
+        }
+        return append(uint32bytes(1), make([]byte, 8)...)
+      }
+      return []byte{}
+    })
+  })
+  consumer := NewConsumer(address, "test", 0, WithMaxSize(1048576), WithLogger(NopLogger),
+    WithHeartbeatInterval(20*time.Millisecond), WithKeepAlive(time.Minute))
+  consumer.ReconnectBackoffBase = time.Millisecond
+
+  msgChan := make(chan *Message)
+  quit := make(chan bool)
+  result := make(chan error, 1)
+  go func() {
+    _, err := consumer.ConsumeOnChannelE(msgChan, 10000, quit)
+    result <- err
+  }()
+
+  time.Sleep(150 * time.Millisecond)
+  if n := connections.Load(); n != 2 {
+    t.Fatalf("expected a reconnect after the failed heartbeat, got %d connections", n)
+  }
+  if n := heartbeats.Load(); n < 3 {
+    t.Fatalf("expected heartbeats to carry on over the new connection, got: %d", n)
+  }
+  quit <- true
+  for range msgChan {
+  }
+  if err := <-result; err != nil {
+    t.Fatal(err)
+  }
+}
+
+func TestConsumeOnChannelReconnects(t *testing.T) {
+  broker, err := NewFakeBroker()
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer broker.Close()
+  one := NewMessage([]byte("one"))
+  broker.Append(one, NewMessage([]byte("two")), NewMessage([]byte("three")))
+  // the first two fetches lose their connection
+  broker.RespondWithFrame([]byte{0x00, 0x00, 0x00, 0x10, 0x00, 0x00})
+  broker.RespondWithFrame([]byte{0x00, 0x00, 0x00, 0x10, 0x00, 0x00})
+
+  var dials atomic.Int32
+  dialer := func(network, addr string) (net.Conn, error) {
+    dials.Add(1)
+    return broker.Dial(network, addr)
+  }
+  // resuming from the offset it was at, past "one"
+  consumer := NewConsumer("fake", "test", 0, WithOffset(uint64(one.Size())), WithMaxSize(1048576),
+    WithLogger(NopLogger), WithDialer(dialer))
+  defer consumer.Close()
+  consumer.ReconnectBackoffBase = time.Millisecond
+
+  msgChan := make(chan *Message)
+  quit := make(chan bool)
+  result := make(chan error, 1)
+  go func() {
+    _, err := consumer.ConsumeOnChannelE(msgChan, 10, quit)
+    result <- err
+  }()
+  payloads := []string{(<-msgChan).PayloadString(), (<-msgChan).PayloadString()}
+  close(quit)
+  for range msgChan {
+  }
+  if err := <-result; err != nil {
+    t.Fatal(err)
+  }
+  if strings.Join(payloads, ",") != "two,three" || dials.Load() != 3 {
+    t.Fatalf("expected two and three after 2 reconnects but got: %q over %d connections", payloads, dials.Load())
+  }
+
+  // a broker that stays down surfaces the error after MaxReconnectAttempts
+  dials.Store(0)
+  down := errors.New("broker down")
+  dead := NewConsumer("fake", "test", 0, WithMaxSize(1048576), WithLogger(NopLogger),
+    WithDialer(func(network, addr string) (net.Conn, error) {
+      if dials.Add(1) > 1 {
+        return nil, down
+      }
+      return broker.Dial(network, addr)
+    }))
+  defer dead.Close()
+  dead.ReconnectBackoffBase = time.Millisecond
+  dead.MaxReconnectAttempts = 2
+  broker.RespondWithFrame([]byte{0x00, 0x00, 0x00, 0x10, 0x00, 0x00})
+  deadChan := make(chan *Message, 10)
+  go func() {
+    for range deadChan {
+    }
+  }()
+  if _, err := dead.ConsumeOnChannelE(deadChan, 10, make(chan bool)); !errors.Is(err, down) {
+    t.Fatalf("expected the dial error after giving up but got: %v", err)
+  }
+  if n := dials.Load(); n != 3 {
+    t.Fatalf("expected 1 connection and 2 reconnect attempts but got %d dials", n)
+  }
+}
+
+func TestRateLimit(t *testing.T) {
+  msgs := make([]*Message, 10)
+  for i := range msgs {
+    msgs[i] = NewMessage([]byte("0123456789"))
+  }
+  address := serveLog(t, EncodeMessageSet(msgs))
+
+  // 100 bytes/s of 10 byte payloads paces 10 messages over 90ms
+  consumer := NewConsumer(address, "test", 0, WithMaxSize(1048576), WithLogger(NopLogger), WithRateLimit(0, 100))
+  start := time.Now()
+  if num, err := consumer.Consume(func(msg *Message) {}); err != nil || num != 10 {
+    t.Fatalf("expected 10 messages but got: %d, %v", num, err)
+  }
+  if elapsed := time.Since(start); elapsed < 80*time.Millisecond {
+    t.Fatalf("expected the bytes rate to pace consumption but took: %v", elapsed)
+  }
+
+  // lifting the limit from the handler lets the rest through straight away, where 10/s would take 900ms
+  consumer = NewConsumer(address, "test", 0, WithMaxSize(1048576), WithLogger(NopLogger), WithRateLimit(10, 0))
+  start = time.Now()
+  handled := 0
+  num, err := consumer.Consume(func(msg *Message) {
+    if handled++; handled == 2 {
+      consumer.SetRateLimit(0, 0)
+    }
+  })
+  if err != nil || num != 10 {
+    t.Fatalf("expected 10 messages but got: %d, %v", num, err)
+  }
+  if elapsed := time.Since(start); elapsed < 90*time.Millisecond || elapsed > 500*time.Millisecond {
+    t.Fatalf("expected one paced message then the rest unlimited but took: %v", elapsed)
+  }
+}
+
+func TestConsumeCaughtUp(t *testing.T) {
+  first := EncodeMessageSet([]*Message{NewMessage([]byte("one")), NewMessage([]byte("two"))})
+  consumer := NewBrokerConsumer(serveFetches(t, first), "test", 0, 0, 1048576)
+  consumer.SetLogger(NopLogger)
+
+  total := 0
+  for {
+    num, err := consumer.Consume(func(msg *Message) {})
+    if errors.Is(err, ErrNoMessages) {
+      break
+    }
+    if err != nil {
+      t.Fatal(err)
+    }
+    total += num
+  }
+  if total != 2 {
+    t.Fatalf("expected 2 messages before catching up but got: %d", total)
+  }
+
+  // a dropped connection is not mistaken for being caught up
+  address := serve(t, func(conn net.Conn) { conn.Close() })
+  consumer = NewBrokerConsumer(address, "test", 0, 0, 1048576)
+  consumer.SetLogger(NopLogger)
+  if _, err := consumer.Consume(func(msg *Message) {}); err == nil || errors.Is(err, ErrNoMessages) {
+    t.Fatalf("expected a connection error but got: %v", err)
+  }
+}
+
+func TestTail(t *testing.T) {
+  old := EncodeMessageSet([]*Message{NewMessage([]byte("old"))})
+  fresh := EncodeMessageSet([]*Message{NewMessage([]byte("one")), NewMessage([]byte("two"))})
+  address := serve(t, func(conn net.Conn) {
+    answerRequests(conn, func(request []byte) []byte {
+      if binary.BigEndian.Uint16(request) == REQUEST_OFFSETS {
+        // the latest offset is past the old message
+        return append(uint32bytes(1), uint64ToUint64bytes(uint64(len(old)))...)
+      }
+      if binary.BigEndian.Uint64(request[len(request)-12:]) == uint64(len(old)) {
+        return fresh
+      }
+      return []byte{}
+    })
+  })
+  consumer := NewBrokerConsumer(address, "test", 0, 0, 1048576)
+  consumer.SetLogger(NopLogger)
+
+  out := &bytes.Buffer{}
+  quit := make(chan bool)
+  go func() {
+    time.Sleep(50 * time.Millisecond)
+    quit <- true
+  }()
+  num, err := consumer.Tail(out, 10, quit)
+  if err != nil || num != 2 {
+    t.Fatalf("expected 2 messages written but got: %d, %v", num, err)
+  }
+  if out.String() != "one\ntwo\n" {
+    t.Fatalf("unexpected output: %q", out.String())
+  }
+}
+
+// run with -race
+func TestStatsWhileConsuming(t *testing.T) {
+  msgs := make([]*Message, 200)
+  for i := range msgs {
+    msgs[i] = NewMessage([]byte(fmt.Sprintf("message %d", i)))
+  }
+  log := EncodeMessageSet(msgs)
+  consumer := NewBrokerConsumer(serveLog(t, log), "test", 0, 0, 256)
+  consumer.SetLogger(NopLogger)
+  consumer.AutoGrowMaxSize = true
+  consumer.PrefixFilter = []byte("message")
+
+  msgChan := make(chan *Message)
+  quit := make(chan bool)
+  go consumer.ConsumeOnChannelE(msgChan, 1, quit)
+
+  polled := make(chan bool)
+  go func() {
+    defer close(polled)
+    for consumer.Offset() < uint64(len(log)) {
+      stats := consumer.Stats()
+      if stats.Offset > uint64(len(log)) || stats.MaxSize < 256 {
+        t.Errorf("unexpected stats: %+v", stats)
+        return
+      }
+    }
+  }()
+  for received := 0; received < len(msgs); received++ {
+    <-msgChan
+  }
+  <-polled
+  quit <- true
+  for range msgChan {
+  }
+  if stats := consumer.Stats(); stats.Offset != uint64(len(log)) || stats.PrefixMatched != uint64(len(msgs)) {
+    t.Fatalf("unexpected stats once done: %+v", stats)
+  }
+}
+
+func TestPollBackoff(t *testing.T) {
+  consumer := NewConsumer("localhost:9092", "test", 0, WithPollBackoff(35*time.Millisecond))
+  backoff := consumer.newPollBackoff(5)
+  expected := []time.Duration{5, 10, 20, 35, 35}
+  for i, wait := range expected {
+    if next := backoff.next(false); next != wait*time.Millisecond {
+      t.Fatalf("expected wait %d to be %dms but got: %v", i, wait, next)
+    }
+  }
+  if next := backoff.next(true); next != 5*time.Millisecond {
+    t.Fatalf("expected the base interval once messages arrive but got: %v", next)
+  }
+  if next := backoff.next(false); next != 5*time.Millisecond {
+    t.Fatalf("expected backing off to start over but got: %v", next)
+  }
+
+  // without a max the interval is fixed
+  backoff = NewConsumer("localhost:9092", "test", 0).newPollBackoff(5)
+  for i := 0; i < 3; i++ {
+    if next := backoff.next(false); next != 5*time.Millisecond {
+      t.Fatalf("expected a fixed interval but got: %v", next)
+    }
+  }
+}
+
+func TestConsumeOnChannelBacksOffWhenIdle(t *testing.T) {
+  var fetches atomic.Int32
+  address := serve(t, func(conn net.Conn) {
+    answerRequests(conn, func(request []byte) []byte {
+      fetches.Add(1)
+      return []byte{}
+    })
+  })
+  consumer := NewConsumer(address, "test", 0, WithMaxSize(1048576), WithLogger(NopLogger),
+    WithPollBackoff(80*time.Millisecond))
+
+  msgChan := make(chan *Message)
+  quit := make(chan bool)
+  go consumer.ConsumeOnChannelE(msgChan, 5, quit)
+  time.Sleep(200 * time.Millisecond)
+  quit <- true
+  for range msgChan {
+  }
+  // 5, 10, 20, 40, 80, 80ms apart rather than every 5ms
+  if n := fetches.Load(); n < 3 || n > 10 {
+    t.Fatalf("expected polling to back off, got %d fetches", n)
+  }
+}
+
+func TestConsumeUntilPastFilteredFetch(t *testing.T) {
+  first := NewMessage([]byte("bbb")).Encode()
+  log := EncodeMessageSet([]*Message{NewMessage([]byte("bbb")), NewMessage([]byte("bbb")), NewMessage([]byte("aaa"))})
+  // the first fetch holds only messages the filter skips
+  consumer := NewBrokerConsumer(serveLog(t, log), "test", 0, 0, uint32(2*len(first)))
+  consumer.SetLogger(NopLogger)
+  defer consumer.Close()
+  consumer.PrefixFilter = []byte("aaa")
+
+  payloads := []string{}
+  num, err := consumer.ConsumeUntil(func(msg *Message) bool { return false }, func(msg *Message) {
+    payloads = append(payloads, msg.PayloadString())
+  })
+  if err != nil || num != 1 || payloads[0] != "aaa" {
+    t.Fatalf("expected the matching message but got: %d, %q, %v", num, payloads, err)
+  }
+  if consumer.Offset() != uint64(len(log)) {
+    t.Fatalf("expected to consume to %d but stopped at: %d", len(log), consumer.Offset())
+  }
+}
+
+func TestPrefixFilterOverConsumeUntil(t *testing.T) {
+  broker, err := NewFakeBroker()
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer broker.Close()
+  for i := 0; i < 20; i++ {
+    broker.Append(NewMessage([]byte(fmt.Sprintf("skip %d", i))))
+  }
+  broker.Append(NewMessage([]byte("type:a")))
+  first := NewMessage([]byte("skip 0")).Encode()
+
+  // fetches of 4 messages, so the first several hold nothing the filter lets through
+  newConsumer := func() *BrokerConsumer {
+    consumer := NewConsumer("fake", "test", 0, WithMaxSize(uint32(4*len(first))), WithDialer(broker.Dial), WithLogger(NopLogger))
+    consumer.PrefixFilter = []byte("type:")
+    return consumer
+  }
+
+  consumer := newConsumer()
+  defer consumer.Close()
+  payloads := []string{}
+  if num, err := consumer.ConsumeFromEarliest(func(msg *Message) { payloads = append(payloads, msg.PayloadString()) }); err != nil || num != 1 {
+    t.Fatalf("expected 1 message from ConsumeFromEarliest but got: %d, %v", num, err)
+  }
+  if payloads[0] != "type:a" || consumer.Stats().PrefixSkipped != 20 {
+    t.Fatalf("unexpected payloads: %q or stats: %+v", payloads, consumer.Stats())
+  }
+
+  writer := newConsumer()
+  defer writer.Close()
+  writer.Framing = FRAMING_NEWLINE
+  out := &bytes.Buffer{}
+  if num, err := writer.ConsumeToWriter(out); err != nil || num != 1 || out.String() != "type:a\n" {
+    t.Fatalf("expected ConsumeToWriter to write the matching message but got: %d, %q, %v", num, out.String(), err)
+  }
+
+  w, err := NewWALConsumer(newConsumer(), t.TempDir()+"/wal")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer w.Close()
+  if num, err := w.Consume(func(msg *Message) {}); err != nil || num != 1 {
+    t.Fatalf("expected 1 message through the WAL consumer but got: %d, %v", num, err)
+  }
+}
+
+func TestConsumeEStopsOnHandlerError(t *testing.T) {
+  first := NewMessage([]byte("one"))
+  log := EncodeMessageSet([]*Message{first, NewMessage([]byte("two")), NewMessage([]byte("three"))})
+  consumer := NewBrokerConsumer(serveLog(t, log), "test", 0, 0, 1048576)
+  defer consumer.Close()
+
+  full := errors.New("database full")
+  var handled []string
+  num, err := consumer.ConsumeE(func(msg *Message) error {
+    if msg.PayloadString() == "two" {
+      return full
+    }
+    handled = append(handled, msg.PayloadString())
+    return nil
+  })
+  if !errors.Is(err, full) || num != 1 || len(handled) != 1 {
+    t.Fatalf("expected the handler error after 1 message but got: %d, %v", num, err)
+  }
+  // left at the failed message, so consuming again resumes with it
+  if consumer.Offset() != uint64(first.Size()) {
+    t.Fatalf("expected the offset at the failed message but got: %d", consumer.Offset())
+  }
+  if num, err = consumer.Consume(func(msg *Message) { handled = append(handled, msg.PayloadString()) }); err != nil || num != 2 {
+    t.Fatalf("expected the remaining 2 messages but got: %d, %v", num, err)
+  }
+  if strings.Join(handled, ",") != "one,two,three" {
+    t.Fatalf("expected every message handled once but got: %v", handled)
+  }
+}
+
+func TestConsumeFromEarliestAfterRetention(t *testing.T) {
+  broker, err := NewFakeBroker()
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer broker.Close()
+  deleted := NewMessage([]byte("deleted"))
+  broker.Append(deleted, NewMessage([]byte("one")), NewMessage([]byte("two")))
+  // retention has deleted the first segment
+  broker.SetOffsets(uint64(deleted.Size()))
+
+  consumer := NewConsumer("fake", "test", 0, WithMaxSize(1048576), WithDialer(broker.Dial), WithLogger(NopLogger))
+  defer consumer.Close()
+  // an offset committed before the retention ran doesn't win over the earliest offset
+  store := NewFileOffsetStore(t.TempDir())
+  if err := store.Commit("test", 0, 0); err != nil {
+    t.Fatal(err)
+  }
+  consumer.OffsetStore = store
+  consumer.SkipInitial = 1
+
+  var payloads []string
+  if num, err := consumer.ConsumeFromEarliest(func(msg *Message) { payloads = append(payloads, msg.PayloadString()) }); err != nil || num != 2 {
+    t.Fatalf("expected 2 messages but got: %d, %v", num, err)
+  }
+  if strings.Join(payloads, ",") != "one,two" {
+    t.Fatalf("expected the messages from the earliest offset but got: %v", payloads)
+  }
+}
+
+func TestConsumeRange(t *testing.T) {
+  msgs := make([]*Message, 6)
+  for i := range msgs {
+    msgs[i] = NewMessage([]byte(fmt.Sprintf("message %d", i)))
+  }
+  log := EncodeMessageSet(msgs)
+  size := uint64(len(msgs[0].Encode()))
+  consumer := NewBrokerConsumer(serveLog(t, log), "test", 0, 0, 1048576)
+  consumer.SetLogger(NopLogger)
+
+  // one fetch holds all of it, straddling the end which falls inside message 4
+  received := []string{}
+  num, err := consumer.ConsumeRange(size, 3*size+1, func(msg *Message) {
+    received = append(received, msg.PayloadString())
+  })
+  if err != nil || num != 3 {
+    t.Fatalf("expected 3 messages but got: %d, %v", num, err)
+  }
+  if strings.Join(received, ",") != "message 1,message 2,message 3" {
+    t.Fatalf("unexpected messages: %v", received)
+  }
+  if consumer.offset != 4*size {
+    t.Fatalf("expected the offset left on message 4 at %d but got: %d", 4*size, consumer.offset)
+  }
+
+  // an end on a message boundary excludes the message there
+  if num, err = consumer.ConsumeRange(0, 2*size, func(msg *Message) {}); err != nil || num != 2 {
+    t.Fatalf("expected 2 messages but got: %d, %v", num, err)
+  }
+
+  // the partition running out before the end
+  if num, err = consumer.ConsumeRange(4*size, 100*size, func(msg *Message) {}); !errors.Is(err, ErrNoMessages) || num != 2 {
+    t.Fatalf("expected 2 messages then ErrNoMessages but got: %d, %v", num, err)
+  }
+}
+
+// Fails every write once it has taken ok writes
+type failingWriter struct {
+  ok  int
+  out bytes.Buffer
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+  if w.ok == 0 {
+    return 0, io.ErrShortWrite
+  }
+  w.ok--
+  return w.out.Write(p)
+}
+
+func TestConsumeToWriterFailedWrite(t *testing.T) {
+  first := NewMessage([]byte("one"))
+  log := EncodeMessageSet([]*Message{first, NewMessage([]byte("two"))})
+  consumer := NewBrokerConsumer(serveLog(t, log), "test", 0, 0, 1048576)
+  defer consumer.Close()
+  consumer.SetLogger(NopLogger)
+  consumer.Framing = FRAMING_LENGTH_PREFIX
+  store := NewFileOffsetStore(t.TempDir())
+  consumer.OffsetStore = store
+
+  w := &failingWriter{ok: 1}
+  if num, err := consumer.ConsumeToWriter(w); !errors.Is(err, io.ErrShortWrite) || num != 1 {
+    t.Fatalf("expected the write error after 1 message but got: %d, %v", num, err)
+  }
+  // left on the message that failed to write, and not committed past it
+  if consumer.Offset() != uint64(first.Size()) {
+    t.Fatalf("expected the offset on the failed message but got: %d", consumer.Offset())
+  }
+  if offset, err := store.Load("test", 0); err != nil || offset != uint64(first.Size()) {
+    t.Fatalf("expected offset %d committed but got: %d, %v", first.Size(), offset, err)
+  }
+
+  w.ok = 1
+  if num, err := consumer.ConsumeToWriter(w); err != nil || num != 1 || consumer.Offset() != uint64(len(log)) {
+    t.Fatalf("expected the failed message retried but got: %d, %v at %d", num, err, consumer.Offset())
+  }
+}
+
+func TestConsumeWithBytes(t *testing.T) {
+  messageSet := EncodeMessageSet([]*Message{NewMessage([]byte("one")), NewMessage([]byte("two"))})
+  // a partial message at the end of the fetch isn't consumed, so isn't counted
+  partial := NewMessage([]byte("three")).Encode()[:6]
+  consumer := NewBrokerConsumer(serveFetches(t, append(messageSet, partial...)), "test", 0, 0, 1048576)
+  consumer.SetLogger(NopLogger)
+
+  num, size, err := consumer.ConsumeWithBytes(func(msg *Message) {})
+  if err != nil || num != 2 || size != len(messageSet) {
+    t.Fatalf("expected 2 messages of %d size but got: %d, %d, %v", len(messageSet), num, size, err)
+  }
+  if _, size, err = consumer.ConsumeWithBytes(func(msg *Message) {}); !errors.Is(err, ErrNoMessages) || size != 0 {
+    t.Fatalf("expected no size and ErrNoMessages but got: %d, %v", size, err)
+  }
+}
+
+func TestGetOffsetsAscending(t *testing.T) {
+  address := serve(t, func(conn net.Conn) {
+    answerRequests(conn, func(request []byte) []byte {
+      response := uint32bytes(3)
+      for _, offset := range []uint64{300, 200, 100} {
+        response = append(response, uint64ToUint64bytes(offset)...)
+      }
+      return response
+    })
+  })
+  consumer := NewBrokerOffsetConsumer(address, "test", 0)
+  consumer.SetLogger(NopLogger)
+  offsets, err := consumer.GetOffsetsAscending(-1, 3)
+  if err != nil || len(offsets) != 3 || offsets[0] != 100 || offsets[2] != 300 {
+    t.Fatalf("expected 100, 200, 300 but got: %v, %v", offsets, err)
+  }
+
+  // nothing to ask for, so nothing is sent (there's no broker here)
+  consumer = NewBrokerOffsetConsumer("127.0.0.1:1", "test", 0)
+  consumer.SetLogger(NopLogger)
+  if offsets, err = consumer.GetOffsets(-1, 0); err != nil || offsets == nil || len(offsets) != 0 {
+    t.Fatalf("expected no offsets but got: %v, %v", offsets, err)
+  }
+}
+
+func TestGetOffsetsForPartitions(t *testing.T) {
+  var inFlight, maxInFlight, connections atomic.Int32
+  address := serve(t, func(conn net.Conn) {
+    connections.Add(1)
+    answerRequests(conn, func(request []byte) []byte {
+      offsetRequest, err := DecodeOffsetRequest(append(uint32bytes(len(request)), request...))
+      if err != nil {
+        t.Errorf("unexpected request: %v", err)
+      }
+      if n := inFlight.Add(1); n > maxInFlight.Load() {
+        maxInFlight.Store(n)
+      }
+      time.Sleep(10 * time.Millisecond)
+      inFlight.Add(-1)
+      if offsetRequest.Partition == 3 {
+        // fails this partition only, the others carry on over a new connection
+        conn.Close()
+        return nil
+      }
+      return append(uint32bytes(1), uint64ToUint64bytes(uint64(offsetRequest.Partition*100))...)
+    })
+  })
+
+  results := GetOffsetsForPartitions(address, "test", []int{0, 1, 2, 3, 4, 5}, -1, 1, 2)
+  if len(results) != 6 {
+    t.Fatalf("expected a result per partition but got: %v", results)
+  }
+  for partition, result := range results {
+    if partition == 3 {
+      if result.Err == nil {
+        t.Fatalf("expected an error for partition 3 but got: %v", result.Offsets)
+      }
+      continue
+    }
+    if result.Err != nil || len(result.Offsets) != 1 || result.Offsets[0] != uint64(partition*100) {
+      t.Fatalf("expected offset %d for partition %d but got: %v, %v", partition*100, partition, result.Offsets, result.Err)
+    }
+  }
+  if n := maxInFlight.Load(); n < 1 || n > 2 {
+    t.Fatalf("expected at most 2 requests in flight but got: %d", n)
+  }
+  // the pool's 2 connections, and one to replace the connection partition 3 failed on
+  if n := connections.Load(); n > 3 {
+    t.Fatalf("expected at most 3 connections but got: %d", n)
+  }
+
+  connections.Store(0)
+  results = GetOffsetsForPartitions(address, "test", []int{0, 1, 2, 4, 5, 6, 7, 8}, -1, 1, 2)
+  if len(results) != 8 || results[8].Err != nil || results[8].Offsets[0] != 800 {
+    t.Fatalf("expected a result per partition but got: %v", results)
+  }
+  if n := connections.Load(); n < 1 || n > 2 {
+    t.Fatalf("expected the lookups to share at most 2 connections but got: %d", n)
+  }
+}
+
+func TestGetOffsetsAcrossBrokers(t *testing.T) {
+  var hosts []string
+  for i := 1; i <= 2; i++ {
+    broker, err := NewFakeBroker()
+    if err != nil {
+      t.Fatal(err)
+    }
+    defer broker.Close()
+    broker.SetOffsets(uint64(i * 100))
+    hosts = append(hosts, broker.Addr())
+  }
+  dead, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatal(err)
+  }
+  deadAddr := dead.Addr().String()
+  dead.Close()
+
+  results, err := GetOffsetsAcrossBrokers(context.Background(), append(hosts, deadAddr), "test", 0, -1)
+  var errs BrokerOffsetErrors
+  if !errors.As(err, &errs) || len(errs) != 1 || errs[deadAddr] == nil {
+    t.Fatalf("expected an error for the dead broker only but got: %v", err)
+  }
+  if len(results) != 2 || results[hosts[0]][0] != 100 || results[hosts[1]][0] != 200 {
+    t.Fatalf("expected the offsets of the live brokers but got: %v", results)
+  }
+
+  // a broker that never answers is abandoned when ctx is done
+  hung := serve(t, func(conn net.Conn) {
+    io.Copy(io.Discard, conn)
+  })
+  ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+  defer cancel()
+  start := time.Now()
+  results, err = GetOffsetsAcrossBrokers(ctx, append(hosts, hung), "test", 0, -1)
+  if !errors.Is(err, context.DeadlineExceeded) || time.Since(start) > time.Second {
+    t.Fatalf("expected the deadline to end the lookups but got: %v after %v", err, time.Since(start))
+  }
+  if _, ok := results[hung]; ok || len(results) != 2 {
+    t.Fatalf("expected only the brokers that answered but got: %v", results)
+  }
+}
+
+func TestOffsetsByTime(t *testing.T) {
+  // segments starting at 0, 100 and 200 last written at 1s, 2s and 3s, and the end of the log at 300 written
+  // now; the broker answers with the starts of those written at or before the time, latest first
+  starts := []uint64{0, 100, 200, 300}
+  written := []int64{1000, 2000, 3000, math.MaxInt64}
+  address := serve(t, func(conn net.Conn) {
+    answerRequests(conn, func(request []byte) []byte {
+      offsetRequest, err := DecodeOffsetRequest(append(uint32bytes(len(request)), request...))
+      if err != nil {
+        t.Errorf("unexpected request: %v", err)
+      }
+      last := -1
+      switch offsetRequest.Time {
+      case -1:
+        last = len(starts) - 1
+      case -2:
+        last = 0
+      default:
+        for i := range starts {
+          if written[i] <= offsetRequest.Time {
+            last = i
+          }
+        }
+      }
+      var offsets []uint64
+      for i := last; i >= 0 && uint32(len(offsets)) < offsetRequest.MaxNumOffsets; i-- {
+        offsets = append(offsets, starts[i])
+      }
+      response := uint32bytes(len(offsets))
+      for _, offset := range offsets {
+        response = append(response, uint64ToUint64bytes(offset)...)
+      }
+      return response
+    })
+  })
+  consumer := NewBrokerOffsetConsumer(address, "test", 0)
+  consumer.SetLogger(NopLogger)
+
+  at := func(ms int64) time.Time { return time.UnixMilli(ms) }
+  offsets, err := consumer.OffsetsByTime([]time.Time{at(500), at(1500), at(2000), at(2500), at(3500)})
+  if err != nil {
+    t.Fatal(err)
+  }
+  // the first segment written to at or after each time
+  for ms, expected := range map[int64]uint64{500: 0, 1500: 100, 2000: 100, 2500: 200, 3500: 300} {
+    if offsets[at(ms)] != expected {
+      t.Fatalf("expected offset %d at %dms but got: %d", expected, ms, offsets[at(ms)])
+    }
+  }
+
+  consumer = NewBrokerOffsetConsumer("127.0.0.1:1", "test", 0)
+  consumer.SetLogger(NopLogger)
+  offsets, err = consumer.OffsetsByTime([]time.Time{at(500)})
+  var errs TimeOffsetErrors
+  if !errors.As(err, &errs) || errs[at(500)] == nil || len(offsets) != 0 {
+    t.Fatalf("expected a per timestamp error but got: %v, %v", offsets, err)
+  }
+}
+
+// A connection delivering one byte per Read, as a slow or fragmented network may
+type oneByteConn struct {
+  net.Conn
+}
+
+func (c oneByteConn) Read(b []byte) (int, error) {
+  if len(b) > 1 {
+    b = b[:1]
+  }
+  return c.Conn.Read(b)
+}
+
+func TestReadResponseShortReads(t *testing.T) {
+  messageSet := EncodeMessageSet([]*Message{NewMessage([]byte("one")), NewMessage([]byte("two"))})
+  response := append(uint32bytes(2+len(messageSet)), 0, 0)
+  response = append(response, messageSet...)
+  broker := newBroker("localhost:9092", "test", 0)
+
+  client, server := net.Pipe()
+  go func() {
+    server.Write(response)
+    // the start of another response, which must be left unread
+    server.Write(response[:3])
+    server.Close()
+  }()
+  length, payload, err := broker.readResponse(oneByteConn{client}, 1048576)
+  if err != nil || length != uint32(2+len(messageSet)) || !bytes.Equal(payload, messageSet) {
+    t.Fatalf("expected the whole message set but got: %d, % X, %v", length, payload, err)
+  }
+
+  // closed mid-frame is an unexpected EOF, not the io.EOF of a connection closed between responses
+  if _, _, err = broker.readResponse(oneByteConn{client}, 1048576); !errors.Is(err, io.ErrUnexpectedEOF) {
+    t.Fatalf("expected io.ErrUnexpectedEOF but got: %v", err)
+  }
+
+  client, server = net.Pipe()
+  go func() {
+    server.Write(response[:10])
+    server.Close()
+  }()
+  if _, _, err = broker.readResponse(oneByteConn{client}, 1048576); !errors.Is(err, io.ErrUnexpectedEOF) || err == io.EOF {
+    t.Fatalf("expected io.ErrUnexpectedEOF but got: %v", err)
+  }
+}
+
+func TestConsumeN(t *testing.T) {
+  msgs := make([]*Message, 5)
+  for i := range msgs {
+    msgs[i] = NewMessage([]byte(fmt.Sprintf("message %d", i)))
+  }
+  log := EncodeMessageSet(msgs)
+  size := uint64(len(msgs[0].Encode()))
+  // fetches of two messages at a time
+  consumer := NewBrokerConsumer(serveLog(t, log), "test", 0, 0, uint32(2*size))
+  consumer.SetLogger(NopLogger)
+  consumer.MaxEmptyPolls = 1
+
+  received, err := consumer.ConsumeN(3)
+  if err != nil || len(received) != 3 {
+    t.Fatalf("expected 3 messages but got: %d, %v", len(received), err)
+  }
+  for i, msg := range received {
+    if msg.PayloadString() != fmt.Sprintf("message %d", i) || msg.Offset() != uint64(i)*size {
+      t.Fatalf("unexpected message %d: %q at %d", i, msg.PayloadString(), msg.Offset())
+    }
+  }
+  if consumer.offset != 3*size {
+    t.Fatalf("expected the offset just past the third message at %d but got: %d", 3*size, consumer.offset)
+  }
+
+  // only two are left when the partition runs dry
+  if received, err = consumer.ConsumeN(3); err != nil || len(received) != 2 || received[1].Offset() != 4*size {
+    t.Fatalf("expected the remaining 2 messages but got: %d, %v", len(received), err)
+  }
+}
+
+func TestCurrentOffsetResumes(t *testing.T) {
+  log := EncodeMessageSet([]*Message{NewMessage([]byte("one")), NewMessage([]byte("two")), NewMessage([]byte("three"))})
+  address := serveLog(t, log)
+  consumer := NewBrokerConsumer(address, "test", 0, 0, 1048576)
+  consumer.SetLogger(NopLogger)
+  if _, err := consumer.ConsumeN(2); err != nil {
+    t.Fatal(err)
+  }
+  checkpoint := consumer.CurrentOffset()
+
+  // a new consumer from the checkpoint picks up with the third message
+  resumed := NewBrokerConsumer(address, "test", 0, checkpoint, 1048576)
+  resumed.SetLogger(NopLogger)
+  msgs, err := resumed.ConsumeN(1)
+  if err != nil || len(msgs) != 1 || msgs[0].PayloadString() != "three" {
+    t.Fatalf("expected to resume with the third message but got: %v, %v", msgs, err)
+  }
+  if resumed.CurrentOffset() != uint64(len(log)) {
+    t.Fatalf("expected offset %d but got: %d", len(log), resumed.CurrentOffset())
+  }
+}
+
+func TestCloseStopsConsuming(t *testing.T) {
+  consumer := NewBrokerConsumer(serveFetches(t, EncodeMessageSet([]*Message{NewMessage([]byte("one"))})), "test", 0, 0, 1048576)
+  consumer.SetLogger(NopLogger)
+
+  msgChan := make(chan *Message)
+  result := make(chan error, 1)
+  go func() {
+    _, err := consumer.ConsumeOnChannelE(msgChan, 10, make(chan bool))
+    result <- err
+  }()
+  if msg := <-msgChan; msg.PayloadString() != "one" {
+    t.Fatalf("unexpected message: %q", msg.PayloadString())
+  }
+
+  consumer.Close()
+  consumer.Close() // closing again is harmless
+  for range msgChan {
+  }
+  if err := <-result; err != nil {
+    t.Fatalf("expected the loop to stop cleanly but got: %v", err)
+  }
+
+  if _, err := consumer.ConsumeOnChannelE(make(chan *Message), 10, make(chan bool)); err != ErrConsumerClosed {
+    t.Fatalf("expected ErrConsumerClosed but got: %v", err)
+  }
+  if _, err := consumer.Consume(func(msg *Message) {}); err != ErrConsumerClosed {
+    t.Fatalf("expected ErrConsumerClosed but got: %v", err)
+  }
+}
+
+func TestConsumeUntilQuitCounts(t *testing.T) {
+  msgs := EncodeMessageSet([]*Message{NewMessage([]byte("one")), NewMessage([]byte("two"))})
+  consumer := NewBrokerConsumer(serveFetches(t, msgs, NewMessage([]byte("three")).Encode()), "test", 0, 0, 1048576)
+  consumer.SetLogger(NopLogger)
+
+  quit := make(chan os.Signal)
+  handled := make(chan bool, 3)
+  result := make(chan [2]int64, 1)
+  go func() {
+    consumed, skipped, _ := consumer.ConsumeUntilQuit(10, quit, func(msg *Message) { handled <- true })
+    result <- [2]int64{consumed, skipped}
+  }()
+  for i := 0; i < 3; i++ {
+    <-handled
+  }
+  if stats := consumer.Stats(); stats.Consumed != 3 || stats.Bytes < uint64(len(msgs)) {
+    t.Fatalf("unexpected stats while consuming: %+v", stats)
+  }
+  quit <- os.Interrupt
+  select {
+  case counts := <-result:
+    if counts[0] != 3 || counts[1] != 0 {
+      t.Fatalf("expected 3 consumed and 0 skipped but got: %v", counts)
+    }
+  case <-time.After(time.Second):
+    t.Fatal("expected quit to stop consuming")
+  }
+
+  // quit cuts short the wait between fetches
+  idle := NewBrokerConsumer(serveFetches(t), "test", 0, 0, 1048576)
+  go func() {
+    time.Sleep(50 * time.Millisecond)
+    quit <- os.Interrupt
+  }()
+  start := time.Now()
+  if consumed, _, err := idle.ConsumeUntilQuit(60000, quit, func(msg *Message) {}); err != nil || consumed != 0 {
+    t.Fatalf("expected nothing consumed but got: %d, %v", consumed, err)
+  }
+  if waited := time.Since(start); waited > time.Second {
+    t.Fatalf("expected quit to interrupt the poll interval but waited: %v", waited)
+  }
+}
+
+func TestConsumeWithContext(t *testing.T) {
+  msgs := EncodeMessageSet([]*Message{NewMessage([]byte("one")), NewMessage([]byte("two"))})
+  consumer := NewBrokerConsumer(serveFetches(t, msgs), "test", 0, 0, 1048576)
+  consumer.SetLogger(NopLogger)
+  defer consumer.Close()
+
+  // cancelled while waiting out the poll interval once caught up
+  ctx, cancel := context.WithCancel(context.Background())
+  handled := 0
+  start := time.Now()
+  num, err := consumer.ConsumeWithContext(ctx, func(msg *Message) {
+    if handled++; handled == 2 {
+      time.AfterFunc(50*time.Millisecond, cancel)
+    }
+  })
+  if !errors.Is(err, context.Canceled) || num != 2 {
+    t.Fatalf("expected 2 messages and a cancellation but got: %d, %v", num, err)
+  }
+  if waited := time.Since(start); waited >= DEFAULT_POLL_TIMEOUT_MS*time.Millisecond {
+    t.Fatalf("expected cancelling to interrupt the poll interval but waited: %v", waited)
+  }
+  if consumer.Offset() != uint64(len(msgs)) {
+    t.Fatalf("expected to stop at offset %d but was at: %d", len(msgs), consumer.Offset())
+  }
+
+  // a deadline, with a fetch in flight the broker never answers
+  silent := serve(t, func(conn net.Conn) { io.Copy(io.Discard, conn) })
+  stuck := NewBrokerConsumer(silent, "test", 0, 0, 1048576)
+  stuck.SetLogger(NopLogger)
+  defer stuck.Close()
+  ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+  defer cancel()
+  start = time.Now()
+  if num, err := stuck.ConsumeWithContext(ctx, func(msg *Message) {}); !errors.Is(err, context.DeadlineExceeded) || num != 0 {
+    t.Fatalf("expected the deadline to stop the fetch but got: %d, %v", num, err)
+  }
+  if waited := time.Since(start); waited > time.Second {
+    t.Fatalf("expected the deadline to close the connection promptly but waited: %v", waited)
+  }
+
+  // already cancelled
+  ctx, cancel = context.WithCancel(context.Background())
+  cancel()
+  if _, err := consumer.ConsumeWithContext(ctx, func(msg *Message) {}); !errors.Is(err, context.Canceled) {
+    t.Fatalf("expected a cancellation but got: %v", err)
+  }
+}
+
+// run with -race
+func TestConsumeUntilQuitDuringFetch(t *testing.T) {
+  first := EncodeMessageSet([]*Message{NewMessage([]byte("one")), NewMessage([]byte("two"))})
+  second := NewMessage([]byte("three")).Encode()
+  inFlight := make(chan bool)
+  release := make(chan bool)
+  addr := serve(t, func(conn net.Conn) {
+    fetches := 0
+    answerRequests(conn, func(request []byte) []byte {
+      fetches++
+      switch fetches {
+      case 1:
+        return first
+      case 2:
+        // hold the second fetch until quit has been sent
+        close(inFlight)
+        <-release
+        return second
+      }
+      return []byte{}
+    })
+  })
+  consumer := NewBrokerConsumer(addr, "test", 0, 0, 1048576)
+  consumer.SetLogger(NopLogger)
+  defer consumer.Close()
+
+  quit := make(chan os.Signal)
+  result := make(chan [2]int64, 1)
+  go func() {
+    consumed, skipped, _ := consumer.ConsumeUntilQuit(1, quit, func(msg *Message) {})
+    result <- [2]int64{consumed, skipped}
+  }()
+  <-inFlight
+  quit <- os.Interrupt
+  consumer.Stats()
+  close(release)
+
+  select {
+  case counts := <-result:
+    // the fetch in flight is handled before stopping
+    if counts[0] != 3 || counts[1] != 0 {
+      t.Fatalf("expected 3 consumed and 0 skipped but got: %v", counts)
+    }
+  case <-time.After(time.Second):
+    t.Fatal("expected quit to stop consuming once the fetch returned")
+  }
+  if stats := consumer.Stats(); stats.Consumed != 3 || stats.Offset != uint64(len(first)+len(second)) {
+    t.Fatalf("unexpected stats: %+v", stats)
+  }
+}
+
+func TestConsumeUntilQuitClosesConn(t *testing.T) {
+  broker, err := NewFakeBroker()
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer broker.Close()
+  broker.Append(NewMessage([]byte("one")))
+
+  var conns []net.Conn
+  consumer := NewConsumer("fake", "test", 0, WithMaxSize(1048576), WithLogger(NopLogger),
+    WithDialer(func(network, addr string) (net.Conn, error) {
+      conn, err := broker.Dial(network, addr)
+      conns = append(conns, conn)
+      return conn, err
+    }))
+  defer consumer.Close()
+
+  quit := make(chan os.Signal, 1)
+  consumer.ConsumeUntilQuit(10, quit, func(msg *Message) { quit <- os.Interrupt })
+  // and when the handler panics
+  broker.Append(NewMessage([]byte("two")))
+  func() {
+    defer func() { recover() }()
+    consumer.ConsumeUntilQuit(10, quit, func(msg *Message) { panic("handler failed") })
+  }()
+
+  if len(conns) != 2 {
+    t.Fatalf("expected a connection per call but got: %d", len(conns))
+  }
+  for i, conn := range conns {
+    if _, err := conn.Write([]byte{0}); !errors.Is(err, io.ErrClosedPipe) {
+      t.Fatalf("expected connection %d to be closed but got: %v", i, err)
+    }
+  }
+}
+
+func TestConsumeEvents(t *testing.T) {
+  broker, err := NewFakeBroker()
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer broker.Close()
+  broker.Append(NewMessage([]byte("one")), NewMessage([]byte("two")))
+  size := uint64(NewMessage([]byte("one")).Size())
+
+  consumer := NewConsumer("fake", "test", 0, WithMaxSize(1048576), WithDialer(broker.Dial), WithLogger(NopLogger))
+  defer consumer.Close()
+  consumer.Events = make(chan ConsumeEvent, 100)
+  // a response cut short after the first fetch, which the loop reconnects from
+  broker.RespondWithError(0)
+  quit := make(chan os.Signal, 1)
+  polls := 0
+  consumer.OnPoll = func(fetched int, offset uint64, err error) {
+    if polls++; polls == 1 {
+      broker.RespondWithFrame([]byte{0x00, 0x00, 0x00, 0x10, 0x00, 0x00})
+    } else if polls == 4 {
+      quit <- os.Interrupt
+    }
+  }
+  consumer.ConsumeUntilQuit(5, quit, func(msg *Message) {})
+  close(consumer.Events)
+
+  var types []string
+  var fetched ConsumeEvent
+  for event := range consumer.Events {
+    types = append(types, event.Type.String())
+    if event.Type == EVENT_FETCHED {
+      fetched = event
+    } else if event.Type == EVENT_ERROR && !errors.Is(event.Err, io.ErrUnexpectedEOF) {
+      t.Fatalf("expected the cut response as the error but got: %v", event.Err)
+    }
+  }
+  expected := "Connected, CaughtUp, Error, Reconnecting, Connected, Fetched, CaughtUp, Stopped"
+  if strings.Join(types, ", ") != expected {
+    t.Fatalf("expected events %s but got: %s", expected, strings.Join(types, ", "))
+  }
+  if fetched.Count != 2 || fetched.Bytes != 2*size || fetched.Offset != 2*size {
+    t.Fatalf("expected 2 messages fetched but got: %+v", fetched)
+  }
+
+  // nobody draining the channel doesn't stall the loop
+  consumer = NewConsumer("fake", "test", 0, WithMaxSize(1048576), WithDialer(broker.Dial), WithLogger(NopLogger))
+  defer consumer.Close()
+  consumer.Events = make(chan ConsumeEvent)
+  consumer.OnPoll = func(fetched int, offset uint64, err error) { quit <- os.Interrupt }
+  if num, _, _ := consumer.ConsumeUntilQuit(5, quit, func(msg *Message) {}); num != 2 {
+    t.Fatalf("expected 2 messages but got: %d", num)
+  }
+}
+
+func TestOnPoll(t *testing.T) {
+  msgs := EncodeMessageSet([]*Message{NewMessage([]byte("one")), NewMessage([]byte("two"))})
+  consumer := NewBrokerConsumer(serveFetches(t, msgs), "test", 0, 0, 1048576)
+  defer consumer.Close()
+
+  quit := make(chan os.Signal, 1)
+  polls := [][2]uint64{}
+  consumer.OnPoll = func(fetched int, offset uint64, err error) {
+    if err != nil {
+      t.Errorf("unexpected poll error: %v", err)
+    }
+    // the second poll comes back empty, but still reports in
+    if polls = append(polls, [2]uint64{uint64(fetched), offset}); len(polls) == 2 {
+      quit <- os.Interrupt
+    }
+  }
+  consumer.ConsumeUntilQuit(10, quit, func(msg *Message) {})
+  if len(polls) != 2 || polls[0] != [2]uint64{2, uint64(len(msgs))} || polls[1] != [2]uint64{0, uint64(len(msgs))} {
+    t.Fatalf("unexpected polls: %v", polls)
+  }
+}
+
+func TestAutoGrowMaxSize(t *testing.T) {
+  large := NewMessage(bytes.Repeat([]byte("large "), 1000)).Encode()
+  log := append(append([]byte{}, NewMessage([]byte("small")).Encode()...), large...)
+  addr := serveLog(t, log)
+
+  consumer := NewBrokerConsumer(addr, "test", 0, 0, 512)
+  consumer.SetLogger(NopLogger)
+  defer consumer.Close()
+  num, err := consumer.Consume(func(msg *Message) {})
+  if err != nil || num != 1 {
+    t.Fatalf("expected the small message but got: %d, %v", num, err)
+  }
+  if _, err = consumer.Consume(func(msg *Message) {}); !errors.Is(err, ErrMessageTooLarge) {
+    t.Fatalf("expected ErrMessageTooLarge but got: %v", err)
+  }
+
+  consumer.AutoGrowMaxSize = true
+  var payload []byte
+  if num, err = consumer.Consume(func(msg *Message) { payload = msg.Payload() }); err != nil || num != 1 {
+    t.Fatalf("expected the large message but got: %d, %v", num, err)
+  }
+  if len(payload) != 6000 || consumer.maxSize < uint32(len(large)) {
+    t.Fatalf("unexpected payload of %d bytes with maxSize %d", len(payload), consumer.maxSize)
+  }
+}
+
+func TestBrokerErrorCodes(t *testing.T) {
+  addr := serve(t, func(conn net.Conn) {
+    defer conn.Close()
+    size := make([]byte, 4)
+    io.ReadFull(conn, size)
+    io.ReadFull(conn, make([]byte, binary.BigEndian.Uint32(size)))
+    conn.Write([]byte{0x00, 0x00, 0x00, 0x02, 0x00, 0x01}) // OffsetOutOfRange
+  })
+  consumer := NewBrokerConsumer(addr, "test", 0, 1<<40, 1048576)
+  consumer.SetLogger(NopLogger)
+  defer consumer.Close()
+  _, err := consumer.Consume(func(msg *Message) {})
+  if !errors.Is(err, ErrOffsetOutOfRange) {
+    t.Fatalf("expected ErrOffsetOutOfRange but got: %v", err)
+  }
+  var brokerErr *BrokerError
+  if !errors.As(err, &brokerErr) || brokerErr.Code != 1 {
+    t.Fatalf("expected a *BrokerError with code 1 but got: %v", err)
+  }
+
+  if !errors.Is(&BrokerError{Code: 3}, ErrWrongPartition) || !errors.Is(&BrokerError{Code: 42}, ErrUnknown) {
+    t.Fatal("unexpected mapping of error codes")
+  }
+}
+
+func TestSeekToLatest(t *testing.T) {
+  addr := serve(t, func(conn net.Conn) {
+    answerRequests(conn, func(request []byte) []byte {
+      // <NUMBER OF OFFSETS: uint32><OFFSET: uint64>
+      return append(uint32bytes(1), uint64ToUint64bytes(12345)...)
+    })
+  })
+  consumer := NewBrokerConsumer(addr, "test", 0, 0, 1048576)
+  defer consumer.Close()
+  if err := consumer.SeekToLatest(); err != nil {
+    t.Fatal(err)
+  }
+  if consumer.offset != 12345 {
+    t.Fatalf("expected offset 12345 but got: %d", consumer.offset)
+  }
+}
+
+func TestTopicConsumerMergesPartitions(t *testing.T) {
+  addr := serve(t, func(conn net.Conn) {
+    answerRequests(conn, func(request []byte) []byte {
+      // <...><PARTITION: uint32><OFFSET: uint64><MAX SIZE: uint32>
+      partition := binary.BigEndian.Uint32(request[len(request)-16:])
+      if binary.BigEndian.Uint64(request[len(request)-12:]) != 0 {
+        return []byte{}
+      }
+      return NewMessage([]byte(fmt.Sprintf("partition %d", partition))).Encode()
+    })
+  })
+  tc := NewTopicConsumer(addr, "test", 2, 0, 1048576)
+  for _, consumer := range tc.Consumers() {
+    consumer.SetLogger(NopLogger)
+  }
+
+  msgChan := make(chan *Message)
+  quit := make(chan bool)
+  result := make(chan int, 1)
+  go func() { result <- tc.ConsumeOnChannel(msgChan, nil, 10, quit) }()
+
+  seen := map[int]string{}
+  for len(seen) < 2 {
+    msg := <-msgChan
+    seen[msg.Partition()] = msg.PayloadString()
+  }
+  close(quit)
+  for range msgChan {
+  }
+  if seen[0] != "partition 0" || seen[1] != "partition 1" {
+    t.Fatalf("unexpected messages: %v", seen)
+  }
+  if num := <-result; num != 2 {
+    t.Fatalf("expected 2 messages but got: %d", num)
+  }
+}
+
+func TestOnTiming(t *testing.T) {
+  labels := []string{}
+  consumer := NewConsumer(serveFetches(t, NewMessage([]byte("testing")).Encode()), "test", 0, WithMaxSize(1048576),
+    WithOnTiming(func(label string, d time.Duration) {
+      if d <= 0 {
+        t.Errorf("expected a positive duration for %s but got: %v", label, d)
+      }
+      labels = append(labels, label)
+    }))
+  defer consumer.Close()
+  if _, err := consumer.Consume(func(msg *Message) {}); err != nil {
+    t.Fatal(err)
+  }
+  if strings.Join(labels, ",") != "connect,write,read" {
+    t.Fatalf("unexpected timings: %v", labels)
+  }
+}
+
+func TestTimingDuration(t *testing.T) {
+  timing := StartTiming("test")
+  time.Sleep(10 * time.Millisecond)
+  timing.Stop()
+  measured := timing.Duration()
+  if measured < 10*time.Millisecond {
+    t.Fatalf("expected at least 10ms but got: %v", measured)
+  }
+  time.Sleep(10 * time.Millisecond)
+  // stopped, so later calls report the same interval while Elapsed keeps going
+  if timing.Duration() != measured || timing.Elapsed() < measured+10*time.Millisecond {
+    t.Fatalf("unexpected duration: %v, elapsed: %v", timing.Duration(), timing.Elapsed())
+  }
+}
+
+func TestNewConsumerOptions(t *testing.T) {
+  store := NewFileOffsetStore(t.TempDir())
+  consumer := NewConsumer("localhost:9092", "test", 1,
+    WithOffset(100), WithMaxSize(1024), WithLogger(NopLogger), WithReadTimeout(time.Second), WithOffsetStore(store, 10))
+  if consumer.offset != 100 || consumer.maxSize != 1024 || consumer.broker.partition != 1 {
+    t.Fatalf("unexpected position: %d, %d, %d", consumer.offset, consumer.maxSize, consumer.broker.partition)
+  }
+  if consumer.broker.logger != NopLogger || consumer.ReadTimeout != time.Second ||
+    consumer.OffsetStore != store || consumer.CommitInterval != 10 {
+    t.Fatal("expected the options to be applied")
+  }
+}
+
+func TestBrokerEndpointFailover(t *testing.T) {
+  dead, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatal(err)
+  }
+  deadAddr := dead.Addr().String()
+  dead.Close() // nothing listens there any more
+  live := serveFetches(t, NewMessage([]byte("testing")).Encode())
+
+  consumer := NewConsumer(deadAddr+","+live, "test", 0, WithMaxSize(1048576), WithLogger(NopLogger))
+  defer consumer.Close()
+  num, err := consumer.Consume(func(msg *Message) {})
+  if err != nil || num != 1 {
+    t.Fatalf("expected to fail over to the live endpoint but got: %d, %v", num, err)
+  }
+  if endpoints := consumer.broker.endpoints(); endpoints[0] != live || endpoints[1] != deadAddr {
+    t.Fatalf("expected the dead endpoint to be tried last but got: %v", endpoints)
+  }
+}
+
+// Serves every request with the broker's "wrong partition" error code, as one that doesn't lead the partition
+func serveWrongPartition(t *testing.T) string {
+  return serve(t, func(conn net.Conn) {
+    defer conn.Close()
+    size := make([]byte, 4)
+    for {
+      if _, err := io.ReadFull(conn, size); err != nil {
+        return
+      }
+      if _, err := io.ReadFull(conn, make([]byte, binary.BigEndian.Uint32(size))); err != nil {
+        return
+      }
+      if _, err := conn.Write([]byte{0x00, 0x00, 0x00, 0x02, 0x00, 0x03}); err != nil {
+        return
+      }
+    }
+  })
+}
+
+func TestWrongBrokerFailover(t *testing.T) {
+  wrong := serveWrongPartition(t)
+  live := serveLog(t, EncodeMessageSet([]*Message{NewMessage([]byte("testing"))}))
+
+  consumer := NewConsumer(wrong+","+live, "test", 0, WithMaxSize(1048576), WithLogger(NopLogger))
+  defer consumer.Close()
+  quit := make(chan os.Signal, 1)
+  num, _, err := consumer.ConsumeUntilQuit(10, quit, func(msg *Message) { quit <- os.Interrupt })
+  if err != nil || num != 1 {
+    t.Fatalf("expected to move to the endpoint serving the partition but got: %d, %v", num, err)
+  }
+
+  single := NewConsumer(serveWrongPartition(t), "test", 0, WithMaxSize(1048576), WithLogger(NopLogger))
+  defer single.Close()
+  _, _, err = single.ConsumeUntilQuit(10, make(chan os.Signal), func(msg *Message) {})
+  var wrongBroker *WrongBrokerError
+  if !errors.As(err, &wrongBroker) || !errors.Is(err, ErrWrongPartition) || wrongBroker.Topic != "test" {
+    t.Fatalf("expected to stop with a *WrongBrokerError but got: %v", err)
+  }
+}
+
+func TestSetLocalAddr(t *testing.T) {
+  remotes := make(chan net.Addr, 1)
+  address := serve(t, func(conn net.Conn) {
+    remotes <- conn.RemoteAddr()
+    answerFetches(conn, &[][]byte{})
+  })
+  // a port known to be free, to see the connection come from it
+  free, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatal(err)
+  }
+  local := free.Addr().(*net.TCPAddr)
+  free.Close()
+
+  consumer := NewBrokerConsumer(address, "test", 0, 0, 1048576)
+  defer consumer.Close()
+  if err := consumer.SetLocalAddr(local); err != nil {
+    t.Fatal(err)
+  }
+  if _, err := consumer.Consume(func(msg *Message) {}); err != nil && !errors.Is(err, ErrNoMessages) {
+    t.Fatal(err)
+  }
+  if remote := (<-remotes).(*net.TCPAddr); remote.Port != local.Port {
+    t.Fatalf("expected the connection from %s but got: %s", local, remote)
+  }
+
+  if err := consumer.SetLocalAddr(&net.UnixAddr{Name: "not a tcp address"}); err == nil {
+    t.Fatalf("expected an invalid address to be rejected")
+  }
+  // an address not on this host can't be bound to
+  consumer = NewBrokerConsumer(address, "test", 0, 0, 1048576)
+  defer consumer.Close()
+  consumer.SetLogger(NopLogger)
+  if err := consumer.SetLocalAddr(&net.TCPAddr{IP: net.ParseIP("192.0.2.1")}); err != nil {
+    t.Fatal(err)
+  }
+  if _, err := consumer.Consume(func(msg *Message) {}); err == nil || !strings.Contains(err.Error(), "192.0.2.1") {
+    t.Fatalf("expected the bind failure naming the address but got: %v", err)
+  }
+}
+
+func TestTLS(t *testing.T) {
+  // borrow httptest's certificate, valid for 127.0.0.1
+  https := httptest.NewTLSServer(nil)
+  roots := https.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+  serverConfig := &tls.Config{Certificates: https.TLS.Certificates}
+  https.Close()
+  log := NewMessage([]byte("testing")).Encode()
+  addr := serve(t, func(conn net.Conn) {
+    answerRequests(tls.Server(conn, serverConfig), func(request []byte) []byte { return log })
+  })
+
+  consumer := NewConsumer(addr, "test", 0, WithMaxSize(1048576), WithTLS(&tls.Config{RootCAs: roots}))
+  defer consumer.Close()
+  if num, err := consumer.Consume(func(msg *Message) {}); err != nil || num != 1 {
+    t.Fatalf("expected to consume over TLS but got: %d, %v", num, err)
+  }
+
+  untrusted := NewConsumer(addr, "test", 0, WithLogger(NopLogger), WithTLS(&tls.Config{}))
+  defer untrusted.Close()
+  if _, err := untrusted.Consume(func(msg *Message) {}); err == nil || !strings.Contains(err.Error(), "TLS handshake") {
+    t.Fatalf("expected the handshake to fail on an unknown certificate authority but got: %v", err)
+  }
+  untrusted.SetTLS(&tls.Config{InsecureSkipVerify: true})
+  if num, err := untrusted.Consume(func(msg *Message) {}); err != nil || num != 1 {
+    t.Fatalf("expected to consume skipping verification but got: %d, %v", num, err)
+  }
+}
+
+func TestFakeBroker(t *testing.T) {
+  broker, err := NewFakeBroker()
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer broker.Close()
+  broker.Append(NewMessage([]byte("one")), NewMessage([]byte("two")))
+
+  // in memory, through Dial
+  consumer := NewConsumer("fake", "test", 0, WithMaxSize(1048576), WithDialer(broker.Dial), WithLogger(NopLogger))
+  defer consumer.Close()
+  if num, err := consumer.Consume(func(msg *Message) {}); err != nil || num != 2 {
+    t.Fatalf("expected 2 messages but got: %d, %v", num, err)
+  }
+  if offsets, err := consumer.GetOffsets(-1, 1); err != nil || len(offsets) != 1 || offsets[0] != consumer.Offset() {
+    t.Fatalf("expected the end of the log but got: %v, %v", offsets, err)
+  }
+
+  broker.RespondWithError(1)
+  if _, err := consumer.Consume(func(msg *Message) {}); !errors.Is(err, ErrOffsetOutOfRange) {
+    t.Fatalf("expected the scripted error but got: %v", err)
+  }
+  broker.RespondWithFrame([]byte{0x00, 0x00, 0x00, 0x10, 0x00, 0x00})
+  if _, err := consumer.Consume(func(msg *Message) {}); !errors.Is(err, io.ErrUnexpectedEOF) {
+    t.Fatalf("expected a frame cut short but got: %v", err)
+  }
+
+  // over TCP, with what's published
+  publisher := NewBrokerPublisher(broker.Addr(), "test", 0)
+  if _, err := publisher.Publish(NewMessage([]byte("three"))); err != nil {
+    t.Fatal(err)
+  }
+  // produce requests get no response, so it may take a fetch or two to show
+  var payload string
+  for deadline := time.Now().Add(time.Second); payload == "" && time.Now().Before(deadline); {
+    consumer.Consume(func(msg *Message) { payload = msg.PayloadString() })
+  }
+  if payload != "three" {
+    t.Fatalf("expected the published message but got: %q", payload)
+  }
+  if requests := broker.Requests(); requests[0] != REQUEST_FETCH || requests[1] != REQUEST_OFFSETS {
+    t.Fatalf("unexpected requests: %v", requests)
+  }
+}
+
+func TestChecksumTable(t *testing.T) {
+  broker, err := NewFakeBroker()
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer broker.Close()
+  castagnoli := crc32.MakeTable(crc32.Castagnoli)
+
+  publisher := NewBrokerPublisher("fake", "test", 0)
+  publisher.SetDialer(broker.Dial)
+  publisher.SetChecksumTable(castagnoli)
+  publisher.SetCompression(DefaultCodecsMap[GZIP_COMPRESSION_ID])
+  defer publisher.Close()
+  if _, err := publisher.BatchPublish(NewKeyedMessage(nil, []byte("one")), NewKeyedMessage([]byte("k"), []byte("two"))); err != nil {
+    t.Fatal(err)
+  }
+
+  consumer := NewConsumer("fake", "test", 0, WithMaxSize(1048576), WithDialer(broker.Dial), WithLogger(NopLogger),
+    WithChecksumTable(castagnoli))
+  defer consumer.Close()
+  consumer.KeyedPayloads = true
+  payloads := []string{}
+  // produce requests get no response, so it may take a fetch or two to show
+  for deadline := time.Now().Add(time.Second); len(payloads) == 0 && time.Now().Before(deadline); {
+    consumer.Consume(func(msg *Message) { payloads = append(payloads, msg.PayloadString()) })
+  }
+  if len(payloads) != 2 || payloads[0] != "one" || payloads[1] != "two" {
+    t.Fatalf("expected both messages but got: %q", payloads)
+  }
+
+  ieee := NewConsumer("fake", "test", 0, WithMaxSize(1048576), WithDialer(broker.Dial), WithLogger(NopLogger))
+  defer ieee.Close()
+  if _, err := ieee.Consume(func(msg *Message) {}); !errors.Is(err, ErrChecksumMismatch) {
+    t.Fatalf("expected a checksum mismatch with IEEE but got: %v", err)
+  }
+}
+
+func TestShortResponses(t *testing.T) {
+  broker, err := NewFakeBroker()
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer broker.Close()
+  // <LENGTH: uint32> then length bytes, of which the first two are the error code
+  frame := func(length uint32) []byte {
+    return append(uint32bytes(int(length)), make([]byte, length)...)
+  }
+
+  for length, expected := range map[uint32]error{0: nil, 1: nil, 2: ErrNoMessages, 3: ErrMessageTooLarge} {
+    consumer := NewConsumer("fake", "test", 0, WithMaxSize(1048576), WithDialer(broker.Dial), WithLogger(NopLogger))
+    broker.RespondWithFrame(frame(length))
+    num, err := consumer.Consume(func(msg *Message) {})
+    if num > 0 || err == nil || (expected != nil && !errors.Is(err, expected)) {
+      t.Fatalf("unexpected result for a fetch response of length %d: %d, %v", length, num, err)
+    }
+    consumer.Close()
+  }
+
+  for length := uint32(0); length < 4; length++ {
+    consumer := NewConsumer("fake", "test", 0, WithDialer(broker.Dial), WithLogger(NopLogger))
+    broker.RespondWithFrame(frame(length))
+    offsets, err := consumer.GetOffsets(-1, 1)
+    if length == 2 {
+      // no offsets at all
+      if err != nil || len(offsets) != 0 {
+        t.Fatalf("expected no offsets for a response of length 2 but got: %v, %v", offsets, err)
+      }
+    } else if err == nil {
+      t.Fatalf("expected an error for an offsets response of length %d but got: %v", length, offsets)
+    }
+    consumer.Close()
+  }
+}
+
+func TestMaxResponseBytes(t *testing.T) {
+  broker, err := NewFakeBroker()
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer broker.Close()
+  broker.Append(NewMessage(bytes.Repeat([]byte("x"), 200)))
+
+  consumer := NewConsumer("fake", "test", 0, WithMaxSize(1024), WithDialer(broker.Dial), WithLogger(NopLogger))
+  defer consumer.Close()
+  // a declared length far past the default cap (a multiple of maxSize) is refused, not allocated
+  broker.RespondWithFrame([]byte{0xff, 0xff, 0xff, 0xf0, 0x00, 0x00})
+  if _, err := consumer.Consume(func(msg *Message) {}); err == nil || !strings.Contains(err.Error(), "exceeds the limit") {
+    t.Fatalf("expected the response to be refused but got: %v", err)
+  }
+
+  consumer.SetMaxResponseBytes(100)
+  if _, err := consumer.Consume(func(msg *Message) {}); err == nil || !strings.Contains(err.Error(), "exceeds the limit of 100 bytes") {
+    t.Fatalf("expected the configured cap to refuse the message but got: %v", err)
+  }
+  consumer.SetMaxResponseBytes(0)
+  if num, err := consumer.Consume(func(msg *Message) {}); err != nil || num != 1 {
+    t.Fatalf("expected the default cap to let the message through but got: %d, %v", num, err)
+  }
+}
+
+func TestConnectError(t *testing.T) {
+  dead, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatal(err)
+  }
+  deadAddr := dead.Addr().String()
+  dead.Close()
+
+  consumer := NewConsumer(deadAddr, "test", 3, WithLogger(NopLogger))
+  defer consumer.Close()
+  _, err = consumer.Consume(func(msg *Message) {})
+  var connectErr *ConnectError
+  if !errors.As(err, &connectErr) || connectErr.Endpoint != deadAddr || connectErr.Topic != "test" || connectErr.Partition != 3 {
+    t.Fatalf("expected a *ConnectError for %s but got: %#v", deadAddr, err)
+  }
+  var opErr *net.OpError
+  if !errors.As(err, &opErr) || !strings.Contains(err.Error(), deadAddr+" for test:3") {
+    t.Fatalf("expected the dial's *net.OpError, and the endpoint in the message, but got: %v", err)
+  }
+
+  both := NewConsumer(deadAddr+","+deadAddr, "test", 3, WithLogger(NopLogger))
+  defer both.Close()
+  if _, err = both.Consume(func(msg *Message) {}); !errors.As(err, &connectErr) || connectErr.Tried != 2 {
+    t.Fatalf("expected a *ConnectError after trying both endpoints but got: %v", err)
+  }
+}
+
+func TestLatestConsumer(t *testing.T) {
+  broker, err := NewFakeBroker()
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer broker.Close()
+  broker.Append(NewMessage([]byte("one")), NewMessage([]byte("two")))
+
+  consumer := NewBrokerLatestConsumer("fake", "test", 0)
+  consumer.SetDialer(broker.Dial)
+  consumer.SetLogger(NopLogger)
+  defer consumer.Close()
+  if requests := broker.Requests(); len(requests) != 0 {
+    t.Fatalf("expected no requests before consuming but got: %v", requests)
+  }
+  broker.Append(NewMessage([]byte("three")))
+  payloads := []string{}
+  consumer.Consume(func(msg *Message) { payloads = append(payloads, msg.PayloadString()) })
+  if len(payloads) != 0 {
+    t.Fatalf("expected only new messages but got: %q", payloads)
+  }
+  broker.Append(NewMessage([]byte("four")))
+  consumer.Consume(func(msg *Message) { payloads = append(payloads, msg.PayloadString()) })
+  if len(payloads) != 1 || payloads[0] != "four" {
+    t.Fatalf("expected the message published after the first fetch but got: %q", payloads)
+  }
+
+  // a failed lookup falls back to the start
+  fallback := NewBrokerLatestConsumer("fake", "test", 0)
+  fallback.SetDialer(broker.Dial)
+  fallback.SetLogger(NopLogger)
+  defer fallback.Close()
+  broker.RespondWithError(1)
+  if num, err := fallback.Consume(func(msg *Message) {}); err != nil || num != 4 {
+    t.Fatalf("expected all 4 messages but got: %d, %v", num, err)
+  }
+}
+
+func TestMirror(t *testing.T) {
+  src, err := NewFakeBroker()
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer src.Close()
+  dst, err := NewFakeBroker()
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer dst.Close()
+  msgs := []*Message{NewMessage([]byte("one")), NewMessage([]byte("two")), NewMessage([]byte("three"))}
+  src.Append(msgs...)
+  store := NewFileOffsetStore(t.TempDir())
+  newSource := func() *BrokerConsumer {
+    return NewConsumer("src", "test", 0, WithMaxSize(1048576), WithDialer(src.Dial), WithLogger(NopLogger),
+      WithOffsetStore(store, 1))
+  }
+
+  // publishing fails, so nothing may be committed
+  down := NewBrokerPublisher("dst", "test", 0)
+  down.SetDialer(func(network, addr string) (net.Conn, error) { return nil, errors.New("destination down") })
+  down.SetLogger(NopLogger)
+  source := newSource()
+  if err := Mirror(source, down); err == nil {
+    t.Fatal("expected the publish failure")
+  }
+  source.Close()
+  if offset, err := store.Load("test", 0); !errors.Is(err, ErrNoCommittedOffset) {
+    t.Fatalf("expected nothing committed but got: %d, %v", offset, err)
+  }
+
+  publisher := NewBrokerPublisher("dst", "test", 0)
+  publisher.SetDialer(dst.Dial)
+  defer publisher.Close()
+  source = newSource()
+  done := make(chan error, 1)
+  go func() { done <- Mirror(source, publisher) }()
+
+  reader := NewConsumer("dst", "test", 0, WithMaxSize(1048576), WithDialer(dst.Dial), WithLogger(NopLogger))
+  defer reader.Close()
+  payloads := []string{}
+  for deadline := time.Now().Add(time.Second); len(payloads) < len(msgs) && time.Now().Before(deadline); {
+    reader.Consume(func(msg *Message) { payloads = append(payloads, msg.PayloadString()) })
+  }
+  source.Close()
+  if err := <-done; err != nil {
+    t.Fatalf("expected Mirror to stop cleanly on Close but got: %v", err)
+  }
+  if strings.Join(payloads, ",") != "one,two,three" {
+    t.Fatalf("expected the messages mirrored but got: %q", payloads)
+  }
+  if offset, err := store.Load("test", 0); err != nil || offset != uint64(len(EncodeMessageSet(msgs))) {
+    t.Fatalf("expected all of the source committed but got: %d, %v", offset, err)
+  }
+}
+
+func TestLag(t *testing.T) {
+  broker, err := NewFakeBroker()
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer broker.Close()
+  broker.Append(NewMessage([]byte("one")), NewMessage([]byte("two")))
+  consumer := NewConsumer("fake", "test", 0, WithMaxSize(1048576), WithDialer(broker.Dial))
+  defer consumer.Close()
+
+  if lag, err := consumer.Lag(); err != nil || lag != uint64(2*NewMessage([]byte("one")).Size()) {
+    t.Fatalf("expected the whole log behind but got: %d, %v", lag, err)
+  }
+  consumer.Consume(func(msg *Message) {})
+  if lag, err := consumer.Lag(); err != nil || lag != 0 {
+    t.Fatalf("expected no lag once caught up but got: %d, %v", lag, err)
+  }
+  broker.SetOffsets(1) // a latest offset behind the consumer's
+  if lag, err := consumer.Lag(); err != nil || lag != 0 {
+    t.Fatalf("expected no lag rather than an underflow but got: %d, %v", lag, err)
+  }
+}
+
+func TestBatchReader(t *testing.T) {
+  first := EncodeMessageSet([]*Message{NewMessage([]byte("one")), NewMessage([]byte("two"))})
+  second := EncodeMessageSet([]*Message{NewMessage([]byte("three"))})
+  consumer := NewBrokerConsumer(serveFetches(t, first, first, second), "test", 0, 0, 1048576)
+  defer consumer.Close()
+  store := NewFileOffsetStore(t.TempDir())
+  consumer.OffsetStore = store
+  reader := consumer.NewBatchReader()
+  defer reader.Close()
+
+  msgs, base, err := reader.NextBatch()
+  if err != nil || base != 0 || len(msgs) != 2 || msgs[1].PayloadString() != "two" {
+    t.Fatalf("expected the first fetch as a batch but got: %v, %d, %v", msgs, base, err)
+  }
+  if consumer.Offset() != 0 {
+    t.Fatalf("expected the offset to wait for CommitBatch but got: %d", consumer.Offset())
+  }
+
+  // not committed, so the same batch comes back
+  msgs, base, err = reader.NextBatch()
+  if err != nil || base != 0 || len(msgs) != 2 {
+    t.Fatalf("expected the first batch again but got: %v, %d, %v", msgs, base, err)
+  }
+  // reading a batch, however often, neither commits nor counts it
+  if offset, err := store.Load("test", 0); !errors.Is(err, ErrNoCommittedOffset) || consumer.Stats().Consumed != 0 {
+    t.Fatalf("expected nothing committed before CommitBatch but got: %d, %v, %d consumed", offset, err, consumer.Stats().Consumed)
+  }
+  if err := reader.CommitBatch(); err != nil {
+    t.Fatal(err)
+  }
+  if consumer.Offset() != uint64(len(first)) {
+    t.Fatalf("expected the offset past the batch but got: %d", consumer.Offset())
+  }
+  if offset, err := store.Load("test", 0); err != nil || offset != uint64(len(first)) || consumer.Stats().Consumed != 2 {
+    t.Fatalf("expected the batch committed but got: %d, %v, %d consumed", offset, err, consumer.Stats().Consumed)
+  }
+  reader.CommitBatch()
+  if consumer.Offset() != uint64(len(first)) {
+    t.Fatalf("expected a second CommitBatch to do nothing but got offset: %d", consumer.Offset())
+  }
+
+  msgs, base, err = reader.NextBatch()
+  if err != nil || base != uint64(len(first)) || len(msgs) != 1 || msgs[0].PayloadString() != "three" {
+    t.Fatalf("expected the second fetch as a batch but got: %v, %d, %v", msgs, base, err)
+  }
+}
+
+func TestLagHooks(t *testing.T) {
+  broker, err := NewFakeBroker()
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer broker.Close()
+  size := NewMessage([]byte("message")).Size()
+  for i := 0; i < 5; i++ {
+    broker.Append(NewMessage([]byte("message")))
+  }
+
+  // one message per fetch, so the lag drops by one message per poll
+  consumer := NewConsumer("fake", "test", 0, WithMaxSize(uint32(size)), WithDialer(broker.Dial), WithLogger(NopLogger))
+  defer consumer.Close()
+  consumer.LagThreshold = uint64(size)
+  consumer.LagCheckInterval = time.Nanosecond
+  quit := make(chan os.Signal, 1)
+  var events []string
+  consumer.OnLagExceeded = func(lag uint64) { events = append(events, fmt.Sprintf("exceeded %d", lag/uint64(size))) }
+  consumer.OnLagRecovered = func(lag uint64) {
+    events = append(events, fmt.Sprintf("recovered %d", lag/uint64(size)))
+    quit <- os.Interrupt
+  }
+  polls := 0
+  consumer.OnPoll = func(fetched int, offset uint64, err error) {
+    if polls++; polls == 50 {
+      quit <- os.Interrupt
+    }
+  }
+  consumer.ConsumeUntilQuit(5, quit, func(msg *Message) {})
+
+  // once each way, not on every poll above the threshold
+  if strings.Join(events, ", ") != "exceeded 4, recovered 1" {
+    t.Fatalf("expected the lag to be exceeded then recover but got: %v", events)
+  }
+}
+
+func TestPrefetchDiscardedAfterSeek(t *testing.T) {
+  messages := []*Message{NewMessage([]byte("one")), NewMessage([]byte("two")), NewMessage([]byte("six")), NewMessage([]byte("ten"))}
+  log := EncodeMessageSet(messages)
+  two := uint64(messages[0].Size() + messages[1].Size())
+  prefetched := make(chan bool, 10)
+  address := serve(t, func(conn net.Conn) {
+    answerRequests(conn, func(request []byte) []byte {
+      fetch, err := DecodeConsumeRequest(append(uint32bytes(len(request)), request...))
+      if err != nil || fetch.Offset > uint64(len(log)) {
+        return []byte{}
+      }
+      if fetch.Offset == two {
+        prefetched <- true
+      }
+      end := fetch.Offset + uint64(fetch.MaxSize)
+      if end > uint64(len(log)) {
+        end = uint64(len(log))
+      }
+      return log[fetch.Offset:end]
+    })
+  })
+
+  // two messages per fetch
+  consumer := NewBrokerConsumer(address, "test", 0, 0, uint32(two))
+  defer consumer.Close()
+  consumer.Prefetch = true
+  reader := consumer.NewBatchReader()
+  defer reader.Close()
+  payloads := func(msgs []*Message) string {
+    var out []string
+    for _, msg := range msgs {
+      out = append(out, msg.PayloadString())
+    }
+    return strings.Join(out, ",")
+  }
+
+  msgs, _, err := reader.NextBatch()
+  if err != nil || payloads(msgs) != "one,two" {
+    t.Fatalf("expected the first two messages but got: %v, %v", payloads(msgs), err)
+  }
+  reader.CommitBatch()
+  select {
+  case <-prefetched:
+  case <-time.After(time.Second):
+    t.Fatalf("expected the next fetch to be issued ahead of time")
+  }
+
+  // the prefetch of six and ten is stale once the offset moves back
+  consumer.Seek(0)
+  msgs, base, err := reader.NextBatch()
+  if err != nil || base != 0 || payloads(msgs) != "one,two" {
+    t.Fatalf("expected the messages at the seek offset but got: %v at %d, %v", payloads(msgs), base, err)
+  }
+  reader.CommitBatch()
+  msgs, _, err = reader.NextBatch()
+  if err != nil || payloads(msgs) != "six,ten" {
+    t.Fatalf("expected the last two messages but got: %v, %v", payloads(msgs), err)
+  }
+}
+
+func TestConsumeIter(t *testing.T) {
+  broker, err := NewFakeBroker()
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer broker.Close()
+  first := NewMessage([]byte("one"))
+  broker.Append(first, NewMessage([]byte("two")), NewMessage([]byte("three")))
+  consumer := NewConsumer("fake", "test", 0, WithMaxSize(1048576), WithDialer(broker.Dial), WithLogger(NopLogger))
+  defer consumer.Close()
+
+  // breaking out resumes after the last message handed out
+  iter := consumer.ConsumeIter()
+  if !iter.Next() || iter.Message().PayloadString() != "one" {
+    t.Fatalf("expected the first message but got: %v", iter.Err())
+  }
+  iter.Close()
+  if consumer.Offset() != uint64(first.Size()) {
+    t.Fatalf("expected offset: %d but got: %d", first.Size(), consumer.Offset())
+  }
+
+  iter = consumer.ConsumeIter()
+  defer iter.Close()
+  payloads := []string{}
+  for iter.Next() {
+    payloads = append(payloads, iter.Message().PayloadString())
+  }
+  if iter.Err() != nil || strings.Join(payloads, ",") != "two,three" || iter.Message() != nil {
+    t.Fatalf("unexpected iteration: %v, %v", payloads, iter.Err())
+  }
+
+  // later messages are picked up by calling Next again
+  broker.Append(NewMessage([]byte("four")))
+  if !iter.Next() || iter.Message().PayloadString() != "four" {
+    t.Fatalf("expected the new message but got: %v", iter.Err())
+  }
+  broker.RespondWithError(1)
+  if iter.Next() || !errors.Is(iter.Err(), ErrOffsetOutOfRange) || iter.Next() {
+    t.Fatalf("expected to stop on the fetch error but got: %v", iter.Err())
+  }
+}
+
+func TestConsumeIterCommitsHandedOut(t *testing.T) {
+  first, second := NewMessage([]byte("one")), NewMessage([]byte("two"))
+  log := EncodeMessageSet([]*Message{first, second})
+  consumer := NewBrokerConsumer(serveLog(t, log), "test", 0, 0, 1048576)
+  defer consumer.Close()
+  store := NewFileOffsetStore(t.TempDir())
+  consumer.OffsetStore = store
+  stored := func() uint64 {
+    offset, err := store.Load("test", 0)
+    if errors.Is(err, ErrNoCommittedOffset) {
+      return 0
+    }
+    if err != nil {
+      t.Fatal(err)
+    }
+    return offset
+  }
+
+  iter := consumer.ConsumeIter()
+  defer iter.Close()
+  // a message in hand isn't committed until Next moves past it
+  if !iter.Next() || stored() != 0 {
+    t.Fatalf("expected nothing committed with the first message in hand but got: %d, %v", stored(), iter.Err())
+  }
+  if !iter.Next() || stored() != uint64(first.Size()) {
+    t.Fatalf("expected the first message committed but got: %d, %v", stored(), iter.Err())
+  }
+  if iter.Next() || iter.Err() != nil || stored() != uint64(len(log)) {
+    t.Fatalf("expected both messages committed but got: %d, %v", stored(), iter.Err())
+  }
+}
+
+func TestSkipInitialAfterSeek(t *testing.T) {
+  first := NewMessage([]byte("one"))
+  log := EncodeMessageSet([]*Message{first, NewMessage([]byte("two")), NewMessage([]byte("three")), NewMessage([]byte("four"))})
+  consumer := NewBrokerConsumer(serveLog(t, log), "test", 0, 0, 1048576)
+  defer consumer.Close()
+  consumer.SkipInitial = 2
+
+  // only applies after a Seek
+  var payloads []string
+  collect := func(msg *Message) { payloads = append(payloads, msg.PayloadString()) }
+  if num, err := consumer.Consume(collect); err != nil || num != 4 {
+    t.Fatalf("expected all 4 messages without a seek but got: %d, %v", num, err)
+  }
+
+  payloads = nil
+  consumer.Seek(uint64(first.Size()))
+  if _, err := consumer.Consume(collect); err != nil {
+    t.Fatal(err)
+  }
+  if len(payloads) != 1 || payloads[0] != "four" {
+    t.Fatalf("expected two and three to be skipped but got: %v", payloads)
+  }
+  if stats := consumer.Stats(); stats.SkippedInitial != 2 {
+    t.Fatalf("expected 2 skipped initial messages but got: %d", stats.SkippedInitial)
+  }
+  if consumer.Offset() != uint64(len(log)) {
+    t.Fatalf("expected the skipped messages to be consumed past but got offset: %d", consumer.Offset())
+  }
+}
+
+func TestSampleRate(t *testing.T) {
+  messages := make([]*Message, 200)
+  for i := range messages {
+    messages[i] = NewMessage([]byte(fmt.Sprintf("message %d", i)))
+  }
+  log := EncodeMessageSet(messages)
+  address := serveLog(t, log)
+  sample := func(seed int64) []string {
+    consumer := NewBrokerConsumer(address, "test", 0, 0, 1048576)
+    defer consumer.Close()
+    consumer.SampleRate = 0.25
+    consumer.SampleSeed = seed
+    var payloads []string
+    if _, err := consumer.Consume(func(msg *Message) { payloads = append(payloads, msg.PayloadString()) }); err != nil {
+      t.Fatal(err)
+    }
+    stats := consumer.Stats()
+    if stats.Sampled != uint64(len(payloads)) || stats.Sampled+stats.SampledOut != 200 {
+      t.Fatalf("expected sampled and skipped to add up to 200 but got: %d, %d", stats.Sampled, stats.SampledOut)
+    }
+    if consumer.Offset() != uint64(len(log)) {
+      t.Fatalf("expected the offset to advance over every message but got: %d", consumer.Offset())
+    }
+    return payloads
+  }
+
+  payloads := sample(42)
+  if len(payloads) < 25 || len(payloads) > 75 {
+    t.Fatalf("expected about a quarter of 200 messages but got: %d", len(payloads))
+  }
+  if again := sample(42); strings.Join(again, ",") != strings.Join(payloads, ",") {
+    t.Fatalf("expected the same seed to sample the same messages but got: %v and %v", payloads, again)
+  }
+}
+
+func TestRekey(t *testing.T) {
+  log := EncodeMessageSet([]*Message{NewMessage([]byte("a")), NewMessage([]byte("bb")), NewMessage([]byte("ccc"))})
+  consumer := NewBrokerConsumer(serveLog(t, log), "test", 2, 0, 1048576)
+  defer consumer.Close()
+
+  rekey := Rekey(func(msg *Message) int { return len(msg.Payload()) % 2 })
+  var targets []int
+  if _, err := consumer.Consume(func(msg *Message) {
+    if msg.TargetPartition() != 2 {
+      t.Fatalf("expected the source partition before rekeying but got: %d", msg.TargetPartition())
+    }
+    rekey(msg)
+    targets = append(targets, msg.TargetPartition())
+    if msg.Partition() != 2 {
+      t.Fatalf("expected the source partition to stay but got: %d", msg.Partition())
+    }
+  }); err != nil {
+    t.Fatal(err)
+  }
+  if len(targets) != 3 || targets[0] != 1 || targets[1] != 0 || targets[2] != 1 {
+    t.Fatalf("expected target partitions 1, 0, 1 but got: %v", targets)
+  }
+}
+
+func TestMessageSize(t *testing.T) {
+  msg := NewMessage([]byte("testing"))
+  encoded := msg.Encode()
+  if msg.Size() != len(encoded) {
+    t.Fatalf("expected size: %d but got: %d", len(encoded), msg.Size())
+  }
+  _, msgsDecoded := DecodeWithDefaultCodecs(encoded)
+  if msgsDecoded[0].Size() != len(encoded) {
+    t.Fatalf("expected decoded size: %d but got: %d", len(encoded), msgsDecoded[0].Size())
+  }
+}
+
+func TestFetchAt(t *testing.T) {
+  first := NewMessage([]byte("one"))
+  log := EncodeMessageSet([]*Message{first, NewMessage([]byte("two")), NewMessage([]byte("three"))})
+  consumer := NewBrokerConsumer(serveLog(t, log), "test", 0, 0, 1048576)
+  defer consumer.Close()
+
+  msgs, err := consumer.FetchAt(uint64(first.Size()), 1048576)
+  if err != nil || len(msgs) != 2 || msgs[0].PayloadString() != "two" || msgs[0].Offset() != uint64(first.Size()) {
+    t.Fatalf("expected the messages after the first but got: %v, %v", msgs, err)
+  }
+  if _, err := consumer.FetchAt(0, 4); !errors.Is(err, ErrMessageTooLarge) {
+    t.Fatalf("expected ErrMessageTooLarge but got: %v", err)
+  }
+  if msgs, err := consumer.FetchAt(uint64(len(log)), 1048576); err != nil || len(msgs) != 0 {
+    t.Fatalf("expected nothing at the end but got: %v, %v", msgs, err)
+  }
+  if consumer.Offset() != 0 || consumer.Stats().MaxSize != 1048576 {
+    t.Fatalf("expected the consumer's state untouched but got offset: %d, maxSize: %d", consumer.Offset(), consumer.Stats().MaxSize)
+  }
+}
+
+func TestAvgMessageSize(t *testing.T) {
+  small, large := NewMessage([]byte("a")), NewMessage([]byte("abcdefghijk"))
+  log := EncodeMessageSet([]*Message{small, large, small, large})
+  // a fetch holds one message at most, so sampling takes several
+  consumer := NewBrokerConsumer(serveLog(t, log), "test", 0, 0, uint32(large.Size()))
+  defer consumer.Close()
+
+  avg, err := consumer.AvgMessageSize(2)
+  if err != nil || avg != float64(small.Size()+large.Size())/2 {
+    t.Fatalf("expected the average of the first two messages but got: %v, %v", avg, err)
+  }
+  avg, err = consumer.AvgMessageSize(10)
+  if err == nil || !strings.Contains(err.Error(), "only 4 of 10") || avg != float64(small.Size()+large.Size())/2 {
+    t.Fatalf("expected the average of the 4 available with an error but got: %v, %v", avg, err)
+  }
+  if consumer.Offset() != 0 {
+    t.Fatalf("expected the consumer's offset untouched but got: %d", consumer.Offset())
+  }
+  consumer.Seek(uint64(len(log)))
+  if _, err := consumer.AvgMessageSize(1); err == nil {
+    t.Fatalf("expected an error with nothing to measure")
+  }
+}
+
+func TestFetchOne(t *testing.T) {
+  first := NewMessage([]byte("one"))
+  log := EncodeMessageSet([]*Message{first, NewMessage([]byte("two"))})
+  consumer := NewBrokerConsumer(serveLog(t, log), "test", 0, 0, 1048576)
+  defer consumer.Close()
+
+  msg, err := consumer.FetchOne(uint64(first.Size()))
+  if err != nil || msg.PayloadString() != "two" || msg.Offset() != uint64(first.Size()) {
+    t.Fatalf("expected the second message but got: %v, %v", msg, err)
+  }
+  if _, err := consumer.FetchOne(2); err == nil {
+    t.Fatalf("expected an error for an offset in the middle of a message")
+  }
+  if _, err := consumer.FetchOne(uint64(len(log))); err == nil {
+    t.Fatalf("expected an error for an offset with no message")
+  }
+  if consumer.Offset() != 0 {
+    t.Fatalf("expected the consumer's offset untouched but got: %d", consumer.Offset())
+  }
+}
+
+func TestPeekDoesNotAdvance(t *testing.T) {
+  log := EncodeMessageSet([]*Message{NewMessage([]byte("one")), NewMessage([]byte("two")), NewMessage([]byte("three"))})
+  consumer := NewBrokerConsumer(serveLog(t, log), "test", 0, 0, 1048576)
+  defer consumer.Close()
+
+  for i := 0; i < 2; i++ {
+    msgs, err := consumer.Peek(2)
+    if err != nil || len(msgs) != 2 || msgs[0].PayloadString() != "one" || msgs[1].PayloadString() != "two" {
+      t.Fatalf("unexpected peek of %d messages: %v", len(msgs), err)
+    }
+    if consumer.offset != 0 {
+      t.Fatalf("expected the offset to stay at 0 but got: %d", consumer.offset)
+    }
+  }
+  if num, err := consumer.Consume(func(msg *Message) {}); err != nil || num != 3 {
+    t.Fatalf("expected to consume all 3 messages after peeking but got: %d, %v", num, err)
+  }
+
+  for _, maxMessages := range []int{0, -1} {
+    if msgs, err := consumer.Peek(maxMessages); err == nil {
+      t.Fatalf("expected Peek(%d) to fail but got: %v", maxMessages, msgs)
+    }
+  }
+}
+
+func TestJSONHandlerFunc(t *testing.T) {
+  valid := NewMessage([]byte(`{"name": "testing"}`))
+  invalid := NewMessage([]byte(`{"name": `))
+  invalid.offset = 42
+  consumer := NewBrokerConsumer("127.0.0.1:1", "test", 0, 0, 1048576)
+  defer consumer.Close()
+
+  var names []interface{}
+  handler := func(v map[string]interface{}) { names = append(names, v["name"]) }
+  if err := consumer.JSONHandlerFunc(handler, JSON_FAIL)(valid); err != nil || len(names) != 1 || names[0] != "testing" {
+    t.Fatalf("unexpected decode: %v, %v", names, err)
+  }
+  err := consumer.JSONHandlerFunc(handler, JSON_FAIL)(invalid)
+  if err == nil || !strings.Contains(err.Error(), "offset 42") {
+    t.Fatalf("expected an error naming the offset but got: %v", err)
+  }
+
+  // the skip is logged through the consumer's logger, not DefaultLogger
+  defaultLogger, skipLogger := &recordingLogger{}, &recordingLogger{}
+  DefaultLogger = defaultLogger
+  defer func() { DefaultLogger = stdLogger{} }()
+  consumer.SetLogger(skipLogger)
+  if err = consumer.JSONHandlerFunc(handler, JSON_SKIP)(invalid); err != nil || len(names) != 1 {
+    t.Fatalf("expected the invalid message to be skipped but got: %v", err)
+  }
+  if len(skipLogger.lines) != 1 || !strings.HasPrefix(skipLogger.lines[0], "WARN:") || len(defaultLogger.lines) != 0 {
+    t.Fatalf("expected the skip logged through the consumer's logger but got: %v and %v", skipLogger.lines, defaultLogger.lines)
+  }
+}
+
+func TestWarmUp(t *testing.T) {
+  small := NewMessage([]byte("testing"))
+  large := NewMessage(bytes.Repeat([]byte("x"), 512))
+  log := EncodeMessageSet([]*Message{small, large, small})
+  largeFrame := uint32(len(large.Encode()))
+  address := serveLog(t, log)
+
+  warmUp := func(autoAdjust bool) *BrokerConsumer {
+    logger := &recordingLogger{}
+    consumer := NewConsumer(address, "test", 0, WithMaxSize(256), WithLogger(logger))
+    consumer.WarmUpAutoAdjust = autoAdjust
+    maxObserved, err := consumer.WarmUp()
+    if err != nil || maxObserved != largeFrame {
+      t.Fatalf("expected the largest frame (%d bytes) to be observed but got: %d, %v", largeFrame, maxObserved, err)
+    }
+    if len(logger.lines) != 1 || !strings.Contains(logger.lines[0], "smaller than the largest message observed") {
+      t.Fatalf("expected a warning about maxSize but got: %v", logger.lines)
+    }
+    if consumer.Offset() != 0 {
+      t.Fatalf("expected WarmUp to leave the offset alone but got: %d", consumer.Offset())
+    }
+    return consumer
+  }
+
+  consumer := warmUp(false)
+  if maxSize := consumer.Stats().MaxSize; maxSize != 256 {
+    t.Fatalf("expected maxSize to stay at 256 without WarmUpAutoAdjust but got: %d", maxSize)
+  }
+  consumer.Close()
+
+  consumer = warmUp(true)
+  defer consumer.Close()
+  if maxSize := consumer.Stats().MaxSize; maxSize != largeFrame {
+    t.Fatalf("expected WarmUpAutoAdjust to raise maxSize to %d but got: %d", largeFrame, maxSize)
+  }
+  // each fetch now holds the large message, where before it never fit
+  consumed := 0
+  for i := 0; i < 3 && consumed < 3; i++ {
+    num, err := consumer.Consume(func(msg *Message) {})
+    if err != nil || num == 0 {
+      t.Fatalf("expected progress after adjusting but got: %d, %v", num, err)
+    }
+    consumed += num
+  }
+  if consumed != 3 {
+    t.Fatalf("expected all 3 messages after adjusting but got: %d", consumed)
+  }
+}
@@ -0,0 +1,49 @@
+/*
+ *  Copyright (c) 2011 NeuStar, Inc.
+ *  All rights reserved.  
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at 
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *  
+ *  NeuStar, the Neustar logo and related names and logos are registered
+ *  trademarks, service marks or tradenames of NeuStar, Inc. All other 
+ *  product names, company names, marks, logos and symbols may be trademarks
+ *  of their respective owners.
+ */
+
+package kafka
+
+import (
+  "log"
+)
+
+// Where brokers, consumers and publishers write their errors and warnings
+type Logger interface {
+  Printf(format string, args ...interface{})
+}
+
+type stdLogger struct{}
+
+func (stdLogger) Printf(format string, args ...interface{}) {
+  log.Printf(format, args...)
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Printf(format string, args ...interface{}) {}
+
+var (
+  // writes to the standard log package, used unless a logger is set with SetLogger
+  DefaultLogger Logger = stdLogger{}
+  // discards everything, for quiet operation
+  NopLogger Logger = nopLogger{}
+)
@@ -25,32 +25,97 @@ package kafka
 import (
   "bytes"
   "encoding/binary"
+  "errors"
+  "fmt"
   "hash/crc32"
   "log"
 )
 
 const (
+  // The original format, without a compression byte: <MAGIC: 1 byte><CHECKSUM: uint32><MESSAGE PAYLOAD: bytes>
+  MAGIC_LEGACY = 0
   // Compression Support uses '1' - https://cwiki.apache.org/confluence/display/KAFKA/Compression
   MAGIC_DEFAULT = 1
   // magic + compression + chksum
   NO_LEN_HEADER_SIZE = 1 + 1 + 4
+  // magic + chksum, for MAGIC_LEGACY
+  LEGACY_NO_LEN_HEADER_SIZE = 1 + 4
 )
 
 type Message struct {
-  magic       byte
-  compression byte
-  checksum    [4]byte
-  payload     []byte
-  offset      uint64 // only used after decoding
-  totalLength uint32 // total length of the raw message (from decoding)
-
+  magic           byte
+  compression     byte
+  checksum        [4]byte
+  payload         []byte
+  key             []byte // only set for keyed messages, nil means no key
+  keyed           bool   // the payload goes on the wire framed with key, see NewKeyedMessage
+  offset          uint64 // only used after decoding
+  nextOffset      uint64 // offset following the message set entry holding this message (after decoding)
+  index           int    // position of the message in its compressed set, 0 for one that isn't (after decoding)
+  setSize         int    // number of messages in that set, 1 for a message that isn't in one (after decoding)
+  totalLength     uint32 // total length of the raw message (from decoding)
+  partition       int    // partition the message was consumed from
+  targetPartition int    // partition computed by Rekey for re-publishing
 }
 
+// The offset of the message set entry holding the message, for a consumed message
 func (m *Message) Offset() uint64 {
   return m.offset
 }
 
+// The size of the message on the wire in bytes, its length prefix included. For a message from a
+// compressed set that is its size inside the (uncompressed) set.
+func (m *Message) Size() int {
+  if m.totalLength == 0 {
+    // not decoded, so it's as big as it will be once encoded
+    return len(m.Encode())
+  }
+  return 4 + int(m.totalLength)
+}
+
+// The partition the message was consumed from
+func (m *Message) Partition() int {
+  return m.partition
+}
+
+// The partition assigned by a Rekey handler, for re-publishing (defaults to the source partition)
+func (m *Message) TargetPartition() int {
+  return m.targetPartition
+}
+
+// Returns a handler that tags each consumed message with the target partition computed by fn,
+// readable via TargetPartition(), for repartitioning onto another topic/partition layout.
+// Chain it ahead of the handler that does the re-publishing.
+func Rekey(fn func(*Message) int) func(*Message) {
+  return func(msg *Message) {
+    msg.targetPartition = fn(msg)
+  }
+}
+
+// The message key, nil for messages without one
+func (m *Message) Key() []byte {
+  return m.key
+}
+
+// The message headers. None of the formats this package reads (magic 0, MAGIC_DEFAULT)
+// carry headers, so this is always empty, but never nil.
+func (m *Message) Headers() map[string][]byte {
+  return map[string][]byte{}
+}
+
+// A copy of the payload, safe to keep (see PayloadRef)
 func (m *Message) Payload() []byte {
+  if m.payload == nil {
+    return nil
+  }
+  payload := make([]byte, len(m.payload))
+  copy(payload, m.payload)
+  return payload
+}
+
+// The payload itself, without copying. For a message from a BrokerConsumer with ZeroCopy set, it's part
+// of the fetch buffer and only valid until the consumer's next fetch or Close; it must not be modified.
+func (m *Message) PayloadRef() []byte {
   return m.payload
 }
 
@@ -67,6 +132,83 @@ func NewMessageWithCodec(payload []byte, codec PayloadCodec) *Message {
   return message
 }
 
+// Create a keyed message, a nil key is encoded as "no key". It is a plain, uncompressed MAGIC_DEFAULT
+// message whose payload is framed as <KEY LENGTH: int32><KEY: bytes><VALUE LENGTH: int32><VALUE: bytes>
+// (a key length of -1 meaning no key), which the broker and other clients see as the payload itself.
+// Consumers only split the key off when asked to, see BrokerConsumer.KeyedPayloads and DecodeKeyed.
+// To compress keyed messages, wrap them in a compressed set (NewCompressedMessages, SetCompression).
+func NewKeyedMessage(key []byte, payload []byte) *Message {
+  message := &Message{}
+  message.magic = byte(MAGIC_DEFAULT)
+  message.compression = NO_COMPRESSION_ID
+  message.key = key
+  message.keyed = true
+  message.payload = payload
+  binary.BigEndian.PutUint32(message.checksum[0:], crc32.ChecksumIEEE(keyedBody(message.key, message.payload)))
+  return message
+}
+
+// CRC32 of data computed with table, nil is the IEEE polynomial Kafka uses
+func checksum(table *crc32.Table, data []byte) uint32 {
+  if table == nil {
+    return crc32.ChecksumIEEE(data)
+  }
+  return crc32.Checksum(data, table)
+}
+
+// A copy of m with its checksum computed with table (nil is IEEE), for brokers or tools expecting another polynomial
+func (m *Message) withChecksum(table *crc32.Table) *Message {
+  body := m.payload
+  if m.keyed {
+    body = keyedBody(m.key, m.payload)
+  }
+  msg := *m
+  binary.BigEndian.PutUint32(msg.checksum[0:], checksum(table, body))
+  return &msg
+}
+
+// <KEY LENGTH: int32><KEY: bytes><VALUE LENGTH: int32><VALUE: bytes>
+func keyedBody(key []byte, value []byte) []byte {
+  body := make([]byte, 0, 8+len(key)+len(value))
+  if key == nil {
+    body = append(body, 0xFF, 0xFF, 0xFF, 0xFF) // -1
+  } else {
+    body = append(body, uint32bytes(len(key))...)
+    body = append(body, key...)
+  }
+  body = append(body, uint32bytes(len(value))...)
+  return append(body, value...)
+}
+
+// Split a keyed body into key (nil for length -1) and value
+func parseKeyedBody(body []byte) ([]byte, []byte, error) {
+  if len(body) < 4 {
+    return nil, nil, errors.New("keyed message too short for key length")
+  }
+  var key []byte
+  keyLength := int32(binary.BigEndian.Uint32(body[0:]))
+  rest := body[4:]
+  if keyLength >= 0 {
+    if int64(len(rest)) < int64(keyLength) {
+      return nil, nil, fmt.Errorf("keyed message too short for key of %d bytes", keyLength)
+    }
+    key = rest[:keyLength]
+    rest = rest[keyLength:]
+  } else if keyLength != -1 {
+    return nil, nil, fmt.Errorf("invalid key length: %d", keyLength)
+  }
+
+  if len(rest) < 4 {
+    return nil, nil, errors.New("keyed message too short for value length")
+  }
+  valueLength := binary.BigEndian.Uint32(rest[0:])
+  rest = rest[4:]
+  if uint64(len(rest)) != uint64(valueLength) {
+    return nil, nil, fmt.Errorf("value length mismatch, expected: %d, was: %d", valueLength, len(rest))
+  }
+  return key, rest, nil
+}
+
 // Default is is create a message with no compression
 func NewMessage(payload []byte) *Message {
   return NewMessageWithCodec(payload, DefaultCodecsMap[NO_COMPRESSION_ID])
@@ -78,104 +220,205 @@ func NewCompressedMessage(payload []byte) *Message {
 }
 
 func NewCompressedMessages(messages ...*Message) *Message {
-  buf := bytes.NewBuffer([]byte{})
-  for _, message := range messages {
-    buf.Write(message.Encode())
-  }
-  return NewMessageWithCodec(buf.Bytes(), DefaultCodecsMap[GZIP_COMPRESSION_ID])
+  return NewCompressedMessagesWithCodec(DefaultCodecsMap[GZIP_COMPRESSION_ID], messages...)
+}
+
+// Wrap messages in a single message compressed with codec, e.g. DefaultCodecsMap[SNAPPY_COMPRESSION_ID]
+func NewCompressedMessagesWithCodec(codec PayloadCodec, messages ...*Message) *Message {
+  return NewMessageWithCodec(EncodeMessageSet(messages), codec)
 }
 
 // MESSAGE SET: <MESSAGE LENGTH: uint32><MAGIC: 1 byte><COMPRESSION: 1 byte><CHECKSUM: uint32><MESSAGE PAYLOAD: bytes>
+// For a keyed message the MESSAGE PAYLOAD is framed with the key, see NewKeyedMessage. A decoded MAGIC_LEGACY
+// message is encoded in its own format, without the compression byte.
 func (m *Message) Encode() []byte {
-  msgLen := NO_LEN_HEADER_SIZE + len(m.payload)
+  if m.magic == MAGIC_LEGACY {
+    msgLen := LEGACY_NO_LEN_HEADER_SIZE + len(m.payload)
+    msg := make([]byte, 4+msgLen)
+    binary.BigEndian.PutUint32(msg[0:], uint32(msgLen))
+    msg[4] = m.magic
+    copy(msg[5:], m.checksum[0:])
+    copy(msg[9:], m.payload)
+    return msg
+  }
+  body := m.payload
+  if m.keyed {
+    body = keyedBody(m.key, m.payload)
+  }
+  msgLen := NO_LEN_HEADER_SIZE + len(body)
   msg := make([]byte, 4+msgLen)
   binary.BigEndian.PutUint32(msg[0:], uint32(msgLen))
   msg[4] = m.magic
   msg[5] = m.compression
 
   copy(msg[6:], m.checksum[0:])
-  copy(msg[10:], m.payload)
+  copy(msg[10:], body)
 
   return msg
 }
 
+// Encode msgs back to back as a message set, each one framed as by Encode:
+// <MESSAGE LENGTH: uint32><MAGIC: 1 byte><COMPRESSION: 1 byte><CHECKSUM: uint32><MESSAGE PAYLOAD: bytes>...
+// There is no padding and no set level header, and the output depends only on the messages,
+// so it can be compared against golden bytes.
+func EncodeMessageSet(msgs []*Message) []byte {
+  buf := bytes.NewBuffer([]byte{})
+  for _, message := range msgs {
+    buf.Write(message.Encode())
+  }
+  return buf.Bytes()
+}
+
 func DecodeWithDefaultCodecs(packet []byte) (uint32, []Message) {
   return Decode(packet, DefaultCodecsMap)
 }
 
+// Decode the message at the start of packet, returning its length (excluding the length prefix) and
+// its messages. Errors are logged and give (0, []Message{}), see DecodeE to tell them apart.
 func Decode(packet []byte, payloadCodecsMap map[byte]PayloadCodec) (uint32, []Message) {
+  messages, consumed, err := decode(packet, payloadCodecsMap, messageFormat{})
+  if err != nil {
+    DefaultLogger.Printf("%v\n", err)
+    return 0, messages
+  }
+  return uint32(consumed - 4), messages
+}
+
+// Like Decode, but returns the number of bytes of packet the message took (length prefix included,
+// so the next message starts there) and why decoding failed: test with errors.Is against
+// ErrTruncatedMessage, ErrInvalidMagic or ErrChecksumMismatch.
+// A compressed message set entry gives all of its messages.
+func DecodeE(packet []byte, payloadCodecsMap map[byte]PayloadCodec) ([]Message, int, error) {
+  return decode(packet, payloadCodecsMap, messageFormat{})
+}
+
+// Like DecodeE, for messages whose payloads are framed with a key (see NewKeyedMessage): each
+// uncompressed message's key is split off into Key(), and one that isn't framed so fails to decode.
+func DecodeKeyed(packet []byte, payloadCodecsMap map[byte]PayloadCodec) ([]Message, int, error) {
+  return decode(packet, payloadCodecsMap, messageFormat{keyed: true})
+}
+
+var (
+  // the packet ends before the message it holds, or the message's length is too short for its header
+  ErrTruncatedMessage = errors.New("truncated message")
+  // the message is in a format this package doesn't read
+  ErrInvalidMagic = errors.New("invalid magic")
+  // returned (wrapped in a *ChecksumError) when a message's payload doesn't match its checksum
+  ErrChecksumMismatch = errors.New("checksum mismatch")
+)
+
+// A message whose CRC32 doesn't match its payload, a sign of corruption on the wire or on disk
+type ChecksumError struct {
+  Expected uint32 // the checksum stored in the message
+  Actual   uint32 // the checksum computed over the payload
+  Offset   uint64 // where the message starts, when decoded by a consumer
+}
+
+func (e *ChecksumError) Error() string {
+  return fmt.Sprintf("checksum mismatch at offset %d, expected: %08X was: %08X", e.Offset, e.Expected, e.Actual)
+}
+
+func (e *ChecksumError) Unwrap() error {
+  return ErrChecksumMismatch
+}
+
+// How the messages read are checksummed and framed, beyond what their magic and compression bytes say
+type messageFormat struct {
+  crcTable *crc32.Table // checksums are computed with this table, nil is IEEE
+  keyed    bool         // uncompressed payloads are framed with a key, see NewKeyedMessage
+}
+
+// Decode the message at the start of packet, unpacking compressed message sets.
+// Returns its messages and the bytes it took, length prefix included (0 on error).
+func decode(packet []byte, payloadCodecsMap map[byte]PayloadCodec, format messageFormat) ([]Message, int, error) {
   messages := []Message{}
 
-  length, message := decodeMessage(packet, payloadCodecsMap)
-
-  if length > 0 && message != nil {
-    if message.compression != NO_COMPRESSION_ID {
-      // wonky special case for compressed messages having embedded messages
-      payloadLen := uint32(len(message.payload))
-      messageLenLeft := payloadLen
-      for messageLenLeft > 0 {
-        start := payloadLen - messageLenLeft
-        innerLen, innerMsg := decodeMessage(message.payload[start:], payloadCodecsMap)
-        messageLenLeft = messageLenLeft - innerLen - 4 // message length uint32
-        messages = append(messages, *innerMsg)
+  message, consumed, err := decodeMessage(packet, payloadCodecsMap, format)
+  if err != nil {
+    return messages, 0, err
+  }
+
+  if message.compression != NO_COMPRESSION_ID {
+    // wonky special case for compressed messages having embedded messages
+    for start := 0; start < len(message.payload); {
+      innerMsg, innerConsumed, err := decodeMessage(message.payload[start:], payloadCodecsMap, format)
+      if err != nil {
+        return []Message{}, 0, fmt.Errorf("in compressed message set: %w", err)
       }
-    } else {
-      messages = append(messages, *message)
+      start += innerConsumed
+      messages = append(messages, *innerMsg)
     }
+  } else {
+    messages = append(messages, *message)
   }
 
-  return length, messages
+  return messages, consumed, nil
 }
 
-func decodeMessage(packet []byte, payloadCodecsMap map[byte]PayloadCodec) (uint32, *Message) {
+// Decode a single message, without unpacking it. Returns it and the bytes it took, length prefix included.
+func decodeMessage(packet []byte, payloadCodecsMap map[byte]PayloadCodec, format messageFormat) (*Message, int, error) {
   if len(packet) < 5 {
-    log.Printf("malformed packet with length:%d (%#v), skipping\n", len(packet), packet)
-    return 0, nil
+    return nil, 0, fmt.Errorf("%w: packet of %d bytes (%#v) is too short for a message", ErrTruncatedMessage, len(packet), packet)
   }
   
   length := binary.BigEndian.Uint32(packet[0:])
   if length > uint32(len(packet[4:])) {
-    log.Printf("length mismatch, expected at least: %X, was: %X\n", length, len(packet[4:]))
-    return 0, nil
+    return nil, 0, fmt.Errorf("%w: length mismatch, expected at least: %X, was: %X", ErrTruncatedMessage, length, len(packet[4:]))
   }
   msg := Message{}
   msg.totalLength = length
   msg.magic = packet[4]
 
+  // the magic byte decides the header layout, MAGIC_LEGACY has no compression byte before the checksum
   rawPayload := []byte{}
-  if msg.magic == 0 {
+  if msg.magic == MAGIC_LEGACY {
+    if length < LEGACY_NO_LEN_HEADER_SIZE {
+      return nil, 0, fmt.Errorf("%w: length %d is too short for a magic 0 header", ErrTruncatedMessage, length)
+    }
     msg.compression = byte(0)
     copy(msg.checksum[:], packet[5:9])
-    payloadLength := length - 1 - 4
-    if uint32(len(packet)) < 9+payloadLength {
-      log.Printf("length mismatch in msg.magic == 0, expected at least: %X, was: %X\n", 9+payloadLength, len(packet))
-      return 0, nil
-    }
-    rawPayload = packet[9 : 9+payloadLength]
+    rawPayload = packet[9 : 4+length]
   } else if msg.magic == MAGIC_DEFAULT {
+    if length < NO_LEN_HEADER_SIZE {
+      return nil, 0, fmt.Errorf("%w: length %d is too short for a magic %d header", ErrTruncatedMessage, length, msg.magic)
+    }
     msg.compression = packet[5]
     copy(msg.checksum[:], packet[6:10])
-    payloadLength := length - NO_LEN_HEADER_SIZE
-    if uint32(len(packet)) < 10+payloadLength {
-      log.Printf("length mismatch in msg.magic == MAGIC_DEFAULT, expected at least: %X, was: %X\n", 10+payloadLength, len(packet))
-      return 0, nil
-    }
-    rawPayload = packet[10 : 10+payloadLength]
+    rawPayload = packet[10 : 4+length]
   } else {
-    log.Printf("incorrect magic, expected: %X was: %X\n", MAGIC_DEFAULT, msg.magic)
-    return 0, nil
+    return nil, 0, fmt.Errorf("%w, expected: %X was: %X", ErrInvalidMagic, MAGIC_DEFAULT, msg.magic)
   }
 
-  payloadChecksum := make([]byte, 4)
-  binary.BigEndian.PutUint32(payloadChecksum, crc32.ChecksumIEEE(rawPayload))
-  if !bytes.Equal(payloadChecksum, msg.checksum[:]) {
-    msg.Print()
-    log.Printf("checksum mismatch, expected: % X was: % X\n", payloadChecksum, msg.checksum[:])
-    return 0, nil
+  actual := checksum(format.crcTable, rawPayload)
+  expected := binary.BigEndian.Uint32(msg.checksum[:])
+  if actual != expected {
+    return nil, 0, &ChecksumError{Expected: expected, Actual: actual}
+  }
+  // a compressed message holds a message set, whose messages carry the keys
+  if format.keyed && msg.magic == MAGIC_DEFAULT && msg.compression == NO_COMPRESSION_ID {
+    key, value, err := parseKeyedBody(rawPayload)
+    if err != nil {
+      return nil, 0, fmt.Errorf("malformed keyed message: %w", err)
+    }
+    msg.key = key
+    msg.keyed = true
+    rawPayload = value
+  }
+  codec, ok := payloadCodecsMap[msg.compression]
+  if !ok {
+    return nil, 0, fmt.Errorf("%w: %d", ErrUnknownCodec, msg.compression)
+  }
+  if decoder, ok := codec.(payloadDecoderE); ok {
+    payload, err := decoder.DecodeE(rawPayload)
+    if err != nil {
+      return nil, 0, fmt.Errorf("decompressing with codec %d: %w", msg.compression, err)
+    }
+    msg.payload = payload
+  } else {
+    msg.payload = codec.Decode(rawPayload)
   }
-  msg.payload = payloadCodecsMap[msg.compression].Decode(rawPayload)
 
-  return length, &msg
+  return &msg, 4 + int(length), nil
 }
 
 func (msg *Message) Print() {
@@ -183,6 +426,9 @@ func (msg *Message) Print() {
   log.Printf("magic: %X\n", msg.magic)
   log.Printf("compression: %X\n", msg.compression)
   log.Printf("checksum: %X\n", msg.checksum)
+  if msg.key != nil {
+    log.Printf("key: % X\n", msg.key)
+  }
   if len(msg.payload) < 1048576 { // 1 MB 
     log.Printf("payload: % X\n", msg.payload)
     log.Printf("payload(string): %s\n", msg.PayloadString())
@@ -0,0 +1,96 @@
+/*
+ *  Copyright (c) 2011 NeuStar, Inc.
+ *  All rights reserved.  
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at 
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *  
+ *  NeuStar, the Neustar logo and related names and logos are registered
+ *  trademarks, service marks or tradenames of NeuStar, Inc. All other 
+ *  product names, company names, marks, logos and symbols may be trademarks
+ *  of their respective owners.
+ */
+
+package kafka
+
+import (
+  "fmt"
+  "net"
+)
+
+// Copies messages from src to dst until src is closed (returning nil) or an error, for simple
+// cross-cluster replication. src resumes from its OffsetStore, if it has one.
+// Each fetch from src is re-published to dst as one batch, and only once dst has accepted it is the
+// next fetch issued, so a slow destination holds back the source rather than buffering.
+// The batch is committed to src.OffsetStore (as CommitInterval and CommitEvery say) only after dst accepted
+// it, so delivery is at-least-once: a batch published before a failed commit or a crash is sent again.
+// Kafka 0.7 doesn't acknowledge produce requests, so accepted means written to dst's connection.
+// Messages are re-published with their original checksums, compressed sets arrive uncompressed.
+func Mirror(src *BrokerConsumer, dst *BrokerPublisher) error {
+  if src.isClosed() {
+    return ErrConsumerClosed
+  }
+  if err := src.loadStoredOffset(); err != nil {
+    return err
+  }
+  conn, err := src.broker.dial()
+  if err != nil {
+    return err
+  }
+  defer conn.Close()
+
+  backoff := src.newPollBackoff(DEFAULT_POLL_TIMEOUT_MS)
+  for !src.isClosed() {
+    num, err := src.mirrorFetch(conn, dst)
+    if err != nil {
+      return err
+    }
+    if num == 0 {
+      src.pollWait(conn, backoff.next(false), src.closed)
+    } else {
+      backoff.next(true)
+    }
+  }
+  return nil
+}
+
+// One fetch of Mirror: publish the messages at the consumer's offset to dst, then move past them and
+// commit them. Returns the number of messages mirrored.
+func (consumer *BrokerConsumer) mirrorFetch(conn net.Conn, dst *BrokerPublisher) (int, error) {
+  defer consumer.holdFetchBuffer()()
+  _, payload, err := consumer.fetchComplete(conn)
+  if err != nil {
+    return 0, err
+  }
+  msgs, consumed, decodeErr := decodeMessageSet(payload, consumer.offset, consumer.codecs, consumer.messageFormat())
+  if len(msgs) == 0 {
+    return 0, decodeErr
+  }
+  // what decoded is mirrored, a message that failed to is fetched (and fails) again next time
+  if _, err := dst.BatchPublish(msgs...); err != nil {
+    // the consumer stays at the unpublished batch, and nothing of it is committed
+    return 0, err
+  }
+  consumer.setOffset(consumer.offset + consumed)
+  consumer.consumed.Add(uint64(len(msgs)))
+  for i, msg := range msgs {
+    // messages of a compressed set share an offset, resuming before the last of them replays the set
+    resumeAt := msg.offset
+    if i == len(msgs)-1 || msgs[i+1].offset != msg.offset {
+      resumeAt = msg.nextOffset
+    }
+    if err := consumer.commitHandled(resumeAt); err != nil {
+      return i, fmt.Errorf("committing offset %d: %w", resumeAt, err)
+    }
+  }
+  return len(msgs), nil
+}
@@ -0,0 +1,183 @@
+/*
+ *  Copyright (c) 2011 NeuStar, Inc.
+ *  All rights reserved.  
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at 
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *  
+ *  NeuStar, the Neustar logo and related names and logos are registered
+ *  trademarks, service marks or tradenames of NeuStar, Inc. All other 
+ *  product names, company names, marks, logos and symbols may be trademarks
+ *  of their respective owners.
+ */
+
+package kafka
+
+import (
+  "encoding/binary"
+  "errors"
+  "fmt"
+  "sort"
+  "strings"
+)
+
+// One topic/partition read by a MultiConsumer
+type FetchRequest struct {
+  Topic     string
+  Partition int
+  Offset    uint64 // advanced as messages are consumed
+  MaxSize   uint32
+}
+
+type TopicPartition struct {
+  Topic     string
+  Partition int
+}
+
+// Per topic/partition failures from MultiConsumer.Consume
+type FetchErrors map[TopicPartition]error
+
+func (errs FetchErrors) Error() string {
+  msgs := make([]string, 0, len(errs))
+  for tp, err := range errs {
+    msgs = append(msgs, fmt.Sprintf("%s:%d: %s", tp.Topic, tp.Partition, err))
+  }
+  sort.Strings(msgs)
+  return "fetch failed for " + strings.Join(msgs, "; ")
+}
+
+// Consumer reading several topic/partitions from one broker with a single MultiFetch request per poll
+type MultiConsumer struct {
+  broker  *Broker
+  fetches []FetchRequest
+  codecs  map[byte]PayloadCodec
+}
+
+// Create a new multi fetch consumer
+// hostname - host and optionally port, delimited by ':'
+// fetches - the topic/partitions to consume, each from its offset, with its maxSize
+func NewMultiConsumer(hostname string, fetches []FetchRequest) *MultiConsumer {
+  return &MultiConsumer{broker: newBroker(hostname, "", 0),
+    fetches: append([]FetchRequest{}, fetches...),
+    codecs:  DefaultCodecsMap}
+}
+
+// Close the idle pooled connections
+func (mc *MultiConsumer) Close() error {
+  return mc.broker.Close()
+}
+
+// The topic/partitions being consumed, with their current offsets
+func (mc *MultiConsumer) Fetches() []FetchRequest {
+  return append([]FetchRequest{}, mc.fetches...)
+}
+
+// Fetch from all of the topic/partitions in one request, handing each message to handlerFunc tagged with
+// where it came from. A topic/partition that fails doesn't stop the others, its error is reported in a
+// FetchErrors alongside the number of messages handled.
+func (mc *MultiConsumer) Consume(handlerFunc func(topic string, partition int, msg *Message)) (int, error) {
+  conn, err := mc.broker.connect()
+  if err != nil {
+    return -1, err
+  }
+
+  _, err = mc.broker.write(conn, EncodeMultiFetchRequest(mc.fetches))
+  if err != nil {
+    mc.broker.release(conn, err)
+    return -1, err
+  }
+
+  var expected uint64 = 0
+  for _, fetch := range mc.fetches {
+    expected += 6 + uint64(fetch.MaxSize)
+  }
+  _, payload, err := mc.broker.readResponse(conn, mc.broker.responseLimit(expected))
+  mc.broker.release(conn, err)
+  if err != nil {
+    return -1, err
+  }
+
+  // <RESPONSE SIZE: uint32><ERROR CODE: uint16><MESSAGE SET>, one per fetch in request order
+  num := 0
+  errs := make(FetchErrors)
+  var current uint64 = 0
+  for i := range mc.fetches {
+    fetch := &mc.fetches[i]
+    tp := TopicPartition{fetch.Topic, fetch.Partition}
+    if current+6 > uint64(len(payload)) {
+      errs[tp] = fmt.Errorf("multi fetch response ended before this topic/partition")
+      continue
+    }
+    size := uint64(binary.BigEndian.Uint32(payload[current:]))
+    if size < 2 || current+4+size > uint64(len(payload)) {
+      errs[tp] = fmt.Errorf("multi fetch response truncated, declared size: %d", size)
+      current = uint64(len(payload))
+      continue
+    }
+    errorCode := int16(binary.BigEndian.Uint16(payload[current+4:]))
+    messageSet := payload[current+6 : current+4+size]
+    current += 4 + size
+    if errorCode != 0 {
+      errs[tp] = &BrokerError{Code: errorCode}
+      continue
+    }
+
+    msgs, consumed, err := decodeMessageSet(messageSet, fetch.Offset, mc.codecs, messageFormat{})
+    for _, msg := range msgs {
+      msg.partition = fetch.Partition
+      msg.targetPartition = fetch.Partition
+      handlerFunc(fetch.Topic, fetch.Partition, msg)
+      num += 1
+    }
+    fetch.Offset += consumed
+    if err != nil {
+      errs[tp] = err
+    }
+  }
+
+  if len(errs) > 0 {
+    return num, errs
+  }
+  return num, nil
+}
+
+// Decode the complete messages of a message set fetched from baseOffset, setting their offsets.
+// Returns the messages and the number of bytes they took, up to the first message that failed to decode.
+func decodeMessageSet(payload []byte, baseOffset uint64, codecs map[byte]PayloadCodec, format messageFormat) ([]*Message, uint64, error) {
+  messages := make([]*Message, 0)
+  var current uint64 = 0
+  for current+4 <= uint64(len(payload)) {
+    size := 4 + uint64(binary.BigEndian.Uint32(payload[current:]))
+    if current+size > uint64(len(payload)) {
+      // partial message at the end of the fetch, read again next time
+      break
+    }
+    msgs, consumed, err := decode(payload[current:], codecs, format)
+    if err != nil {
+      var checksumErr *ChecksumError
+      if errors.As(err, &checksumErr) {
+        checksumErr.Offset = baseOffset + current
+      }
+      return messages, current, fmt.Errorf("Error Decoding Message at offset %d: %w", baseOffset+current, err)
+    }
+    for i := range msgs {
+      msg := &msgs[i]
+      msg.offset = baseOffset + current
+      msg.nextOffset = baseOffset + current + uint64(consumed)
+      msg.index = i
+      msg.setSize = len(msgs)
+      messages = append(messages, msg)
+    }
+    current += uint64(consumed)
+  }
+  return messages, current, nil
+}
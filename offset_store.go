@@ -0,0 +1,153 @@
+/*
+ *  Copyright (c) 2011 NeuStar, Inc.
+ *  All rights reserved.  
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at 
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *  
+ *  NeuStar, the Neustar logo and related names and logos are registered
+ *  trademarks, service marks or tradenames of NeuStar, Inc. All other 
+ *  product names, company names, marks, logos and symbols may be trademarks
+ *  of their respective owners.
+ */
+
+package kafka
+
+import (
+  "errors"
+  "fmt"
+  "os"
+  "path/filepath"
+  "strconv"
+  "strings"
+  "time"
+)
+
+// Returned (possibly wrapped) by OffsetStore.Load when nothing has been committed for the topic/partition yet
+var ErrNoCommittedOffset = errors.New("no committed offset")
+
+// Where a BrokerConsumer checkpoints the offset to resume from, see BrokerConsumer.OffsetStore
+type OffsetStore interface {
+  Load(topic string, partition int) (uint64, error)
+  Commit(topic string, partition int, offset uint64) error
+}
+
+// OffsetStore keeping one file per topic/partition in a directory, holding the offset in decimal
+type FileOffsetStore struct {
+  dir string
+}
+
+// Store offsets in dir, which must exist
+func NewFileOffsetStore(dir string) *FileOffsetStore {
+  return &FileOffsetStore{dir: dir}
+}
+
+func (s *FileOffsetStore) path(topic string, partition int) string {
+  return filepath.Join(s.dir, fmt.Sprintf("%s-%d.offset", topic, partition))
+}
+
+func (s *FileOffsetStore) Load(topic string, partition int) (uint64, error) {
+  data, err := os.ReadFile(s.path(topic, partition))
+  if errors.Is(err, os.ErrNotExist) {
+    return 0, ErrNoCommittedOffset
+  }
+  if err != nil {
+    return 0, err
+  }
+  offset, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+  if err != nil {
+    return 0, fmt.Errorf("corrupt offset file %s: %w", s.path(topic, partition), err)
+  }
+  return offset, nil
+}
+
+// Writes to a temporary file renamed over the old one, so a crash leaves either offset but never half of one
+func (s *FileOffsetStore) Commit(topic string, partition int, offset uint64) error {
+  path := s.path(topic, partition)
+  tmp := path + ".tmp"
+  if err := os.WriteFile(tmp, []byte(strconv.FormatUint(offset, 10)+"\n"), 0644); err != nil {
+    return err
+  }
+  return os.Rename(tmp, path)
+}
+
+// Once, before the first fetch: resume from the offset in OffsetStore, if one was committed
+func (consumer *BrokerConsumer) loadStoredOffset() error {
+  if consumer.OffsetStore == nil || consumer.storeLoaded {
+    return nil
+  }
+  offset, err := consumer.OffsetStore.Load(consumer.broker.topic, consumer.broker.partition)
+  if errors.Is(err, ErrNoCommittedOffset) {
+    consumer.storeLoaded = true
+    return nil
+  }
+  if err != nil {
+    return err
+  }
+  consumer.setOffset(offset)
+  consumer.storeLoaded = true
+  consumer.startAtLatest = false // resuming wins over WithLatestOffset
+  return nil
+}
+
+// Counts a handled message, committing resumeAt when CommitInterval or CommitEvery says it's time
+func (consumer *BrokerConsumer) commitHandled(resumeAt uint64) error {
+  if consumer.OffsetStore == nil {
+    return nil
+  }
+  consumer.commitLock.Lock()
+  defer consumer.commitLock.Unlock()
+  if consumer.uncommitted == 0 && consumer.lastCommit.IsZero() {
+    // CommitEvery counts from the first message handled
+    consumer.lastCommit = time.Now()
+  }
+  consumer.uncommitted++
+  consumer.pendingCommit = resumeAt
+  byCount := consumer.CommitInterval > 0 && consumer.uncommitted >= consumer.CommitInterval
+  byTime := consumer.CommitEvery > 0 && time.Since(consumer.lastCommit) >= consumer.CommitEvery
+  if byCount || byTime || (consumer.CommitInterval <= 0 && consumer.CommitEvery <= 0) {
+    return consumer.commitPending()
+  }
+  return nil
+}
+
+// Commit resumeAt to OffsetStore now, for an explicit commit such as BatchReader.CommitBatch
+func (consumer *BrokerConsumer) commitNow(resumeAt uint64) error {
+  if consumer.OffsetStore == nil {
+    return nil
+  }
+  consumer.commitLock.Lock()
+  defer consumer.commitLock.Unlock()
+  consumer.pendingCommit = resumeAt
+  return consumer.commitPending()
+}
+
+// Commit the offset after the last message handled to OffsetStore now, if it hasn't been yet (see
+// CommitInterval and CommitEvery). Close does this too.
+func (consumer *BrokerConsumer) FlushOffset() error {
+  if consumer.OffsetStore == nil {
+    return nil
+  }
+  consumer.commitLock.Lock()
+  defer consumer.commitLock.Unlock()
+  if consumer.uncommitted == 0 {
+    return nil
+  }
+  return consumer.commitPending()
+}
+
+// Commit pendingCommit, commitLock held
+func (consumer *BrokerConsumer) commitPending() error {
+  consumer.uncommitted = 0
+  consumer.lastCommit = time.Now()
+  return consumer.OffsetStore.Commit(consumer.broker.topic, consumer.broker.partition, consumer.pendingCommit)
+}
@@ -0,0 +1,314 @@
+/*
+ *  Copyright (c) 2011 NeuStar, Inc.
+ *  All rights reserved.  
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at 
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *  
+ *  NeuStar, the Neustar logo and related names and logos are registered
+ *  trademarks, service marks or tradenames of NeuStar, Inc. All other 
+ *  product names, company names, marks, logos and symbols may be trademarks
+ *  of their respective owners.
+ */
+
+package kafka
+
+import (
+  "context"
+  "encoding/binary"
+  "errors"
+  "fmt"
+  "math"
+  "net"
+  "sort"
+  "strings"
+  "sync"
+  "time"
+)
+
+// The offsets returned for a single GetOffsetsDetailed request
+type OffsetResponse struct {
+  Time    int64    // the time the offsets were requested for (-1 latest, -2 earliest)
+  Count   uint32   // the number of offsets the broker reported
+  Offsets []uint64
+}
+
+// As GetOffsets, but in ascending order: the earliest offset is first, the latest last
+func (consumer *BrokerConsumer) GetOffsetsAscending(time int64, maxNumOffsets uint32) ([]uint64, error) {
+  offsets, err := consumer.GetOffsets(time, maxNumOffsets)
+  sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+  return offsets, err
+}
+
+// Parse the payload of an offsets response (following the error code):
+// <NUMBER OF OFFSETS: uint32><OFFSET: uint64>...
+// An empty payload yields no offsets, a payload too short for the offsets it declares is an error.
+func ParseOffsetResponse(payload []byte) ([]uint64, error) {
+  response, err := parseOffsetResponse(0, payload)
+  return response.Offsets, err
+}
+
+func parseOffsetResponse(time int64, payload []byte) (OffsetResponse, error) {
+  response := OffsetResponse{Time: time, Offsets: make([]uint64, 0)}
+  if len(payload) == 0 {
+    return response, nil
+  }
+  if len(payload) < 4 {
+    return response, fmt.Errorf("offset response too short: %d bytes", len(payload))
+  }
+
+  response.Count = binary.BigEndian.Uint32(payload[0:])
+  if uint64(len(payload)-4) != uint64(response.Count)*8 {
+    return response, fmt.Errorf("offset response declares %d offsets but holds %d bytes", response.Count, len(payload)-4)
+  }
+  for i := uint64(0); i < uint64(response.Count); i++ {
+    response.Offsets = append(response.Offsets, binary.BigEndian.Uint64(payload[4+i*8:]))
+  }
+  return response, nil
+}
+
+const (
+  // the number of brokers GetOffsetsAcrossBrokers queries at once
+  MAX_BROKER_FANOUT = 8
+)
+
+// The offsets (or the error) returned for a single partition by GetOffsetsForPartitions
+type PartitionOffsets struct {
+  Offsets []uint64
+  Err     error
+}
+
+// Get the offsets of many partitions of a topic concurrently
+// hostname - host and optionally port, delimited by ':'
+// topic to query
+// partitions to query
+// time & maxNumOffsets - as for BrokerConsumer.GetOffsets
+// concurrency - the number of pooled connections, and so the maximum number of requests in flight
+// The result is keyed by partition, a failed partition carries its error rather than failing the whole call.
+func GetOffsetsForPartitions(hostname string, topic string, partitions []int, time int64, maxNumOffsets uint32, concurrency int) map[int]PartitionOffsets {
+  if concurrency < 1 {
+    concurrency = 1
+  }
+
+  // one broker for all of the partitions, so the lookups share its pool of connections
+  broker := newBroker(hostname, topic, 0)
+  broker.maxIdle = concurrency
+  defer broker.Close()
+
+  results := make(map[int]PartitionOffsets, len(partitions))
+  var lock sync.Mutex
+  var wg sync.WaitGroup
+
+  work := make(chan int)
+  for i := 0; i < concurrency; i++ {
+    wg.Add(1)
+    go func() {
+      defer wg.Done()
+      for partition := range work {
+        request := OffsetRequest{Topic: topic, Partition: partition, Time: time, MaxNumOffsets: maxNumOffsets}
+        var response OffsetResponse
+        conn, err := broker.connect()
+        if err == nil {
+          response, err = broker.exchangeOffsets(conn, request.Encode(), time, maxNumOffsets)
+          // closed rather than pooled after an error, it may be out of step with the broker
+          broker.release(conn, err)
+        }
+        lock.Lock()
+        results[partition] = PartitionOffsets{Offsets: response.Offsets, Err: err}
+        lock.Unlock()
+      }
+    }()
+  }
+
+  for _, partition := range partitions {
+    work <- partition
+  }
+  close(work)
+  wg.Wait()
+
+  return results
+}
+
+// Per timestamp failures from OffsetsByTime
+type TimeOffsetErrors map[time.Time]error
+
+func (errs TimeOffsetErrors) Error() string {
+  times := make([]time.Time, 0, len(errs))
+  for t := range errs {
+    times = append(times, t)
+  }
+  sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+  msgs := make([]string, 0, len(times))
+  for _, t := range times {
+    msgs = append(msgs, fmt.Sprintf("%s: %s", t.Format(time.RFC3339), errs[t]))
+  }
+  return "offset lookup failed for " + strings.Join(msgs, "; ")
+}
+
+// Map each of times to the earliest offset at or after it, for building a time index of the partition.
+// The broker only tracks time per log segment (its last write), so each time maps to the start of the
+// first segment written to at or after it: the earliest offset a message from then on can be at. That
+// segment may begin with older messages, but none at or after the time are missed. A time past the
+// last write maps to the end of the log. All lookups share one connection. Timestamps that could not be resolved are left out of the
+// result and reported in a TimeOffsetErrors, the rest are still returned.
+func (consumer *BrokerConsumer) OffsetsByTime(times []time.Time) (map[time.Time]uint64, error) {
+  results := make(map[time.Time]uint64, len(times))
+  errs := make(TimeOffsetErrors)
+
+  var conn net.Conn
+  defer func() {
+    if conn != nil {
+      consumer.broker.release(conn, nil)
+    }
+  }()
+
+  // the segment starts and the end of the log, ascending
+  var boundaries []uint64
+  for _, t := range times {
+    var err error
+    if conn == nil {
+      conn, err = consumer.broker.connect()
+      if err != nil {
+        errs[t] = err
+        continue
+      }
+    }
+    if boundaries == nil {
+      boundaries, err = consumer.broker.getOffsetsWithConn(conn, -1, math.MaxInt32)
+      sort.Slice(boundaries, func(i, j int) bool { return boundaries[i] < boundaries[j] })
+    }
+
+    var offsets []uint64
+    if err == nil {
+      // the start of the last segment written to before t (the broker includes one last written at the
+      // time asked for, hence a millisecond earlier), so the one after it is the first written to since
+      offsets, err = consumer.broker.getOffsetsWithConn(conn, t.UnixNano()/int64(time.Millisecond)-1, 1)
+    }
+    if err != nil {
+      errs[t] = err
+      boundaries = nil
+      conn.Close()
+      conn = nil
+      continue
+    }
+    if len(boundaries) == 0 {
+      errs[t] = errors.New("no offsets available")
+      continue
+    }
+    if len(offsets) == 0 {
+      // before the first segment was last written, so from the earliest offset
+      results[t] = boundaries[0]
+      continue
+    }
+    next := sort.Search(len(boundaries), func(i int) bool { return boundaries[i] > offsets[0] })
+    if next == len(boundaries) {
+      // after the last write, so where the next message will go
+      next--
+    }
+    results[t] = boundaries[next]
+  }
+
+  if len(errs) > 0 {
+    return results, errs
+  }
+  return results, nil
+}
+
+// Per broker failures from GetOffsetsAcrossBrokers
+type BrokerOffsetErrors map[string]error
+
+func (errs BrokerOffsetErrors) Error() string {
+  hosts := make([]string, 0, len(errs))
+  for host := range errs {
+    hosts = append(hosts, host)
+  }
+  sort.Strings(hosts)
+  msgs := make([]string, 0, len(hosts))
+  for _, host := range hosts {
+    msgs = append(msgs, fmt.Sprintf("%s: %s", host, errs[host]))
+  }
+  return "offset lookup failed for " + strings.Join(msgs, "; ")
+}
+
+// Get the latest offset before time (-1 latest, -2 earliest) for a topic/partition from each of hosts,
+// e.g. to compare partition state across a cluster. Up to MAX_BROKER_FANOUT brokers are queried at
+// once, and cancelling ctx abandons the lookups still in flight.
+// Results are keyed by host; hosts that failed are left out and reported in a BrokerOffsetErrors,
+// or ctx.Err() is returned if ctx was done first.
+func GetOffsetsAcrossBrokers(ctx context.Context, hosts []string, topic string, partition int, time int64) (map[string][]uint64, error) {
+  results := make(map[string][]uint64, len(hosts))
+  errs := make(BrokerOffsetErrors)
+  var lock sync.Mutex
+  var wg sync.WaitGroup
+
+  slots := make(chan bool, MAX_BROKER_FANOUT)
+  for _, host := range hosts {
+    wg.Add(1)
+    go func(host string) {
+      defer wg.Done()
+      var offsets []uint64
+      var err error
+      select {
+      case slots <- true:
+        offsets, err = newBroker(host, topic, partition).getOffsetsContext(ctx, time, 1)
+        <-slots
+      case <-ctx.Done():
+        err = ctx.Err()
+      }
+
+      lock.Lock()
+      if err != nil {
+        errs[host] = err
+      } else {
+        results[host] = offsets
+      }
+      lock.Unlock()
+    }(host)
+  }
+  wg.Wait()
+
+  if ctx.Err() != nil {
+    return results, ctx.Err()
+  }
+  if len(errs) > 0 {
+    return results, errs
+  }
+  return results, nil
+}
+
+// GetOffsets on a connection of its own, which is closed to abandon the request if ctx is done
+func (b *Broker) getOffsetsContext(ctx context.Context, time int64, maxNumOffsets uint32) ([]uint64, error) {
+  conn, err := b.dialEndpoints(func(hostname string) (net.Conn, error) {
+    if b.Dialer != nil {
+      // a custom Dialer can't be interrupted, only the request once it's connected
+      return b.Dialer(NETWORK, hostname)
+    }
+    dialer := net.Dialer{}
+    if b.localAddr != nil {
+      dialer.LocalAddr = b.localAddr
+    }
+    return dialer.DialContext(ctx, NETWORK, hostname)
+  })
+  if err != nil {
+    return nil, err
+  }
+  defer conn.Close()
+
+  stop := context.AfterFunc(ctx, func() { conn.Close() })
+  defer stop()
+
+  offsets, err := b.getOffsetsWithConn(conn, time, maxNumOffsets)
+  if ctx.Err() != nil {
+    return nil, ctx.Err()
+  }
+  return offsets, err
+}
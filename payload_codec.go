@@ -25,12 +25,16 @@ package kafka
 import (
   "bytes"
   "compress/gzip"
+  "errors"
+  "fmt"
+  "io"
   //  "log"
 )
 
 const (
   NO_COMPRESSION_ID   = 0
   GZIP_COMPRESSION_ID = 1
+  // SNAPPY_COMPRESSION_ID = 2, see snappy.go
 )
 
 type PayloadCodec interface {
@@ -50,10 +54,50 @@ type PayloadCodec interface {
 var DefaultCodecs = []PayloadCodec{
   new(NoCompressionPayloadCodec),
   new(GzipPayloadCodec),
+  new(SnappyPayloadCodec),
 }
 
 var DefaultCodecsMap = codecsMap(DefaultCodecs)
 
+// Returned (wrapped, test with errors.Is) when decoding a message compressed with a codec that isn't registered
+var ErrUnknownCodec = errors.New("unknown compression codec")
+
+// Add a codec to DefaultCodecsMap, used by every consumer that hasn't been given its own codecs, so messages
+// whose compression attribute is id are decompressed with decompress (e.g. for lz4). Replaces any codec
+// registered with id. The codec only decompresses, it can't be used to publish. Not safe while consuming,
+// register codecs up front (e.g. from init).
+func RegisterCodec(id byte, decompress func([]byte) ([]byte, error)) {
+  DefaultCodecsMap[id] = &decompressorCodec{id: id, decompress: decompress}
+}
+
+// Implemented by codecs whose decoding can fail, so the failure is reported rather than an empty payload
+type payloadDecoderE interface {
+  DecodeE(data []byte) ([]byte, error)
+}
+
+// A decode only codec from RegisterCodec
+type decompressorCodec struct {
+  id         byte
+  decompress func([]byte) ([]byte, error)
+}
+
+func (codec *decompressorCodec) Id() byte {
+  return codec.id
+}
+
+func (codec *decompressorCodec) Encode(data []byte) []byte {
+  panic(fmt.Sprintf("codec %d was registered to decompress only", codec.id))
+}
+
+func (codec *decompressorCodec) Decode(data []byte) []byte {
+  decoded, _ := codec.decompress(data)
+  return decoded
+}
+
+func (codec *decompressorCodec) DecodeE(data []byte) ([]byte, error) {
+  return codec.decompress(data)
+}
+
 func codecsMap(payloadCodecs []PayloadCodec) map[byte]PayloadCodec {
   payloadCodecsMap := make(map[byte]PayloadCodec, len(payloadCodecs))
   for _, c := range payloadCodecs {
@@ -96,19 +140,23 @@ func (codec *GzipPayloadCodec) Encode(data []byte) []byte {
   return buf.Bytes()
 }
 
+// Corrupt data decodes to an empty payload, see DecodeE
 func (codec *GzipPayloadCodec) Decode(data []byte) []byte {
-  buf := bytes.NewBuffer([]byte{})
-  zipper, _ := gzip.NewReader(bytes.NewBuffer(data))
-  unzipped := make([]byte, 100)
-  for {
-    n, err := zipper.Read(unzipped)
-    if n > 0 && err == nil {
-      buf.Write(unzipped[0:n])
-    } else {
-      break
-    }
+  unzipped, err := codec.DecodeE(data)
+  if err != nil {
+    return []byte{}
   }
+  return unzipped
+}
 
-  zipper.Close()
-  return buf.Bytes()
+// Like Decode, but corrupt data is an error, which decoding a message reports rather than passing on nothing
+func (codec *GzipPayloadCodec) DecodeE(data []byte) ([]byte, error) {
+  zipper, err := gzip.NewReader(bytes.NewBuffer(data))
+  if err != nil {
+    return nil, err
+  }
+  defer zipper.Close()
+
+  // the final chunk can arrive together with io.EOF, which ReadAll doesn't count as an error
+  return io.ReadAll(zipper)
 }
@@ -22,8 +22,31 @@
 
 package kafka
 
+import (
+  "bytes"
+  "crypto/tls"
+  "errors"
+  "fmt"
+  "hash/crc32"
+  "net"
+  "time"
+)
+
+const (
+  // how often PublishAndVerify fetches back a message the broker hasn't made visible yet, and how long it waits in between
+  PUBLISH_VERIFY_ATTEMPTS = 10
+  PUBLISH_VERIFY_WAIT_MS  = 100
+  // the largest produce request BatchPublish sends, unless changed with SetMaxRequestSize
+  DEFAULT_MAX_REQUEST_SIZE = 1048576
+)
+
+// Returned (wrapped, test with errors.Is) when a single message doesn't fit in a produce request
+var ErrRequestTooLarge = errors.New("message larger than the max request size")
+
 type BrokerPublisher struct {
-  broker *Broker
+  broker         *Broker
+  compression    PayloadCodec
+  maxRequestSize int
 }
 
 func NewBrokerPublisher(hostname string, topic string, partition int) *BrokerPublisher {
@@ -34,18 +57,188 @@ func (b *BrokerPublisher) Publish(message *Message) (int, error) {
   return b.BatchPublish(message)
 }
 
+// Publish messages, split over as many produce requests as it takes to keep each within the max request
+// size (see SetMaxRequestSize). Returns the number of bytes written.
 func (b *BrokerPublisher) BatchPublish(messages ...*Message) (int, error) {
-  conn, err := b.broker.connect()
+  num, _, err := b.publishRequests(messages)
   if err != nil {
     return -1, err
   }
-  defer conn.Close()
-  // TODO: MULTIPRODUCE
-  request := b.broker.EncodePublishRequest(messages...)
-  num, err := conn.Write(request)
+  return num, err
+}
+
+// Publish each of payloads as a message, like BatchPublish. Returns the number of messages sent,
+// which on error are the ones in the requests written before it.
+func (b *BrokerPublisher) BatchPublishPayloads(payloads [][]byte) (int, error) {
+  messages := make([]*Message, len(payloads))
+  for i, payload := range payloads {
+    messages[i] = NewMessage(payload)
+  }
+  _, sent, err := b.publishRequests(messages)
+  return sent, err
+}
+
+// Write messages in produce requests of at most the max request size on one connection.
+// Returns the bytes written and the number of messages in the requests written.
+func (b *BrokerPublisher) publishRequests(messages []*Message) (written int, sent int, err error) {
+  batches, err := b.splitRequests(messages)
   if err != nil {
-    return -1, err
+    return 0, 0, err
+  }
+  conn, err := b.broker.connect()
+  if err != nil {
+    return 0, 0, err
   }
+  defer func() { b.broker.release(conn, err) }()
 
-  return num, err
+  for _, batch := range batches {
+    encoded := b.broker.checksummed(batch)
+    if b.compression != nil {
+      encoded = b.broker.checksummed([]*Message{NewCompressedMessagesWithCodec(b.compression, encoded...)})
+    }
+    // TODO: MULTIPRODUCE
+    num, err := b.broker.write(conn, b.broker.EncodePublishRequest(encoded...))
+    written += num
+    if err != nil {
+      return written, sent, err
+    }
+    sent += len(batch)
+  }
+  return written, sent, nil
+}
+
+// Group messages, in order, into batches whose produce request fits the max request size.
+// Sizes are taken uncompressed, so a compressed request only comes out smaller.
+func (b *BrokerPublisher) splitRequests(messages []*Message) ([][]*Message, error) {
+  maxSize := b.maxRequestSize
+  if maxSize <= 0 {
+    maxSize = DEFAULT_MAX_REQUEST_SIZE
+  }
+  overhead := len(b.broker.EncodePublishRequest())
+  if b.compression != nil {
+    overhead += len(NewMessage(nil).Encode()) // the message wrapping the compressed set
+  }
+
+  batches := make([][]*Message, 0, 1)
+  batch := make([]*Message, 0)
+  size := overhead
+  for _, message := range messages {
+    messageSize := message.Size()
+    if overhead+messageSize > maxSize {
+      return nil, fmt.Errorf("%w: %d bytes, max request size %d", ErrRequestTooLarge, messageSize, maxSize)
+    }
+    if size+messageSize > maxSize {
+      batches = append(batches, batch)
+      batch = make([]*Message, 0)
+      size = overhead
+    }
+    batch = append(batch, message)
+    size += messageSize
+  }
+  return append(batches, batch), nil
+}
+
+// Publish message, then fetch it back to confirm the broker stored exactly the bytes sent.
+// Returns the offset the message was written at (the latest offset before publishing).
+// The broker only serves messages once flushed, so the fetch is retried PUBLISH_VERIFY_ATTEMPTS times.
+// Verification fails if another producer wrote to the partition in between.
+func (b *BrokerPublisher) PublishAndVerify(message *Message) (offset uint64, err error) {
+  conn, err := b.broker.connect()
+  if err != nil {
+    return 0, err
+  }
+  defer func() { b.broker.release(conn, err) }()
+
+  offsets, err := b.broker.getOffsetsWithConn(conn, -1, 1)
+  if err != nil {
+    return 0, err
+  }
+  if len(offsets) == 0 {
+    return 0, fmt.Errorf("no latest offset for %s:%d", b.broker.topic, b.broker.partition)
+  }
+  offset = offsets[0]
+
+  message = b.broker.checksummed([]*Message{message})[0]
+  if _, err = b.broker.write(conn, b.broker.EncodePublishRequest(message)); err != nil {
+    return offset, err
+  }
+
+  sent := message.Encode()
+  for attempt := 0; attempt < PUBLISH_VERIFY_ATTEMPTS; attempt++ {
+    if attempt > 0 {
+      time.Sleep(time.Millisecond * PUBLISH_VERIFY_WAIT_MS)
+    }
+    var length uint32
+    var payload []byte
+    length, payload, err = b.broker.fetch(conn, offset, uint32(len(sent)))
+    if err != nil {
+      return offset, err
+    }
+    if length <= 2 {
+      continue // not flushed yet
+    }
+    if !bytes.Equal(payload, sent) {
+      return offset, fmt.Errorf("message at offset %d differs from the one published: sent % X, got % X", offset, sent, payload)
+    }
+
+    offsets, err = b.broker.getOffsetsWithConn(conn, -1, 1)
+    if err != nil {
+      return offset, err
+    }
+    if len(offsets) == 0 || offsets[0] <= offset {
+      return offset, fmt.Errorf("latest offset did not advance past %d after publishing", offset)
+    }
+    return offset, nil
+  }
+  return offset, fmt.Errorf("message published at offset %d was not readable after %d attempts", offset, PUBLISH_VERIFY_ATTEMPTS)
+}
+
+// Publish payload as one message, blocking until the broker serves it, and return the offset it was written
+// at. This is PublishAndVerify, with its caveat that another producer writing in between fails it.
+func (b *BrokerPublisher) PublishSync(payload []byte) (uint64, error) {
+  return b.PublishAndVerify(NewMessage(payload))
+}
+
+// Route the publisher's logging to logger (NopLogger to silence it), nil restores DefaultLogger
+func (b *BrokerPublisher) SetLogger(logger Logger) {
+  b.broker.setLogger(logger)
+}
+
+// Compress each batch from Publish and BatchPublish into one message with codec,
+// e.g. DefaultCodecsMap[SNAPPY_COMPRESSION_ID]. nil (the default) sends the messages as given.
+func (b *BrokerPublisher) SetCompression(codec PayloadCodec) {
+  b.compression = codec
+}
+
+// Limit the size of each produce request BatchPublish sends, in bytes; <= 0 restores DEFAULT_MAX_REQUEST_SIZE
+func (b *BrokerPublisher) SetMaxRequestSize(size int) {
+  b.maxRequestSize = size
+}
+
+// Open broker connections with dialer instead of a plain TCP dial, nil restores the default
+func (b *BrokerPublisher) SetDialer(dialer func(network, addr string) (net.Conn, error)) {
+  b.broker.Dialer = dialer
+}
+
+// Connect to the broker over TLS with config, nil goes back to plain TCP. See BrokerConsumer.SetTLS.
+func (b *BrokerPublisher) SetTLS(config *tls.Config) {
+  b.broker.setTLS(config)
+}
+
+// Have onTiming called with how long each connect, request write and response read takes.
+// See BrokerConsumer.SetOnTiming.
+func (b *BrokerPublisher) SetOnTiming(onTiming func(label string, d time.Duration)) {
+  b.broker.onTiming = onTiming
+}
+
+// Checksum published messages with table instead of IEEE, nil goes back to IEEE. Messages are
+// re-checksummed as they are sent, but the messages inside one the caller compressed keep theirs,
+// so compress with SetCompression instead. See BrokerConsumer.SetChecksumTable.
+func (b *BrokerPublisher) SetChecksumTable(table *crc32.Table) {
+  b.broker.setChecksumTable(table)
+}
+
+// Close the idle pooled connections
+func (b *BrokerPublisher) Close() error {
+  return b.broker.Close()
 }
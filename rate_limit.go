@@ -0,0 +1,73 @@
+/*
+ *  Copyright (c) 2011 NeuStar, Inc.
+ *  All rights reserved.  
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at 
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *  
+ *  NeuStar, the Neustar logo and related names and logos are registered
+ *  trademarks, service marks or tradenames of NeuStar, Inc. All other 
+ *  product names, company names, marks, logos and symbols may be trademarks
+ *  of their respective owners.
+ */
+
+package kafka
+
+import (
+  "sync"
+  "time"
+)
+
+// Paces messages to at most messagesPerSecond and payload bytes to at most bytesPerSecond, a zero rate
+// being unlimited. This is a token bucket without burst capacity: each message waits for the time its
+// predecessor's share of the rate took, so throughput is smooth rather than bursty.
+type rateLimiter struct {
+  lock              sync.Mutex
+  messagesPerSecond float64
+  bytesPerSecond    float64
+  next              time.Time // when the next message may go
+}
+
+func (r *rateLimiter) set(messagesPerSecond float64, bytesPerSecond float64) {
+  r.lock.Lock()
+  defer r.lock.Unlock()
+  r.messagesPerSecond = messagesPerSecond
+  r.bytesPerSecond = bytesPerSecond
+  // the wait reserved under the old rates no longer applies
+  r.next = time.Time{}
+}
+
+// Block until a message of size payload bytes may go
+func (r *rateLimiter) wait(size int) {
+  r.lock.Lock()
+  var cost time.Duration
+  if r.messagesPerSecond > 0 {
+    cost = time.Duration(float64(time.Second) / r.messagesPerSecond)
+  }
+  if r.bytesPerSecond > 0 {
+    if byteCost := time.Duration(float64(size) * float64(time.Second) / r.bytesPerSecond); byteCost > cost {
+      cost = byteCost
+    }
+  }
+  if cost == 0 {
+    r.lock.Unlock()
+    return
+  }
+  now := time.Now()
+  if r.next.Before(now) {
+    r.next = now
+  }
+  start := r.next
+  r.next = start.Add(cost)
+  r.lock.Unlock()
+  time.Sleep(time.Until(start))
+}
@@ -0,0 +1,264 @@
+/*
+ *  Copyright (c) 2011 NeuStar, Inc.
+ *  All rights reserved.  
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at 
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *  
+ *  NeuStar, the Neustar logo and related names and logos are registered
+ *  trademarks, service marks or tradenames of NeuStar, Inc. All other 
+ *  product names, company names, marks, logos and symbols may be trademarks
+ *  of their respective owners.
+ */
+
+package kafka
+
+import (
+  "encoding/binary"
+  "fmt"
+  "net"
+)
+
+// Pull based reader handing out the messages of one fetch at a time, with explicit commit control.
+// A batch returned by NextBatch is read again by the next call unless CommitBatch is called first, and
+// only CommitBatch moves the offset or commits to the OffsetStore. Filters (SkipInitial, PrefixFilter,
+// SampleRate) don't apply, as a batch may be read any number of times.
+type BatchReader struct {
+  consumer *BrokerConsumer
+  conn     net.Conn
+  next     uint64 // offset following the last batch returned by NextBatch
+  count    int    // number of messages in it
+  pending  bool
+}
+
+// Create a BatchReader reading from the consumer's current offset
+func (consumer *BrokerConsumer) NewBatchReader() *BatchReader {
+  return &BatchReader{consumer: consumer}
+}
+
+// Fetch the next set of messages, returned with the base offset they were fetched from.
+// The consumer's offset is left in place until CommitBatch.
+func (r *BatchReader) NextBatch() ([]*Message, uint64, error) {
+  if r.conn == nil {
+    conn, err := r.consumer.broker.dial()
+    if err != nil {
+      return nil, r.consumer.offset, err
+    }
+    r.conn = conn
+  }
+
+  msgs, next, err := r.consumer.fetchSet(r.conn)
+  // after fetchSet, which may have loaded the offset from the OffsetStore
+  base := r.consumer.offset
+  if err != nil {
+    r.pending = false
+    r.conn.Close()
+    r.conn = nil
+    return nil, base, err
+  }
+
+  if msgs == nil {
+    msgs = make([]*Message, 0)
+  }
+  r.next, r.count, r.pending = next, len(msgs), true
+  return msgs, base, nil
+}
+
+// Advance the consumer's offset past the batch last returned by NextBatch, committing it to the
+// OffsetStore straight away (CommitInterval and CommitEvery don't apply)
+func (r *BatchReader) CommitBatch() error {
+  if !r.pending {
+    return nil
+  }
+  r.pending = false
+  r.consumer.setOffset(r.next)
+  r.consumer.consumed.Add(uint64(r.count))
+  if err := r.consumer.commitNow(r.next); err != nil {
+    return fmt.Errorf("committing offset %d: %w", r.next, err)
+  }
+  return nil
+}
+
+// Close the reader's connection
+func (r *BatchReader) Close() {
+  if r.conn != nil {
+    r.conn.Close()
+    r.conn = nil
+  }
+}
+
+// Pull based iteration over a consumer's messages:
+//
+//   iter := consumer.ConsumeIter()
+//   defer iter.Close()
+//   for iter.Next() {
+//     handle(iter.Message())
+//   }
+//   if err := iter.Err(); err != nil { ... }
+//
+// Next fetches again once the messages of the last fetch are used up, and returns false once a fetch brings
+// nothing new (calling it again later picks up from there) or fails, which Err then returns. The consumer's
+// offset follows the messages Next hands out, so breaking out of the loop resumes after the last of them.
+// A message is only committed to the OffsetStore once Next moves past it, so a crash mid-iteration
+// delivers the message in hand again rather than losing it.
+type MessageIterator struct {
+  consumer *BrokerConsumer
+  conn     net.Conn
+  batch    []*Message
+  next     int    // index in batch of the message Next hands out next
+  end      uint64 // offset following batch
+  message  *Message
+  resumeAt uint64 // offset to resume from once message is done with
+  fetchErr error  // what ended the fetch of batch, reported once batch is used up
+  err      error
+}
+
+// Iterate over the messages from the consumer's current offset, see MessageIterator
+func (consumer *BrokerConsumer) ConsumeIter() *MessageIterator {
+  return &MessageIterator{consumer: consumer}
+}
+
+// Move to the next message, fetching if need be. Returns false when there's none to move to.
+func (it *MessageIterator) Next() bool {
+  if it.message != nil {
+    // the caller is done with it
+    it.message = nil
+    if err := it.consumer.commitHandled(it.resumeAt); err != nil {
+      it.err = fmt.Errorf("committing offset %d: %w", it.resumeAt, err)
+    }
+  }
+  if it.err != nil {
+    return false
+  }
+  for {
+    if it.next >= len(it.batch) {
+      if it.fetchErr != nil {
+        it.err = it.fetchErr
+        return false
+      }
+      if !it.fetch() {
+        return false
+      }
+    }
+    msg := it.batch[it.next]
+    it.next++
+    if it.consumer.DetectDuplicates && msg.index == 0 {
+      it.consumer.checkDuplicate(msg.offset)
+    }
+    // messages of a compressed set share an offset, resuming before the last of them replays the set
+    resumeAt := msg.offset
+    if it.next == len(it.batch) {
+      // past anything SkipCorrupted passed over at the end too
+      resumeAt = it.end
+    } else if msg.index == msg.setSize-1 {
+      resumeAt = msg.nextOffset
+    }
+    admitted := it.consumer.admit(msg)
+    it.consumer.setOffset(resumeAt)
+    if admitted {
+      it.consumer.limiter.wait(len(msg.payload))
+      it.consumer.consumed.Add(1)
+      it.message, it.resumeAt = msg, resumeAt
+      return true
+    }
+    // filtered out (PrefixFilter, ...), move past it
+  }
+}
+
+// The message Next moved to, nil once it has returned false
+func (it *MessageIterator) Message() *Message {
+  return it.message
+}
+
+// Why Next returned false, nil when it was for want of new messages
+func (it *MessageIterator) Err() error {
+  return it.err
+}
+
+// Close the iterator's connection
+func (it *MessageIterator) Close() {
+  if it.conn != nil {
+    it.conn.Close()
+    it.conn = nil
+  }
+}
+
+// Fetch the next batch, leaving the consumer's offset at its start. Returns false when there's nothing in it.
+func (it *MessageIterator) fetch() bool {
+  if it.conn == nil {
+    conn, err := it.consumer.broker.dial()
+    if err != nil {
+      it.err = err
+      return false
+    }
+    it.conn = conn
+  }
+  batch, end, err := it.consumer.fetchSet(it.conn)
+  it.batch, it.next, it.end = batch, 0, end
+  if err != nil {
+    // hand out what was decoded before the error first
+    it.fetchErr = err
+    it.Close()
+  }
+  if len(batch) > 0 {
+    return true
+  }
+  if err != nil {
+    it.err = err
+  }
+  return false
+}
+
+// Fetch and decode a message set at the consumer's offset for the pull based readers, leaving the offset,
+// the OffsetStore, the filters and the counters for them to update as the messages are used.
+// Returns the messages and the offset following them.
+func (consumer *BrokerConsumer) fetchSet(conn net.Conn) ([]*Message, uint64, error) {
+  if consumer.isClosed() {
+    return nil, consumer.offset, ErrConsumerClosed
+  }
+  if err := consumer.loadStoredOffset(); err != nil {
+    return nil, consumer.offset, err
+  }
+  consumer.resolveLatestOffset(conn)
+  defer consumer.holdFetchBuffer()()
+  _, payload, err := consumer.fetchComplete(conn)
+  if err != nil {
+    return nil, consumer.offset, consumer.reportFetch(conn, consumer.offset, 0, err)
+  }
+  if next := completeFramesLength(payload); consumer.Prefetch && next > 0 {
+    consumer.startPrefetch(conn, consumer.offset+next)
+  }
+
+  var msgs []*Message
+  var consumed uint64
+  for {
+    decoded, n, decodeErr := decodeMessageSet(payload[consumed:], consumer.offset+consumed, consumer.codecs, consumer.messageFormat())
+    msgs = append(msgs, decoded...)
+    consumed += n
+    err = decodeErr
+    if err == nil || !consumer.SkipCorrupted {
+      break
+    }
+    // only complete messages are decoded, so the next one starts after the corrupt one
+    consumer.corrupted.Add(1)
+    consumer.broker.logger.Printf("ERROR: [%s] skipping corrupt message at offset %d: %v\n", consumer.broker.topic, consumer.offset+consumed, err)
+    consumed += 4 + uint64(binary.BigEndian.Uint32(payload[consumed:]))
+  }
+  for _, msg := range msgs {
+    msg.partition = consumer.broker.partition
+    msg.targetPartition = consumer.broker.partition
+  }
+  if err != nil {
+    err = consumer.reportFetch(conn, consumer.offset, 0, err)
+  }
+  return msgs, consumer.offset + consumed, err
+}
@@ -25,6 +25,8 @@ package kafka
 import (
   "bytes"
   "encoding/binary"
+  "errors"
+  "fmt"
 )
 
 type RequestType uint16
@@ -50,6 +52,75 @@ func (b *Broker) EncodeRequestHeader(requestType RequestType) *bytes.Buffer {
   return request
 }
 
+// Returned (wrapped, test with errors.Is) by the Decode*Request functions for bytes that aren't a request of that type
+var ErrMalformedRequest = errors.New("malformed request")
+
+// An offsets request, as EncodeOffsetRequest puts it on the wire
+type OffsetRequest struct {
+  Topic         string
+  Partition     int
+  Time          int64 // -1 for the latest offset, -2 for the earliest
+  MaxNumOffsets uint32
+}
+
+// The bytes of the fetch request for fetch, for inspecting or logging what a consumer sends
+func (fetch FetchRequest) Encode() []byte {
+  b := &Broker{topic: fetch.Topic, partition: fetch.Partition}
+  return b.EncodeConsumeRequest(fetch.Offset, fetch.MaxSize)
+}
+
+// The bytes of the offsets request for request, see FetchRequest.Encode
+func (request OffsetRequest) Encode() []byte {
+  b := &Broker{topic: request.Topic, partition: request.Partition}
+  return b.EncodeOffsetRequest(request.Time, request.MaxNumOffsets)
+}
+
+// Read back a request from EncodeConsumeRequest (size prefix included)
+func DecodeConsumeRequest(request []byte) (FetchRequest, error) {
+  topic, partition, body, err := decodeRequestHeader(request, REQUEST_FETCH, 8+4)
+  if err != nil {
+    return FetchRequest{}, err
+  }
+  return FetchRequest{
+    Topic:     topic,
+    Partition: partition,
+    Offset:    binary.BigEndian.Uint64(body),
+    MaxSize:   binary.BigEndian.Uint32(body[8:])}, nil
+}
+
+// Read back a request from EncodeOffsetRequest (size prefix included)
+func DecodeOffsetRequest(request []byte) (OffsetRequest, error) {
+  topic, partition, body, err := decodeRequestHeader(request, REQUEST_OFFSETS, 8+4)
+  if err != nil {
+    return OffsetRequest{}, err
+  }
+  return OffsetRequest{
+    Topic:         topic,
+    Partition:     partition,
+    Time:          int64(binary.BigEndian.Uint64(body)),
+    MaxNumOffsets: binary.BigEndian.Uint32(body[8:])}, nil
+}
+
+// Check the size and type of request and split its header off, leaving a body of bodySize bytes
+func decodeRequestHeader(request []byte, requestType RequestType, bodySize int) (string, int, []byte, error) {
+  if len(request) < 4+2+2 {
+    return "", 0, nil, fmt.Errorf("%w: %d bytes is shorter than a request header", ErrMalformedRequest, len(request))
+  }
+  if size := binary.BigEndian.Uint32(request); int(size) != len(request)-4 {
+    return "", 0, nil, fmt.Errorf("%w: size %d but %d bytes follow", ErrMalformedRequest, size, len(request)-4)
+  }
+  if found := RequestType(binary.BigEndian.Uint16(request[4:])); found != requestType {
+    return "", 0, nil, fmt.Errorf("%w: request type %d, expected %d", ErrMalformedRequest, found, requestType)
+  }
+  topicLength := int(binary.BigEndian.Uint16(request[6:]))
+  if len(request) != 4+2+2+topicLength+4+bodySize {
+    return "", 0, nil, fmt.Errorf("%w: %d bytes for a topic of %d", ErrMalformedRequest, len(request), topicLength)
+  }
+  topic := string(request[8 : 8+topicLength])
+  partition := int(binary.BigEndian.Uint32(request[8+topicLength:]))
+  return topic, partition, request[8+topicLength+4:], nil
+}
+
 // after writing to the buffer is complete, encode the size of the request in the request.
 func encodeRequestSize(request *bytes.Buffer) {
   binary.BigEndian.PutUint32(request.Bytes()[0:], uint32(request.Len()-4))
@@ -87,11 +158,7 @@ func (b *Broker) EncodePublishRequest(messages ...*Message) []byte {
   messageSetSizePos := request.Len()
   request.Write(uint32bytes(0)) // placeholder message len
 
-  written := 0
-  for _, message := range messages {
-    wrote, _ := request.Write(message.Encode())
-    written += wrote
-  }
+  written, _ := request.Write(EncodeMessageSet(messages))
 
   // now add the accumulated size of that the message set was
   binary.BigEndian.PutUint32(request.Bytes()[messageSetSizePos:], uint32(written))
@@ -99,3 +166,23 @@ func (b *Broker) EncodePublishRequest(messages ...*Message) []byte {
   encodeRequestSize(request)
   return request.Bytes()
 }
+
+// <REQUEST_SIZE: uint32><REQUEST_TYPE: uint16><NUMBER OF FETCHES: uint16>
+//   (<TOPIC SIZE: uint16><TOPIC: bytes><PARTITION: uint32><OFFSET: uint64><MAX SIZE: uint32>)...
+func EncodeMultiFetchRequest(fetches []FetchRequest) []byte {
+  request := bytes.NewBuffer([]byte{})
+  request.Write(uint32bytes(0)) // placeholder for request size
+  request.Write(uint16bytes(REQUEST_MULTIFETCH))
+  request.Write(uint16bytes(len(fetches)))
+  for _, fetch := range fetches {
+    request.Write(uint16bytes(len(fetch.Topic)))
+    request.WriteString(fetch.Topic)
+    request.Write(uint32bytes(fetch.Partition))
+    request.Write(uint64ToUint64bytes(fetch.Offset))
+    request.Write(uint32toUint32bytes(fetch.MaxSize))
+  }
+
+  encodeRequestSize(request)
+
+  return request.Bytes()
+}
@@ -0,0 +1,252 @@
+/*
+ *  Copyright (c) 2011 NeuStar, Inc.
+ *  All rights reserved.  
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at 
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *  
+ *  NeuStar, the Neustar logo and related names and logos are registered
+ *  trademarks, service marks or tradenames of NeuStar, Inc. All other 
+ *  product names, company names, marks, logos and symbols may be trademarks
+ *  of their respective owners.
+ */
+
+package kafka
+
+import (
+  "bytes"
+  "encoding/binary"
+  "errors"
+)
+
+// Snappy (https://github.com/google/snappy) compression, in the block format, optionally in the
+// framing written by the JVM clients' snappy-java streams:
+// <MAGIC: 8 bytes><VERSION: int32><MIN COMPATIBLE VERSION: int32>(<BLOCK LENGTH: int32><BLOCK: bytes>)...
+
+const (
+  SNAPPY_COMPRESSION_ID = 2
+  // input is compressed in blocks of this size, so copy offsets stay within 2 bytes
+  snappyBlockSize = 65536
+  // entries in the match finder's hash table
+  snappyTableBits = 14
+)
+
+var (
+  xerialMagic  = []byte{0x82, 'S', 'N', 'A', 'P', 'P', 'Y', 0}
+  xerialHeader = append(append([]byte{}, xerialMagic...), 0, 0, 0, 1, 0, 0, 0, 1)
+
+  errSnappyCorrupt = errors.New("corrupt snappy data")
+)
+
+type SnappyPayloadCodec struct {
+}
+
+func (codec *SnappyPayloadCodec) Id() byte {
+  return SNAPPY_COMPRESSION_ID
+}
+
+// Compresses in the snappy-java framing, which the JVM clients require
+func (codec *SnappyPayloadCodec) Encode(data []byte) []byte {
+  buf := bytes.NewBuffer(append([]byte{}, xerialHeader...))
+  for start := 0; start < len(data); start += snappyBlockSize {
+    end := start + snappyBlockSize
+    if end > len(data) {
+      end = len(data)
+    }
+    block := snappyEncode(data[start:end])
+    buf.Write(uint32bytes(len(block)))
+    buf.Write(block)
+  }
+  return buf.Bytes()
+}
+
+// Decompresses either framed or bare block data, corrupt data decodes to an empty payload (see DecodeE)
+func (codec *SnappyPayloadCodec) Decode(data []byte) []byte {
+  decoded, err := codec.DecodeE(data)
+  if err != nil {
+    return []byte{}
+  }
+  return decoded
+}
+
+// Like Decode, but corrupt data is an error, which decoding a message reports rather than passing on nothing
+func (codec *SnappyPayloadCodec) DecodeE(data []byte) ([]byte, error) {
+  return snappyDecodeFramed(data)
+}
+
+func snappyDecodeFramed(data []byte) ([]byte, error) {
+  if !bytes.HasPrefix(data, xerialMagic) {
+    return snappyDecode(data)
+  }
+  if len(data) < len(xerialHeader) {
+    return nil, errSnappyCorrupt
+  }
+  decoded := []byte{}
+  for rest := data[len(xerialHeader):]; len(rest) > 0; {
+    if len(rest) < 4 {
+      return nil, errSnappyCorrupt
+    }
+    size := uint64(binary.BigEndian.Uint32(rest))
+    if uint64(len(rest)-4) < size {
+      return nil, errSnappyCorrupt
+    }
+    block, err := snappyDecode(rest[4 : 4+size])
+    if err != nil {
+      return nil, err
+    }
+    decoded = append(decoded, block...)
+    rest = rest[4+size:]
+  }
+  return decoded, nil
+}
+
+// <UNCOMPRESSED LENGTH: uvarint>(<TAG: byte><...>)...
+// The low 2 bits of a tag give the element type: a literal, or a copy of earlier output with a 1, 2 or 4 byte offset.
+func snappyDecode(src []byte) ([]byte, error) {
+  length, n := binary.Uvarint(src)
+  if n <= 0 || length > uint64(len(src))*255 {
+    return nil, errSnappyCorrupt
+  }
+  dst := make([]byte, 0, length)
+  for s := n; s < len(src); {
+    tag := src[s]
+    s++
+    switch tag & 0x03 {
+    case 0x00:
+      size := uint64(tag >> 2)
+      if size >= 60 {
+        extra := int(size - 59)
+        if s+extra > len(src) {
+          return nil, errSnappyCorrupt
+        }
+        size = 0
+        for i := extra - 1; i >= 0; i-- {
+          size = size<<8 | uint64(src[s+i])
+        }
+        s += extra
+      }
+      size++
+      if uint64(len(src)-s) < size {
+        return nil, errSnappyCorrupt
+      }
+      dst = append(dst, src[s:s+int(size)]...)
+      s += int(size)
+      continue
+    case 0x01:
+      if s+1 > len(src) {
+        return nil, errSnappyCorrupt
+      }
+      offset := int(tag&0xe0)<<3 | int(src[s])
+      s++
+      if err := snappyCopy(&dst, offset, 4+int(tag>>2&0x07)); err != nil {
+        return nil, err
+      }
+    case 0x02:
+      if s+2 > len(src) {
+        return nil, errSnappyCorrupt
+      }
+      offset := int(binary.LittleEndian.Uint16(src[s:]))
+      s += 2
+      if err := snappyCopy(&dst, offset, 1+int(tag>>2)); err != nil {
+        return nil, err
+      }
+    case 0x03:
+      if s+4 > len(src) {
+        return nil, errSnappyCorrupt
+      }
+      offset := int(binary.LittleEndian.Uint32(src[s:]))
+      s += 4
+      if err := snappyCopy(&dst, offset, 1+int(tag>>2)); err != nil {
+        return nil, err
+      }
+    }
+  }
+  if uint64(len(dst)) != length {
+    return nil, errSnappyCorrupt
+  }
+  return dst, nil
+}
+
+// Append size bytes starting offset back from the end of dst, which may overlap what's being appended
+func snappyCopy(dst *[]byte, offset int, size int) error {
+  if offset <= 0 || offset > len(*dst) {
+    return errSnappyCorrupt
+  }
+  start := len(*dst) - offset
+  for i := 0; i < size; i++ {
+    *dst = append(*dst, (*dst)[start+i])
+  }
+  return nil
+}
+
+// Compress one block of up to snappyBlockSize bytes, finding matches of 4 bytes or more with a hash table
+func snappyEncode(src []byte) []byte {
+  dst := make([]byte, binary.MaxVarintLen64, len(src)+len(src)/6+32)
+  dst = dst[:binary.PutUvarint(dst, uint64(len(src)))]
+
+  var table [1 << snappyTableBits]int32 // position+1 of the last 4 bytes hashing to each entry
+  literalStart := 0
+  for s := 0; s+4 <= len(src); {
+    word := binary.LittleEndian.Uint32(src[s:])
+    h := (word * 0x1e35a7bd) >> (32 - snappyTableBits)
+    candidate := int(table[h]) - 1
+    table[h] = int32(s + 1)
+    if candidate < 0 || binary.LittleEndian.Uint32(src[candidate:]) != word {
+      s++
+      continue
+    }
+
+    dst = snappyLiteral(dst, src[literalStart:s])
+    size := 4
+    for s+size < len(src) && src[candidate+size] == src[s+size] {
+      size++
+    }
+    dst = snappyCopyElements(dst, s-candidate, size)
+    s += size
+    literalStart = s
+  }
+  return snappyLiteral(dst, src[literalStart:])
+}
+
+func snappyLiteral(dst []byte, literal []byte) []byte {
+  if len(literal) == 0 {
+    return dst
+  }
+  n := len(literal) - 1
+  switch {
+  case n < 60:
+    dst = append(dst, byte(n<<2))
+  case n < 1<<8:
+    dst = append(dst, 60<<2, byte(n))
+  default:
+    // blocks are at most snappyBlockSize, so 2 bytes always suffice
+    dst = append(dst, 61<<2, byte(n), byte(n>>8))
+  }
+  return append(dst, literal...)
+}
+
+// A match may be longer than one copy element can say, emit as many as it takes
+func snappyCopyElements(dst []byte, offset int, size int) []byte {
+  for size > 0 {
+    n := size
+    if n > 64 {
+      n = 64
+    }
+    if n >= 4 && n <= 11 && offset < 2048 {
+      dst = append(dst, byte(offset>>8)<<5|byte(n-4)<<2|0x01, byte(offset))
+    } else {
+      dst = append(dst, byte(n-1)<<2|0x02, byte(offset), byte(offset>>8))
+    }
+    size -= n
+  }
+  return dst
+}
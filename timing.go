@@ -23,7 +23,6 @@
 package kafka
 
 import (
-  "log"
   "time"
 )
 
@@ -41,9 +40,20 @@ func (t *Timing) Stop() {
   t.stop = time.Now().UnixNano()
 }
 
-func (t *Timing) Print() {
+// The measured interval from start to Stop, stopping first if Stop hasn't been called
+func (t *Timing) Duration() time.Duration {
   if t.stop == 0 {
     t.Stop()
   }
-  log.Printf("%s took: %f ms\n", t.label, float64(t.stop-t.start)/1000000)
+  return time.Duration(t.stop - t.start)
+}
+
+// The time since start, without stopping
+func (t *Timing) Elapsed() time.Duration {
+  return time.Duration(time.Now().UnixNano() - t.start)
+}
+
+// Log the measured interval (see Duration) through DefaultLogger
+func (t *Timing) Print() {
+  DefaultLogger.Printf("%s took: %f ms\n", t.label, float64(t.Duration())/float64(time.Millisecond))
 }
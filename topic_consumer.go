@@ -0,0 +1,155 @@
+/*
+ *  Copyright (c) 2011 NeuStar, Inc.
+ *  All rights reserved.  
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at 
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *  
+ *  NeuStar, the Neustar logo and related names and logos are registered
+ *  trademarks, service marks or tradenames of NeuStar, Inc. All other 
+ *  product names, company names, marks, logos and symbols may be trademarks
+ *  of their respective owners.
+ */
+
+package kafka
+
+import (
+  "errors"
+  "fmt"
+  "sync"
+)
+
+const (
+  // the most partitions DiscoverPartitions probes for
+  MAX_DISCOVERED_PARTITIONS = 1024
+)
+
+// A failure of one partition's consumer in a TopicConsumer
+type PartitionError struct {
+  Partition int
+  Err       error
+}
+
+func (e *PartitionError) Error() string {
+  return fmt.Sprintf("partition %d: %v", e.Partition, e.Err)
+}
+
+func (e *PartitionError) Unwrap() error {
+  return e.Err
+}
+
+// Consumes every partition of a topic, with one BrokerConsumer per partition, merging their messages
+type TopicConsumer struct {
+  consumers []*BrokerConsumer
+}
+
+// Create a consumer for partitions 0 to partitions-1 of topic (see DiscoverPartitions), each starting
+// at offset and fetching up to maxSize bytes at a time
+func NewTopicConsumer(hostname string, topic string, partitions int, offset uint64, maxSize uint32) *TopicConsumer {
+  consumers := make([]*BrokerConsumer, partitions)
+  for partition := range consumers {
+    consumers[partition] = NewBrokerConsumer(hostname, topic, partition, offset, maxSize)
+  }
+  return &TopicConsumer{consumers: consumers}
+}
+
+// Count the partitions of topic on the broker. Kafka 0.7 brokers don't describe their topics, so this
+// asks for the offsets of partition 0, 1, ... until one is reported invalid.
+func DiscoverPartitions(hostname string, topic string) (int, error) {
+  for partition := 0; partition < MAX_DISCOVERED_PARTITIONS; partition++ {
+    consumer := NewBrokerOffsetConsumer(hostname, topic, partition)
+    _, err := consumer.GetOffsets(-1, 1)
+    consumer.Close()
+    if errors.Is(err, ErrInvalidPartition) {
+      return partition, nil
+    }
+    if err != nil {
+      return 0, err
+    }
+  }
+  return 0, fmt.Errorf("more than %d partitions found for %s", MAX_DISCOVERED_PARTITIONS, topic)
+}
+
+// The per partition consumers, indexed by partition, e.g. to set options before consuming
+func (tc *TopicConsumer) Consumers() []*BrokerConsumer {
+  return tc.consumers
+}
+
+// Close the consumers of all of the partitions, see BrokerConsumer.Close
+func (tc *TopicConsumer) Close() error {
+  var err error
+  for _, consumer := range tc.consumers {
+    if closeErr := consumer.Close(); closeErr != nil && err == nil {
+      err = closeErr
+    }
+  }
+  return err
+}
+
+// Consume all partitions concurrently, as ConsumeOnChannelE does for one, delivering their messages on msgChan
+// (Partition() and Offset() say where each came from) until quit, or until every partition has failed.
+// A partition that fails stops on its own, its *PartitionError is sent on errChan if that's not nil
+// (keep receiving from it, or give it room for an error per partition).
+// msgChan is closed once every partition has stopped; as with ConsumeOnChannelE, keep receiving until it is.
+// Returns the number of messages delivered.
+func (tc *TopicConsumer) ConsumeOnChannel(msgChan chan *Message, errChan chan error, pollTimeoutMs int64, quit chan bool) int {
+  var lock sync.Mutex
+  total := 0
+  stopping := make(chan bool)
+  var wg sync.WaitGroup
+  for _, consumer := range tc.consumers {
+    wg.Add(1)
+    go func(consumer *BrokerConsumer) {
+      defer wg.Done()
+      partitionChan := make(chan *Message)
+      forwarded := make(chan bool)
+      go func() {
+        for msg := range partitionChan {
+          msgChan <- msg
+        }
+        close(forwarded)
+      }()
+
+      num, err := consumer.ConsumeOnChannelE(partitionChan, pollTimeoutMs, stopping)
+      if num < 0 {
+        // failed to connect, so partitionChan wasn't closed
+        close(partitionChan)
+        num = 0
+      }
+      <-forwarded
+      lock.Lock()
+      total += num
+      lock.Unlock()
+
+      if err != nil && errChan != nil {
+        select {
+        case errChan <- &PartitionError{Partition: consumer.broker.partition, Err: err}:
+        case <-stopping:
+        }
+      }
+    }(consumer)
+  }
+
+  stopped := make(chan bool)
+  go func() {
+    wg.Wait()
+    close(stopped)
+  }()
+  select {
+  case <-quit:
+  case <-stopped:
+  }
+  close(stopping) // quits every partition still running
+  <-stopped
+  close(msgChan)
+  return total
+}
@@ -0,0 +1,188 @@
+/*
+ *  Copyright (c) 2011 NeuStar, Inc.
+ *  All rights reserved.  
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at 
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *  
+ *  NeuStar, the Neustar logo and related names and logos are registered
+ *  trademarks, service marks or tradenames of NeuStar, Inc. All other 
+ *  product names, company names, marks, logos and symbols may be trademarks
+ *  of their respective owners.
+ */
+
+package kafka
+
+import (
+  "encoding/binary"
+  "errors"
+  "fmt"
+  "io"
+  "os"
+)
+
+// Consumer that writes each message to a local write-ahead log before handling it, and clears the
+// log once the handler returns, so a crash mid-handler can be recovered from the log on restart
+// rather than by refetching (which may be impossible once the broker's retention has passed).
+//
+// The log holds the message in flight, with its position in the compressed set holding it:
+// <OFFSET: uint64><NEXT OFFSET: uint64><INDEX: uint32><REMAINING: uint32><MESSAGE: encoded as by Message.Encode>
+//
+// On startup call Recover (Consume does so itself): a message found in the log is replayed to the
+// handler, the consumer resumes after it, then the log is cleared.
+type WALConsumer struct {
+  consumer  *BrokerConsumer
+  wal       *os.File
+  recovered bool
+  // after recovering a message from the middle of a compressed set, the set is fetched again and its
+  // messages up to skipIndex (handled before the crash) are passed over
+  skipping   bool
+  skipOffset uint64
+  skipIndex  int
+}
+
+// Wrap consumer with the write-ahead log at path, created if missing
+func NewWALConsumer(consumer *BrokerConsumer, path string) (*WALConsumer, error) {
+  wal, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+  if err != nil {
+    return nil, err
+  }
+  return &WALConsumer{consumer: consumer, wal: wal}, nil
+}
+
+// Replay a message left in the log by an earlier run, then clear the log.
+// The consumer's offset is moved past the replayed message if it isn't already; when the message is
+// followed by others in its compressed set, the consumer goes back to the set and Consume passes over
+// the messages up to and including the replayed one.
+// Returns the number of messages replayed.
+func (w *WALConsumer) Recover(handlerFunc MessageHandlerFunc) (int, error) {
+  w.recovered = true
+  if _, err := w.wal.Seek(0, io.SeekStart); err != nil {
+    return 0, err
+  }
+  record, err := io.ReadAll(w.wal)
+  if err != nil {
+    return 0, err
+  }
+  if len(record) == 0 {
+    return 0, nil
+  }
+  if len(record) < 24 {
+    return 0, errors.New("write-ahead log truncated")
+  }
+
+  msgs, _, err := decode(record[24:], w.consumer.codecs, w.consumer.messageFormat())
+  if err != nil {
+    return 0, fmt.Errorf("write-ahead log holds a corrupt message: %w", err)
+  }
+  if len(msgs) == 0 {
+    return 0, errors.New("write-ahead log holds a corrupt message")
+  }
+  msg := &msgs[0]
+  msg.offset = binary.BigEndian.Uint64(record[0:])
+  msg.nextOffset = binary.BigEndian.Uint64(record[8:])
+  msg.index = int(binary.BigEndian.Uint32(record[16:]))
+  remaining := int(binary.BigEndian.Uint32(record[20:]))
+  msg.setSize = msg.index + 1 + remaining
+  msg.partition = w.consumer.broker.partition
+  msg.targetPartition = w.consumer.broker.partition
+  handlerFunc(msg)
+
+  if w.consumer.offset < msg.nextOffset {
+    if remaining > 0 {
+      // the rest of the set was never handled, and is only fetched along with the whole set
+      w.consumer.setOffset(msg.offset)
+      w.skipping, w.skipOffset, w.skipIndex = true, msg.offset, msg.index
+    } else {
+      w.consumer.setOffset(msg.nextOffset)
+    }
+  }
+  return 1, w.clear()
+}
+
+// Consume the available messages, logging each one before it is handed to handlerFunc.
+// Recovers a message left by an earlier run first.
+func (w *WALConsumer) Consume(handlerFunc MessageHandlerFunc) (int, error) {
+  replayed := 0
+  if !w.recovered {
+    var err error
+    if replayed, err = w.Recover(handlerFunc); err != nil {
+      return replayed, err
+    }
+  }
+
+  var walErr error
+  var unlogged *Message
+  passedOver := 0
+  num, err := w.consumer.ConsumeUntil(func(msg *Message) bool {
+    return walErr != nil
+  }, func(msg *Message) {
+    if w.handledBefore(msg) {
+      passedOver++
+      return
+    }
+    if walErr = w.append(msg); walErr != nil {
+      unlogged = msg
+      return
+    }
+    handlerFunc(msg)
+    walErr = w.clear()
+  })
+  if unlogged != nil {
+    // it was never handled, so leave the consumer in front of it
+    w.consumer.setOffset(unlogged.offset)
+    num--
+  }
+  if err == nil {
+    err = walErr
+  }
+  return replayed + num - passedOver, err
+}
+
+// Whether msg was handled before the crash Recover recovered from, see skipIndex
+func (w *WALConsumer) handledBefore(msg *Message) bool {
+  if !w.skipping {
+    return false
+  }
+  if msg.offset != w.skipOffset {
+    w.skipping = false
+    return false
+  }
+  return msg.index <= w.skipIndex
+}
+
+// Close the write-ahead log
+func (w *WALConsumer) Close() error {
+  return w.wal.Close()
+}
+
+func (w *WALConsumer) append(msg *Message) error {
+  remaining := 0
+  if msg.setSize > msg.index {
+    remaining = msg.setSize - msg.index - 1
+  }
+  record := append(uint64ToUint64bytes(msg.offset), uint64ToUint64bytes(msg.nextOffset)...)
+  record = append(record, uint32toUint32bytes(uint32(msg.index))...)
+  record = append(record, uint32toUint32bytes(uint32(remaining))...)
+  record = append(record, msg.Encode()...)
+  if _, err := w.wal.WriteAt(record, 0); err != nil {
+    return err
+  }
+  return w.wal.Sync()
+}
+
+func (w *WALConsumer) clear() error {
+  if err := w.wal.Truncate(0); err != nil {
+    return err
+  }
+  return w.wal.Sync()
+}